@@ -1,6 +1,9 @@
 package assistant
 
 import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
     "fmt"
     "io/ioutil"
     "log"
@@ -10,149 +13,541 @@ import (
     "bytes"
     "bufio"
     "path/filepath"
-    "time" // Import time package
 
     "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+    "github.com/thomasdullien/coding-assistant/assistant/cost"
+    "github.com/thomasdullien/coding-assistant/assistant/llm"
+    "github.com/thomasdullien/coding-assistant/assistant/prompts"
+    "github.com/thomasdullien/coding-assistant/assistant/redact"
+    "github.com/thomasdullien/coding-assistant/assistant/tokens"
     "github.com/thomasdullien/coding-assistant/assistant/types"
 )
 
-// ProcessAssistant handles the main workflow
-func ProcessAssistant(data types.FormData) (string, error) {
+// Result is the outcome of a job. Usage is filled in even if the job failed.
+type Result struct {
+    PRLink     string
+    Usage      *cost.Ledger
+    Candidates []string // How each candidate did, if the job generated several
+    Redactions string   // The secrets masked before sending, empty if there were none
+}
+
+// maxAttempts is the number of replies the model gets to produce changes
+// that build and pass the tests.
+const maxAttempts = 2
+
+// ProcessAssistant handles the main workflow. Progress updates are sent to
+// progress, which may be nil. Cancelling ctx aborts the job, including
+// pending model requests and running builds.
+func ProcessAssistant(ctx context.Context, data types.FormData, progress types.ProgressFunc) (Result, error) {
+    if progress == nil {
+        progress = func(types.ProgressUpdate) {}
+    }
+    result := Result{Usage: &cost.Ledger{}}
+
+    err := processAssistant(ctx, data, progress, &result)
+    log.Printf("Job usage: %s", result.Usage.Summary())
+    return result, err
+}
+
+// processAssistant runs the steps of ProcessAssistant, filling in result
+// as it goes.
+func processAssistant(ctx context.Context, data types.FormData, progress types.ProgressFunc, result *Result) error {
+    // Check the candidate options before anything costs time or money
+    count, rules, err := candidateOptions(&data)
+    if err != nil {
+        return err
+    }
+    // Name the files to change by their path in the repository, with or without "repo/"
+    for i, file := range data.Files {
+        data.Files[i], err = repoPath(file)
+        if err != nil {
+            return fmt.Errorf("invalid file to change: %v", err)
+        }
+    }
+
+    // Pick the LLM provider for this job
+    provider, err := llm.NewProvider(data.Provider)
+    if err != nil {
+        return err
+    }
+    // Answer repeated requests from the response cache, unless the job asks for fresh replies
+    if data.BypassCache {
+        log.Printf("Response cache bypassed for this job")
+    } else {
+        provider, err = llm.NewCachedProvider(provider)
+        if err != nil {
+            return err
+        }
+    }
+
+    // Mask secrets in everything sent to the model and in the logs
+    redactor := redact.New()
+    ctx = redact.NewContext(ctx, redactor)
+    provider = llm.NewRedactingProvider(provider, redactor)
+    defer func() {
+        result.Redactions = redactor.Report()
+    }()
+
+    // Settle the model and sampling parameters, from the job and the server configuration
+    data.Params, err = llm.ResolveParams(provider, data.Params)
+    if err != nil {
+        return err
+    }
+    log.Printf("Using LLM provider %s with model %s", provider.Name(), data.Params.Model)
+    if len(data.Params.Escalation) > 0 {
+        log.Printf("Escalating to %s after build or test failures", strings.Join(data.Params.Escalation, ", "))
+    }
+
     // Clone repository and create branch
-    log.Println("Cloning repository and creating branch...")
-    err := cloneAndCheckoutRepo(&data)
+    reportStage(progress, "Cloning repository and creating branch...")
+    err = cloneAndCheckoutRepo(&data)
     if err != nil {
-        return "", fmt.Errorf("failed to clone repository: %v", err)
+        return fmt.Errorf("failed to clone repository: %v", err)
     }
 
     var deps []string
     // Calculate dependencies for C++ code.
     if (data.RepoType == "C++") {
-        log.Println("Calculating C++ dependencies...")
+        reportStage(progress, "Calculating C++ dependencies...")
         deps, err = calculateDependencies(data.Files)
         for i, dep := range deps {
           log.Printf("Dependency %d: %s", i, dep)
         }
         if err != nil {
-          return "", fmt.Errorf("failed to calculate dependencies: %v", err)
+          return fmt.Errorf("failed to calculate dependencies: %v", err)
         }
     } else if data.RepoType == "Golang" {
         // For Golang repositories, include the entire repository
-        log.Println("Including entire repository for Golang.")
+        reportStage(progress, "Including entire repository for Golang.")
         deps, err = includeEntireRepo("repo")
         if err != nil {
-            return "", fmt.Errorf("failed to include entire repository: %v", err)
+            return fmt.Errorf("failed to include entire repository: %v", err)
         }
     }
 
-    // Prepare prompt
+    // Render the system prompt for the language of the repository and the reply format
+    if data.EditFormat == "json" && !structuredOutput(&data, provider) {
+        log.Printf("%s does not support structured output, falling back to file markers", provider.Name())
+    }
+    if data.EditFormat == "declarations" && data.RepoType != "Golang" && data.RepoType != "C++" {
+        log.Printf("Declaration merging needs a Go or C++ repository, falling back to file markers")
+    }
+    systemPrompt, err := prompts.System("repo", data.RepoType, data.Files, replyFormat(&data, provider))
+    if err != nil {
+        return err
+    }
+    systemPrompt = redactor.Redact(systemPrompt)
+    log.Printf("System prompt: %d tokens, %s", tokens.Count(systemPrompt), contentDigest(systemPrompt))
+
+    // Prepare prompt, for the smallest context window of the models the job may use
     log.Println("Preparing prompt...")
-    prompt := buildPrompt(data.Prompt, deps)
-    // Log the prompt for debugging
-    log.Println("Prompt:", prompt)
-
-    // Query ChatGPT and apply changes iteratively
-    for attempts := 0; attempts < 2; attempts++ {
-        log.Printf("Applying changes, attempt %d...", attempts+1)
-        err := applyChangesWithChatGPT(&data, prompt)
+    model := data.Params.Model
+    for _, m := range data.Params.Escalation {
+        if tokens.InputBudget(m) < tokens.InputBudget(model) {
+            model = m
+        }
+    }
+    budget := tokens.InputBudget(model) - tokens.Count(systemPrompt)
+    prompt, report, err := buildPrompt(data.Prompt, deps, data.Files, budget, redactor)
+    if err != nil {
+        return fmt.Errorf("prompt does not fit the context window of %s: %v", model, err)
+    }
+    reportStage(progress, report.String())
+    if redactions := redactor.Report(); redactions != "" {
+        reportStage(progress, redactions)
+    }
+    log.Printf("Prompt: %d tokens, %s", tokens.Count(prompt), contentDigest(prompt))
+
+    // The conversation with the model: the prompt, then for every attempt
+    // the model's reply and the diagnostics it has to address. Each
+    // candidate continues it on its own.
+    history := []chatgpt.Message{{Role: "user", Content: prompt}}
+
+    // Generate the candidates one after the other
+    if count > 1 {
+        removeWorktrees()
+        defer removeWorktrees()
+    }
+    var candidates []*candidate
+    for i := 1; i <= count; i++ {
+        c, err := newCandidate(i, count)
         if err != nil {
-            return "", fmt.Errorf("failed to apply changes: %v", err)
+            return err
+        }
+        candidates = append(candidates, c)
+        err = c.run(ctx, provider, data, systemPrompt, history, budget, progress)
+        result.Usage.Merge(c.usage)
+        if count > 1 {
+            reportStage(progress, c.summary())
+            result.Candidates = summarizeCandidates(candidates, nil)
+        }
+        if err != nil {
+            return err
         }
+    }
 
-        log.Println("Running build...")
-        builderr, buildout := runTestsOrBuild(data.RepoType, true)
-        if !builderr {
-          log.Println("Build successful.")
-        } else {
-          prompt += "\nBuild failed, please address the following issues:\n" + buildout
-          continue
+    // Pick the passing candidate with the smallest diff
+    winner := selectCandidate(candidates, rules)
+    if count > 1 {
+        result.Candidates = summarizeCandidates(candidates, winner)
+    }
+    if winner == nil {
+        log.Println("Exceeded maximum attempts, please review manually.")
+        if count > 1 {
+            return fmt.Errorf("None of the %d candidates passed the build and the tests, please review.", count)
+        }
+        return fmt.Errorf("Exceeded maximum attempts to fix the test, please review.")
+    }
+    if count > 1 {
+        reportStage(progress, fmt.Sprintf("Selected candidate %d, copying its changes...", winner.index))
+        if err := winner.copyTo("repo"); err != nil {
+            return err
         }
+    }
 
-        // Run tests and create pull request if successful
-        log.Println("Running tests...")
-        // For the moment, assume that Golang tests always pass. This
-        // needs to change in the future.
-        testerr, output := runTestsOrBuild(data.RepoType, false)
+    // Name the branch after the summary of the change
+    if data.Branch == "assistant-branch" {
+        data.Branch, err = renameBranch(data.Branch, winner.description.Summary)
+        if err != nil {
+            return err
+        }
+    }
 
-        if !testerr {
-            log.Println("Tests passed, creating pull request...")
-            err1 := commitAndPush(&data)
-            if err1 != nil {
-              return "", fmt.Errorf("failed to commit and push changes: %v", err1)
-            }
-            log.Println("Changes pushed to branch.")
-            prlink, err := createPullRequest(&data)
-            if err != nil {
-                return "", fmt.Errorf("failed to create pull request: %v", err)
-            }
-            log.Printf("Pull request created: %s", prlink)
-            return prlink, nil
-        } else {
-          prompt += "\nTest failed, please address the following issues:\n" + output
-        }            
+    // Commit the changes and create the pull request
+    reportStage(progress, "Tests passed, creating pull request...")
+    err = commitAndPush(&data, winner.description)
+    if err != nil {
+        return fmt.Errorf("failed to commit and push changes: %v", err)
+    }
+    log.Println("Changes pushed to branch.")
+    prlink, err := createPullRequest(&data, winner.description, winner.testOutput)
+    if err != nil {
+        return fmt.Errorf("failed to create pull request: %v", err)
     }
-    log.Println("Exceeded maximum attempts, please review manually.")
-    return "", fmt.Errorf("Exceeded maximum attempts to fix the test, please review.")
+    log.Printf("Pull request created: %s", prlink)
+    result.PRLink = prlink
+    return nil
 }
 
-// applyChangesWithChatGPT sends a prompt to ChatGPT, retrieves the response, and applies any changes
-// specified in the response to the relevant files in the local repository.
-func applyChangesWithChatGPT(data *types.FormData, prompt string) error {
-    // Create a ChatGPT request with the initial prompt
-    request := chatgpt.CreateRequest(prompt)
+// applyChangesWithLLM sends the conversation to the job's LLM provider, retrieves the response, and
+// applies any changes specified in the response to the relevant files in the working copy at dir.
+// The reply is streamed, and every piece of it is forwarded to progress as it arrives. The token
+// usage of the request is recorded in ledger under label. The reply is returned, also if it could
+// not be applied; problems the model can fix are returned as a *responseError. If the changes were
+// applied, the model's description of them is returned too.
+func applyChangesWithLLM(ctx context.Context, provider llm.Provider, data *types.FormData, dir string, systemPrompt string, history []chatgpt.Message, progress types.ProgressFunc, ledger *cost.Ledger, label string) (string, changeDescription, error) {
+    // Use the structured JSON protocol if the job asks for it and the provider supports it,
+    // unified diffs or search/replace blocks if the job asks for them, and the delimited file
+    // protocol otherwise
+    format := replyFormat(data, provider)
+    structured := format == "json"
+
+    // Create a request with the conversation so far
+    var request chatgpt.ChatGPTRequest
+    if structured {
+        request = chatgpt.CreateStructuredRequest(data.Params.Model, systemPrompt, history)
+    } else {
+        request = chatgpt.CreateRequest(data.Params.Model, systemPrompt, history)
+    }
+    llm.ApplyParams(&request, data.Params)
 
-    // Send the request to ChatGPT and get a response
-    response, err := chatgpt.SendRequest(request)
-    if err != nil {
-        return fmt.Errorf("failed to get response from ChatGPT: %v", err)
+    // Offer the repository tools if the job asks for them and the provider supports them
+    useTools := data.UseTools && provider.SupportsTools()
+    if data.UseTools && !useTools {
+        log.Printf("%s does not support tools, sending the prompt only", provider.Name())
     }
+    if useTools {
+        request.Tools = repoTools
+    }
+    runner := &toolRunner{ctx: ctx, root: dir, repoType: data.RepoType}
+
+    // Stream the request to the provider, reporting partial output and the
+    // file currently being written. As long as the model calls tools, run
+    // them and send the results back; the tool calls only live in this
+    // request, the job history gets the final reply.
+    var reply chatgpt.Reply
+    for turn := 0; ; turn++ {
+        tracker := &fileTracker{progress: progress, format: format}
+        var err error
+        reply, err = provider.StreamRequest(ctx, request, func(delta string) {
+            progress(types.ProgressUpdate{Kind: "output", Text: delta})
+            tracker.write(delta)
+        })
+        if err != nil {
+            return "", changeDescription{}, fmt.Errorf("failed to get response from %s: %v", provider.Name(), err)
+        }
+        if turn == 0 {
+            recordUsage(ledger, progress, label, request, reply)
+        } else {
+            recordUsage(ledger, progress, fmt.Sprintf("%s, tool turn %d", label, turn), request, reply)
+        }
+        if len(reply.ToolCalls) == 0 {
+            break
+        }
+        // Servers may ignore the tool choice; never run more tool turns than allowed
+        if turn >= maxToolTurns {
+            return "", changeDescription{}, fmt.Errorf("%s kept calling tools after %d tool turns", provider.Name(), maxToolTurns)
+        }
+
+        request.Messages = append(request.Messages, chatgpt.Message{Role: "assistant", Content: reply.Content, ToolCalls: reply.ToolCalls})
+        for _, call := range reply.ToolCalls {
+            description := fmt.Sprintf("%s %s", call.Function.Name, redact.FromContext(ctx).Redact(call.Function.Arguments))
+            log.Printf("Tool call: %s", description)
+            progress(types.ProgressUpdate{Kind: "tool", Text: description})
+            result := runner.run(call)
+            log.Printf("Tool result: %d tokens, %s", tokens.Count(result), contentDigest(result))
+            request.Messages = append(request.Messages, chatgpt.Message{Role: "tool", Content: result, ToolCallID: call.ID})
+        }
 
-    // Parse the response to extract file contents based on delimiters
-    filesContent, summary, success := parseResponseForFiles(response)
-    if !success {
-        return fmt.Errorf("failed to parse files from ChatGPT response")
+        // Make the model reply once it has used up its tool turns or half
+        // of the context window, so there is room left for the files
+        if turn+1 >= maxToolTurns || countTokens(request.Messages) > tokens.InputBudget(request.Model)/2 {
+            log.Printf("Ending tool use after %d turns", turn+1)
+            request.ToolChoice = "none"
+            request.Messages = append(request.Messages, chatgpt.Message{
+                Role:    "user",
+                Content: "No more tool calls are available. Reply with the changed files now.",
+            })
+        }
     }
-    
-    if success {
-      err := renameBranch(summary)
-      data.Branch = fmt.Sprintf("assistant-%s-%s", summary, time.Now().Format("20060102150405")) // Update branch name with timestamp
-      if err != nil {
-        log.Fatalf("Error renaming branch: %v", err)
-      }
+    response := reply.Content
+
+    // Parse the response to extract file contents, either from the validated JSON, by applying
+    // the diff or the search/replace blocks to the working copy, or based on delimiters
+    var filesContent map[string]string
+    var ops fileOperations
+    var summary string
+    var description changeDescription
+    if format == "diff" {
+        diff, diffSummary, success := parseResponseForDiff(response)
+        if !success {
+            return response, changeDescription{}, newResponseError("no diff or no Summary line found; put the unified diff between the START OF DIFF and END OF DIFF markers")
+        }
+        var err error
+        description, err = parseChangeDescription(response)
+        if err != nil {
+            return response, changeDescription{}, &responseError{message: err.Error()}
+        }
+        // The model saw the files with their secrets masked, the working copy has them
+        filesContent, ops, err = applyDiff(dir, redact.FromContext(ctx).Restore(diff))
+        if err != nil {
+            return response, changeDescription{}, err
+        }
+        summary = diffSummary
+    } else if format == "blocks" {
+        // Restore the secrets before matching, like for diffs
+        edits, editsSummary, err := parseResponseForEdits(redact.FromContext(ctx).Restore(response))
+        if err != nil {
+            return response, changeDescription{}, &responseError{message: err.Error()}
+        }
+        description, err = parseChangeDescription(response)
+        if err != nil {
+            return response, changeDescription{}, &responseError{message: err.Error()}
+        }
+        // Map the file names onto the repository before reading anything
+        checker := &pathChecker{dir: dir}
+        for i := range edits {
+            edits[i].path = checker.clean(edits[i].path)
+        }
+        ops = checker.operations(parseFileOperations(response))
+        if err := checker.err(); err != nil {
+            return response, changeDescription{}, err
+        }
+        filesContent, err = applyEdits(dir, edits, ops)
+        if err != nil {
+            return response, changeDescription{}, err
+        }
+        summary = editsSummary
+    } else if structured {
+        parsed, err := parseStructuredResponse(response)
+        if err != nil {
+            return response, changeDescription{}, &responseError{message: err.Error()}
+        }
+        filesContent = make(map[string]string)
+        for _, file := range parsed.Files {
+            filesContent[file.Path] = file.Content
+        }
+        ops = parsed.operations()
+        summary = parsed.Summary
+        description = parsed.changeDescription()
+    } else {
+        var parser string
+        var success bool
+        filesContent, summary, parser, success = parseResponseForFiles(response)
+        ops = parseFileOperations(response)
+        if !success || (len(filesContent) == 0 && ops.empty()) {
+            return response, changeDescription{}, newResponseError("no files or no Summary line found; delimit each file with the START OF FILE and END OF FILE markers")
+        }
+        if parser != "" {
+            log.Printf("Parsed the files of the reply from %s", parser)
+        }
+        if parser != fileParsers[0].name && parser != "" {
+            reportStage(progress, fmt.Sprintf("The reply has no file markers, took the files from its %s", parser))
+        }
+        var err error
+        description, err = parseChangeDescription(response)
+        if err != nil {
+            return response, changeDescription{}, &responseError{message: err.Error()}
+        }
+    }
+    log.Printf("Commit message: %s", description.commitMessage())
+    log.Printf("PR title: %s", description.PRTitle)
+
+    // Map the file names of entire files onto the repository; diffs and
+    // blocks had theirs mapped before they were applied
+    if format == "markers" || format == "json" || format == "declarations" {
+        checker := &pathChecker{dir: dir}
+        filesContent = checker.files(filesContent)
+        ops = checker.operations(ops)
+        if err := checker.err(); err != nil {
+            return response, changeDescription{}, err
+        }
     }
 
-    // Loop through each file path and content pair
+    description.Summary = summary
+
+    // Settle the content of every file before anything in the working copy changes
     for filePath, newContent := range filesContent {
-        if strings.Contains(newContent, "\n// ... remaining functions unchanged") {
-            // Handle splicing
-            log.Printf("Detected placeholder in %s, splicing content...", filePath)
-            updatedContent, spliceErr := spliceFileWithOriginal(filePath, newContent)
-            if spliceErr != nil {
-                return fmt.Errorf("failed to splice file %s: %v", filePath, spliceErr)
+        if (format == "markers" || format == "json") && hasElisions(newContent) {
+            // Fill in the code the model left out from the original file,
+            // which has the old name if the file is renamed
+            log.Printf("Detected left out code in %s, reconciling with the original...", filePath)
+            updatedContent, reconcileErr := reconcileElisions(workPath(dir, ops.source(filePath)), filePath, newContent)
+            if reconcileErr != nil {
+                return response, changeDescription{}, newResponseError("%v; please send the entire file", reconcileErr)
             }
             newContent = updatedContent
         }
+        if format == "declarations" && (strings.HasSuffix(filePath, ".go") || isCppFile(filePath)) {
+            // Merge the declarations of the reply into the existing Go or
+            // C++ file; new files are sent whole
+            if original, err := ops.readFile(dir, filePath); err == nil {
+                merge := mergeGoDeclarations
+                if isCppFile(filePath) {
+                    merge = mergeCppDeclarations
+                }
+                merged, mergeErr := merge(filePath, string(original), newContent)
+                if mergeErr != nil {
+                    return response, changeDescription{}, newResponseError("%v", mergeErr)
+                }
+                log.Printf("Merged the declarations of the reply into %s", filePath)
+                newContent = merged
+            }
+        }
+        // Put back the secrets that were masked in the files the model saw
+        filesContent[filePath] = redact.FromContext(ctx).Restore(newContent)
+    }
+    if err := ops.check(dir, filesContent); err != nil {
+        return response, changeDescription{}, err
+    }
 
-        // Write the updated content to the file
-        err := ioutil.WriteFile(filePath, []byte(newContent), 0644)
-        if err != nil {
-            log.Printf("failed to write changes to file %s: %v", filePath, err)
-            continue
+    // Delete and rename files with git, then write the new content of
+    // every file, creating its directory if it is new
+    if err := ops.apply(dir); err != nil {
+        return response, changeDescription{}, err
+    }
+    description.Deleted = ops.Deletes
+    description.Renamed = ops.Renames
+    for filePath, newContent := range filesContent {
+        path := workPath(dir, filePath)
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            return response, changeDescription{}, fmt.Errorf("failed to create directory for file %s: %v", filePath, err)
+        }
+        if err := ioutil.WriteFile(path, []byte(newContent), 0644); err != nil {
+            return response, changeDescription{}, fmt.Errorf("failed to write changes to file %s: %v", filePath, err)
         }
         log.Printf("Successfully applied changes to %s", filePath)
+        description.Files = append(description.Files, filePath)
     }
-    return nil
+    return response, description, nil
+}
+
+// replyFormat returns the reply format of the job for prompts.System: "json" for structured
+// output, "diff" for unified diffs, "blocks" for search/replace blocks and "markers" for entire
+// files between file markers and "declarations" for the changed declarations of Go and C++
+// files between file markers.
+func replyFormat(data *types.FormData, provider llm.Provider) string {
+    switch {
+    case structuredOutput(data, provider):
+        return "json"
+    case data.EditFormat == "diff":
+        return "diff"
+    case data.EditFormat == "blocks":
+        return "blocks"
+    case data.EditFormat == "declarations" && (data.RepoType == "Golang" || data.RepoType == "C++"):
+        return "declarations"
+    default:
+        return "markers"
+    }
+}
+
+// structuredOutput reports whether the job uses the structured JSON reply format: it must ask
+// for it, and the provider must support it.
+func structuredOutput(data *types.FormData, provider llm.Provider) bool {
+    return data.EditFormat == "json" && provider.SupportsStructuredOutput()
+}
+
+// recordUsage adds the token usage of a request to the ledger and reports
+// it. If the server did not report usage, the tokens are counted locally.
+func recordUsage(ledger *cost.Ledger, progress types.ProgressFunc, label string, request chatgpt.ChatGPTRequest, reply chatgpt.Reply) {
+    if reply.Cache == llm.CacheHit {
+        entry := ledger.RecordCached(label, request.Model)
+        reportStage(progress, "Cache hit, usage of "+entry.String())
+        return
+    }
+    usage := reply.Usage
+    estimated := usage.PromptTokens == 0 && usage.CompletionTokens == 0
+    if estimated {
+        for _, msg := range request.Messages {
+            usage.PromptTokens += tokens.Count(msg.Content)
+        }
+        usage.CompletionTokens = tokens.Count(reply.Content)
+    }
+    entry := ledger.Record(label, request.Model, usage.PromptTokens, usage.CompletionTokens, estimated)
+    if reply.Cache == llm.CacheMiss {
+        reportStage(progress, "Cache miss, usage of "+entry.String())
+        return
+    }
+    reportStage(progress, "Usage of "+entry.String())
+}
+
+// countTokens returns the number of tokens of the content of messages.
+func countTokens(messages []chatgpt.Message) int {
+    total := 0
+    for _, msg := range messages {
+        total += tokens.Count(msg.Content)
+    }
+    return total
+}
+
+// contentDigest identifies text sent to or received from the model in the
+// logs by a hash, since the text itself may contain repository content.
+func contentDigest(text string) string {
+    hash := sha256.Sum256([]byte(text))
+    return "sha256 " + hex.EncodeToString(hash[:])[:12]
+}
+
+// reportStage logs the start of a pipeline step and forwards it to progress.
+func reportStage(progress types.ProgressFunc, message string) {
+    log.Println(message)
+    progress(types.ProgressUpdate{Kind: "stage", Text: message})
+}
+
+// reportAttempt is reportStage for the start of a new model request, after
+// which the output of the request before is no longer of interest.
+func reportAttempt(progress types.ProgressFunc, message string) {
+    log.Println(message)
+    progress(types.ProgressUpdate{Kind: "attempt", Text: message})
 }
 
 // calculateDependencies runs `gcc -M` on the input files and parses the output to extract dependencies.
 func calculateDependencies(files []string) ([]string, error) {
-    // Prepend "repo/" to each file in the files slice
-    for i, file := range files {
-        files[i] = "repo/" + file
+    // Prepare the gcc command with the -M flag and the input files, which
+    // are in the clone in "repo"
+    args := []string{"-M"}
+    for _, file := range files {
+        args = append(args, repoPrefix+file)
     }
-
-    // Prepare the gcc command with the -M flag and the input files
-    args := append([]string{"-M"}, files...)
     cmd := exec.Command("gcc", args...)
 
     // Capture stdout and stderr
@@ -194,7 +589,9 @@ func calculateDependencies(files []string) ([]string, error) {
     return dependencies, nil
 }
 
-func runTestsOrBuild(repoType string, isBuild bool) (bool, string) {
+// runTestsOrBuild builds the working copy at dir, or runs its tests, and
+// returns whether that succeeded along with the output.
+func runTestsOrBuild(ctx context.Context, dir string, repoType string, isBuild bool) (bool, string) {
   var cmd *exec.Cmd
   var action string
   if isBuild {
@@ -204,18 +601,18 @@ func runTestsOrBuild(repoType string, isBuild bool) (bool, string) {
   }
 
   if repoType == "C++" && isBuild {
-    cmd = exec.Command("make", "build")
+    cmd = exec.CommandContext(ctx, "make", "build")
   } else if repoType == "C++" && !isBuild {
-    cmd = exec.Command("make", "tests")
+    cmd = exec.CommandContext(ctx, "make", "tests")
   } else if repoType == "Golang" && isBuild {
-    cmd = exec.Command("go", "build", "-o", "build-out-executable", ".")
+    cmd = exec.CommandContext(ctx, "go", "build", "-o", "build-out-executable", ".")
   } else if repoType == "Golang" && !isBuild {
-    cmd = exec.Command("go", "test", "./...")
+    cmd = exec.CommandContext(ctx, "go", "test", "./...")
   } else {
     return false, "Unknown repository type"
   }
-  // Set the working directory to "repo"
-  cmd.Dir = "repo"
+  // Run in the working copy
+  cmd.Dir = dir
 
   // Capture stdout and stderr
   var outBuf, errBuf bytes.Buffer
@@ -226,7 +623,7 @@ func runTestsOrBuild(repoType string, isBuild bool) (bool, string) {
   err := cmd.Run()
 
   // Combine stdout and stderr for logging or further prompting
-  output := outBuf.String() + "\n" + errBuf.String()
+  output := redact.FromContext(ctx).Redact(outBuf.String() + "\n" + errBuf.String())
 
   if err != nil {
       // Log the failure and output
@@ -236,7 +633,7 @@ func runTestsOrBuild(repoType string, isBuild bool) (bool, string) {
 
   // Log success and return
   log.Printf("%s passed successfully.", action)
-  os.Remove("build-out-executable")
+  os.Remove(filepath.Join(dir, "build-out-executable"))
   return true, output
 }
 
@@ -257,30 +654,77 @@ func includeEntireRepo(repoPath string) ([]string, error) {
     return files, nil
 }
 
-// buildPrompt generates a prompt that includes the user's request and the contents of each dependency file.
-func buildPrompt(userPrompt string, deps []string) string {
+// buildPrompt generates a prompt that includes the user's request and the contents of each dependency file,
+// with their secrets masked by redactor.
+// The prompt is kept within budget tokens: dependencies are ranked with rankDependencies and added until
+// the budget, less promptNotesTokens, is used up; what does not fit is shortened or left out, and the
+// model is told about it in notes that use the rest.
+// The files in requested are never shortened; if they do not fit, an error is returned.
+func buildPrompt(userPrompt string, deps []string, requested []string, budget int, redactor *redact.Redactor) (string, promptReport, error) {
     var builder strings.Builder
+    report := promptReport{Budget: budget}
 
     // Start with the user prompt
-    builder.WriteString(userPrompt)
+    builder.WriteString(redactor.Redact(userPrompt))
     builder.WriteString("\n\nDependencies:\n")
+    used := tokens.Count(builder.String())
+    filesBudget := budget - promptNotesTokens
 
-    // Loop through each dependency file
-    for _, dep := range deps {
-        // Add start delimiter
-        builder.WriteString(fmt.Sprintf("\n/* START OF FILE: %s */\n", dep))
+    // Loop through each dependency file, most important first
+    for _, dep := range rankDependencies(deps, requested) {
+        start := fmt.Sprintf("\n/* START OF FILE: %s */\n", dep)
+        end := fmt.Sprintf("\n/* END OF FILE: %s */\n\n", dep)
 
         // Read the content of the dependency file
-        content, err := ioutil.ReadFile(dep)
+        var content string
+        contentBytes, err := ioutil.ReadFile(dep)
         if err != nil {
-            builder.WriteString(fmt.Sprintf("Error reading file: %s\n", err))
+            content = fmt.Sprintf("Error reading file: %s\n", err)
+        } else {
+            content = redactor.RedactFile(dep, string(contentBytes))
+        }
+
+        cost := tokens.Count(start) + tokens.Count(content) + tokens.Count(end)
+        remaining := filesBudget - used
+        if cost > remaining {
+            if isRequestedFile(dep, requested) {
+                return "", report, fmt.Errorf("%s needs %d tokens, but only %d of the %d token budget are left", dep, cost, remaining, filesBudget)
+            }
+            if remaining < minTruncatedTokens {
+                report.Omitted = append(report.Omitted, dep)
+                continue
+            }
+            // Keep the beginning of the file, which usually has the
+            // declarations the model needs.
+            markerFormat := "\n/* ... %d more lines omitted to fit the context window ... */"
+            reserved := tokens.Count(start) + tokens.Count(fmt.Sprintf(markerFormat, 99999)) + tokens.Count(end)
+            var cut int
+            content, cut = tokens.Truncate(content, remaining-reserved)
+            content += fmt.Sprintf(markerFormat, cut)
+            report.Truncated = append(report.Truncated, dep)
         } else {
-            builder.Write(content)
+            report.Included = append(report.Included, dep)
         }
 
-        // Add end delimiter
-        builder.WriteString(fmt.Sprintf("\n/* END OF FILE: %s */\n\n", dep))
+        builder.WriteString(start)
+        builder.WriteString(content)
+        builder.WriteString(end)
+        used += tokens.Count(start) + tokens.Count(content) + tokens.Count(end)
     }
 
-    return builder.String()
+    // Tell the model about the files it cannot see in full, sharing the
+    // room left between both notes
+    room := budget - used
+    if len(report.Omitted) > 0 {
+        room /= 2
+    }
+    note := fileListNote("The following files were shortened to fit the context window; do not return them: ", report.Truncated, room)
+    builder.WriteString(note)
+    used += tokens.Count(note)
+    note = fileListNote("The following files exist but were left out to fit the context window: ", report.Omitted, budget-used)
+    builder.WriteString(note)
+    used += tokens.Count(note)
+    report.Used = used
+
+    return builder.String(), report, nil
 }
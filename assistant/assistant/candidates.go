@@ -0,0 +1,389 @@
+package assistant
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+    "github.com/thomasdullien/coding-assistant/assistant/cost"
+    "github.com/thomasdullien/coding-assistant/assistant/llm"
+    "github.com/thomasdullien/coding-assistant/assistant/types"
+)
+
+// maxCandidates limits the candidates of a job, each of which can cost as
+// much as a job of its own.
+const maxCandidates = 5
+
+// candidateDir holds the working copies of the candidates, next to the
+// clone in "repo".
+const candidateDir = "candidates"
+
+// DefaultTieBreakers decide between passing candidates with equally small
+// diffs, unless the job names its own. Any tie left is won by the candidate
+// generated first.
+var DefaultTieBreakers = []string{"files", "attempts", "tokens"}
+
+// tieBreakers measure a candidate by one criterion, smaller is better.
+var tieBreakers = map[string]func(c *candidate) int{
+    "files":    func(c *candidate) int { return len(c.files) },     // Fewest files changed
+    "attempts": func(c *candidate) int { return c.attempts },       // Fewest replies needed
+    "tokens":   func(c *candidate) int { return c.usage.Tokens() }, // Fewest tokens spent
+}
+
+// candidate is one independent try at the job, with its own conversation
+// with the model and its own working copy of the repository.
+type candidate struct {
+    index       int    // Counted from 1
+    name        string // "candidate 2", or empty if the job has a single candidate
+    dir         string // The working copy
+    usage       *cost.Ledger
+    attempts    int
+    passed      bool
+    problem     string // Why the last attempt failed
+    description changeDescription
+    files       []string // Every file written, deleted or renamed by any attempt, as named in the replies
+    testOutput  string
+    diffLines   int    // Lines added and removed, measured once the candidate passed
+    model       string // The model of the last attempt
+}
+
+// candidateOptions returns the number of candidates of the job and the
+// tie-breakers to choose between them, after checking both.
+func candidateOptions(data *types.FormData) (int, []string, error) {
+    count := data.Candidates
+    if count == 0 {
+        count = 1
+    }
+    if count < 1 || count > maxCandidates {
+        return 0, nil, fmt.Errorf("the number of candidates must be between 1 and %d", maxCandidates)
+    }
+    rules := data.TieBreakers
+    if len(rules) == 0 {
+        rules = DefaultTieBreakers
+    }
+    for _, rule := range rules {
+        if tieBreakers[rule] == nil {
+            return 0, nil, fmt.Errorf("unknown tie-breaker %q, use files, attempts or tokens", rule)
+        }
+    }
+    return count, rules, nil
+}
+
+// newCandidate prepares candidate index of count. A single candidate works
+// in the clone itself, several get a working copy each, checked out from
+// the clone with git worktree.
+func newCandidate(index int, count int) (*candidate, error) {
+    c := &candidate{index: index, dir: "repo", usage: &cost.Ledger{}}
+    if count == 1 {
+        return c, nil
+    }
+    c.name = fmt.Sprintf("candidate %d", index)
+    c.dir = filepath.Join(candidateDir, fmt.Sprintf("candidate-%d", index))
+    if _, err := runGit("repo", "worktree", "add", "--detach", filepath.Join("..", c.dir)); err != nil {
+        return nil, fmt.Errorf("failed to create working copy for %s: %v", c.name, err)
+    }
+    return c, nil
+}
+
+// removeWorktrees deletes the working copies of the candidates. Failures
+// only leave files behind until the next job, so they are logged.
+func removeWorktrees() {
+    if err := os.RemoveAll(candidateDir); err != nil {
+        log.Printf("Failed to remove candidate working copies: %v", err)
+    }
+    if _, err := runGit("repo", "worktree", "prune"); err != nil {
+        log.Printf("Failed to prune candidate working copies: %v", err)
+    }
+}
+
+// run lets the model change the working copy of the candidate until the
+// build and the tests pass, or the attempts are used up. After a build or
+// test failure, the next attempt moves up the escalation ladder to a
+// stronger model, which sees the whole conversation so far; every step up
+// the ladder adds an attempt. A candidate that does not pass is not an
+// error; errors are returned for problems that would hit every candidate,
+// like an unreachable provider or an aborted job.
+func (c *candidate) run(ctx context.Context, provider llm.Provider, data types.FormData, systemPrompt string, history []chatgpt.Message, budget int, progress types.ProgressFunc) error {
+    // Every candidate needs its own replies, also from the response cache
+    // and from models with a fixed seed
+    if c.name != "" {
+        ctx = llm.WithCacheVariant(ctx, c.name)
+    }
+    if data.Params.Seed != nil {
+        seed := *data.Params.Seed + int64(c.index-1)
+        data.Params.Seed = &seed
+    }
+    history = append([]chatgpt.Message(nil), history...)
+    ladder := data.Params.Ladder()
+    rung := 0
+    escalate := func() {
+        if rung+1 < len(ladder) {
+            rung++
+            reportStage(progress, c.stage(fmt.Sprintf("Escalating to %s...", ladder[rung])))
+        }
+    }
+
+    // Query the model and apply changes iteratively
+    for attempt := 1; attempt <= maxAttempts+len(ladder)-1; attempt++ {
+        if ctx.Err() != nil {
+            return fmt.Errorf("job aborted: %v", ctx.Err())
+        }
+        c.attempts = attempt
+        c.model = ladder[rung]
+        data.Params.Model = c.model
+        reportAttempt(progress, c.stage(fmt.Sprintf("Applying changes, attempt %d...", attempt)))
+        reply, description, err := applyChangesWithLLM(ctx, provider, &data, c.dir, systemPrompt, trimHistory(history, budget), progress, c.usage, c.label(fmt.Sprintf("attempt %d", attempt)))
+        if reply != "" {
+            history = append(history, chatgpt.Message{Role: "assistant", Content: reply})
+        }
+        if err != nil {
+            var respErr *responseError
+            if reply != "" && errors.As(err, &respErr) {
+                // Let the model fix its reply
+                log.Printf("Reply could not be applied: %v", err)
+                c.problem = "the reply could not be applied"
+                history = append(history, diagnosticsMessage("Your reply could not be applied", err.Error()))
+                continue
+            }
+            return fmt.Errorf("failed to apply changes: %v", err)
+        }
+        c.description = description
+        c.addFiles(description.Files)
+        c.addFiles(fileOperations{Deletes: description.Deleted, Renames: description.Renamed}.files())
+
+        reportStage(progress, c.stage("Running build..."))
+        buildOK, buildout := runTestsOrBuild(ctx, c.dir, data.RepoType, true)
+        if !buildOK {
+            c.problem = "the build failed"
+            history = append(history, diagnosticsMessage("Build failed", buildout))
+            escalate()
+            continue
+        }
+        log.Println("Build successful.")
+
+        reportStage(progress, c.stage("Running tests..."))
+        // For the moment, assume that Golang tests always pass. This
+        // needs to change in the future.
+        testOK, output := runTestsOrBuild(ctx, c.dir, data.RepoType, false)
+        if !testOK {
+            c.problem = "the tests failed"
+            history = append(history, diagnosticsMessage("Test failed", output))
+            escalate()
+            continue
+        }
+
+        c.passed = true
+        c.problem = ""
+        c.testOutput = output
+        c.description.Model = provider.Name() + "/" + c.model
+        c.description.EscalatedFrom = ladder[:rung]
+        return c.measureDiff()
+    }
+    if c.name != "" {
+        log.Printf("Exceeded maximum attempts for %s", c.name)
+    }
+    return nil
+}
+
+// stage prefixes a progress message with the name of the candidate.
+func (c *candidate) stage(message string) string {
+    if c.name == "" {
+        return message
+    }
+    return fmt.Sprintf("Candidate %d: %s", c.index, message)
+}
+
+// label names a model request of the candidate in the usage ledger.
+func (c *candidate) label(request string) string {
+    if c.name == "" {
+        return request
+    }
+    return c.name + ", " + request
+}
+
+// addFiles records files written, deleted or renamed by an attempt.
+func (c *candidate) addFiles(files []string) {
+    for _, file := range files {
+        known := false
+        for _, existing := range c.files {
+            known = known || existing == file
+        }
+        if !known {
+            c.files = append(c.files, file)
+        }
+    }
+}
+
+// measureDiff stages the changes of the candidate, counts the lines it
+// added and removed, and describes the files it changed, deleted and
+// renamed over all attempts, as git sees them.
+func (c *candidate) measureDiff() error {
+    c.diffLines = 0
+    c.description.Files, c.description.Deleted, c.description.Renamed = nil, nil, nil
+    paths := c.paths()
+    if len(paths) == 0 {
+        return nil
+    }
+
+    // Stage everything, so that git sees new, deleted and renamed files
+    if _, err := runGit(c.dir, "add", "-A"); err != nil {
+        return fmt.Errorf("failed to measure the diff: %v", err)
+    }
+    output, err := runGit(c.dir, append([]string{"diff", "--cached", "-M", "--numstat", "HEAD", "--"}, paths...)...)
+    if err != nil {
+        return fmt.Errorf("failed to measure the diff: %v", err)
+    }
+    for _, line := range strings.Split(output, "\n") {
+        // Each line is "added removed path"; binary files have "-" for the counts
+        fields := strings.Fields(line)
+        if len(fields) < 3 {
+            continue
+        }
+        added, _ := strconv.Atoi(fields[0])
+        removed, _ := strconv.Atoi(fields[1])
+        c.diffLines += added + removed
+    }
+
+    output, err = runGit(c.dir, append([]string{"diff", "--cached", "-M", "--name-status", "HEAD", "--"}, paths...)...)
+    if err != nil {
+        return fmt.Errorf("failed to list the changed files: %v", err)
+    }
+    for _, line := range strings.Split(output, "\n") {
+        // Each line is "status path", or "Rscore old new" for renames
+        fields := strings.Split(line, "\t")
+        switch {
+        case len(fields) == 3 && strings.HasPrefix(fields[0], "R"):
+            c.description.Renamed = append(c.description.Renamed, fileRename{From: fields[1], To: fields[2]})
+        case len(fields) == 2 && fields[0] == "D":
+            c.description.Deleted = append(c.description.Deleted, fields[1])
+        case len(fields) == 2:
+            c.description.Files = append(c.description.Files, fields[1])
+        }
+    }
+    return nil
+}
+
+// paths returns the files of the candidate relative to the repository root.
+func (c *candidate) paths() []string {
+    var paths []string
+    for _, file := range c.files {
+        paths = append(paths, repoRelative(file))
+    }
+    return paths
+}
+
+// copyTo applies the changes of the candidate, as staged by measureDiff,
+// to the working copy at dir, including deleted and renamed files.
+func (c *candidate) copyTo(dir string) error {
+    paths := c.paths()
+    if len(paths) == 0 {
+        return nil
+    }
+    patch, err := runGit(c.dir, append([]string{"diff", "--cached", "-M", "--binary", "HEAD", "--"}, paths...)...)
+    if err != nil {
+        return fmt.Errorf("failed to read the changes of %s: %v", c.name, err)
+    }
+    if patch == "" {
+        return nil
+    }
+    if _, err := runGitInput(dir, patch, "apply", "--index", "-"); err != nil {
+        return fmt.Errorf("failed to copy the changes of %s: %v", c.name, err)
+    }
+    return nil
+}
+
+// better reports whether c is a better choice than other: a smaller diff
+// first, then the tie-breakers in order.
+func (c *candidate) better(other *candidate, rules []string) bool {
+    if c.diffLines != other.diffLines {
+        return c.diffLines < other.diffLines
+    }
+    for _, rule := range rules {
+        measure := tieBreakers[rule]
+        if mine, theirs := measure(c), measure(other); mine != theirs {
+            return mine < theirs
+        }
+    }
+    return false
+}
+
+// selectCandidate returns the best of the passing candidates, or nil if
+// none passed.
+func selectCandidate(candidates []*candidate, rules []string) *candidate {
+    var best *candidate
+    for _, c := range candidates {
+        if c.passed && (best == nil || c.better(best, rules)) {
+            best = c
+        }
+    }
+    return best
+}
+
+// summary describes in one line how the candidate did.
+func (c *candidate) summary() string {
+    attempts := fmt.Sprintf("%d attempt", c.attempts)
+    if c.attempts != 1 {
+        attempts += "s"
+    }
+    if !c.passed {
+        return fmt.Sprintf("Candidate %d failed after %s, %s. %s", c.index, attempts, c.problem, c.usage.Summary())
+    }
+    files := fmt.Sprintf("%d file", len(c.files))
+    if len(c.files) != 1 {
+        files += "s"
+    }
+    return fmt.Sprintf("Candidate %d passed after %s with %s, %d lines changed in %s. %s", c.index, attempts, c.model, c.diffLines, files, c.usage.Summary())
+}
+
+// summarizeCandidates describes how each candidate did, marking the
+// selected one, which may be nil.
+func summarizeCandidates(candidates []*candidate, selected *candidate) []string {
+    var lines []string
+    for _, c := range candidates {
+        line := c.summary()
+        if c == selected {
+            line += " Selected."
+        }
+        lines = append(lines, line)
+    }
+    return lines
+}
+
+// repoRelative returns the path of a file named in a reply, like
+// "repo/main.go", relative to the repository root.
+func repoRelative(file string) string {
+    return strings.TrimPrefix(filepath.ToSlash(file), "repo/")
+}
+
+// workPath returns where a file named in a reply lives in the working copy
+// at dir.
+func workPath(dir string, file string) string {
+    return filepath.Join(dir, filepath.FromSlash(repoRelative(file)))
+}
+
+// runGit runs git with args in dir and returns its standard output.
+func runGit(dir string, args ...string) (string, error) {
+    return runGitInput(dir, "", args...)
+}
+
+// runGitInput runs git like runGit, with input on its standard input.
+func runGitInput(dir string, input string, args ...string) (string, error) {
+    cmd := exec.Command("git", args...)
+    cmd.Dir = dir
+    cmd.Stdin = strings.NewReader(input)
+    var outBuf, errBuf bytes.Buffer
+    cmd.Stdout = &outBuf
+    cmd.Stderr = &errBuf
+    if err := cmd.Run(); err != nil {
+        return "", fmt.Errorf("git %s failed: %v\nstderr: %s", args[0], err, errBuf.String())
+    }
+    return outBuf.String(), nil
+}
@@ -0,0 +1,152 @@
+package assistant
+
+import (
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// Git and GitHub truncate longer subjects and titles in most views.
+const maxCommitSubjectLength = 72
+const maxPRTitleLength = 100
+
+// The test output quoted in the pull request is cut to this many lines.
+const maxPRTestOutputLines = 20
+
+// changeDescription is the model's description of its change, used for the
+// commit and the pull request.
+type changeDescription struct {
+    Summary       string // Short name of the change, used for the branch name
+    CommitSubject string
+    CommitBody    string // May be empty
+    PRTitle       string
+    PRDescription string       // The rationale of the change
+    Files         []string     // The files written, filled in when they are applied
+    Deleted       []string     // The files deleted, likewise
+    Renamed       []fileRename // The files renamed, likewise
+    Model         string       // "provider/model" of the passing attempt, filled in when the tests pass
+    EscalatedFrom []string     // The models tried before it, if the job escalated
+}
+
+var commitMessageRegex = regexp.MustCompile(`(?m)^Commit-Message: (.*)$`)
+var prTitleRegex = regexp.MustCompile(`(?m)^PR-Title: (.*)$`)
+
+// parseChangeDescription extracts the change description from a reply in
+// the marker format: "Commit-Message:" and "PR-Title:" lines, and the commit
+// body and PR description between their START and END markers.
+func parseChangeDescription(response string) (changeDescription, error) {
+    var description changeDescription
+    if match := commitMessageRegex.FindStringSubmatch(response); match != nil {
+        description.CommitSubject = match[1]
+    }
+    if match := prTitleRegex.FindStringSubmatch(response); match != nil {
+        description.PRTitle = match[1]
+    }
+    description.CommitBody = extractBlock(response, "COMMIT BODY")
+    description.PRDescription = extractBlock(response, "PR DESCRIPTION")
+    return description, description.validate()
+}
+
+// extractBlock returns the text between "/* START OF name */" and
+// "/* END OF name */", or an empty string if there is no such block.
+func extractBlock(response string, name string) string {
+    start := strings.Index(response, "/* START OF "+name+" */")
+    if start < 0 {
+        return ""
+    }
+    start += len("/* START OF " + name + " */")
+    end := strings.Index(response[start:], "/* END OF "+name+" */")
+    if end < 0 {
+        return ""
+    }
+    return response[start : start+end]
+}
+
+// validate normalizes the whitespace of the description and checks that it
+// can be used for a commit and a pull request. All problems are reported
+// together, so that they can be sent back to the model in one go.
+func (d *changeDescription) validate() error {
+    d.CommitSubject = strings.TrimSpace(d.CommitSubject)
+    d.CommitBody = strings.TrimSpace(d.CommitBody)
+    d.PRTitle = strings.TrimSpace(d.PRTitle)
+    d.PRDescription = strings.TrimSpace(d.PRDescription)
+
+    var problems []string
+    switch {
+    case d.CommitSubject == "":
+        problems = append(problems, "the commit message is missing")
+    case strings.Contains(d.CommitSubject, "\n"):
+        problems = append(problems, "the commit message must be a single line, put details into the commit body")
+    case len(d.CommitSubject) > maxCommitSubjectLength:
+        problems = append(problems, fmt.Sprintf("the commit message is longer than %d characters", maxCommitSubjectLength))
+    }
+    switch {
+    case d.PRTitle == "":
+        problems = append(problems, "the PR title is missing")
+    case strings.Contains(d.PRTitle, "\n"):
+        problems = append(problems, "the PR title must be a single line")
+    case len(d.PRTitle) > maxPRTitleLength:
+        problems = append(problems, fmt.Sprintf("the PR title is longer than %d characters", maxPRTitleLength))
+    }
+    if d.PRDescription == "" {
+        problems = append(problems, "the PR description is missing")
+    }
+
+    if len(problems) > 0 {
+        return fmt.Errorf("invalid change description: %s", strings.Join(problems, "; "))
+    }
+    return nil
+}
+
+// commitMessage returns the full commit message, with the model that wrote
+// the change as a trailer.
+func (d changeDescription) commitMessage() string {
+    message := d.CommitSubject
+    if d.CommitBody != "" {
+        message += "\n\n" + d.CommitBody
+    }
+    if d.Model != "" {
+        message += "\n\nAssistant-Model: " + d.Model
+    }
+    return message
+}
+
+// prBody returns the body of the pull request: the model's description,
+// then the files it changed, deleted and renamed, the model that wrote it
+// and the result of the tests, which the model cannot know.
+func (d changeDescription) prBody(testOutput string) string {
+    var body strings.Builder
+    body.WriteString(d.PRDescription)
+
+    body.WriteString("\n\n## Files changed\n\n")
+    files := append([]string(nil), d.Files...)
+    sort.Strings(files)
+    for _, file := range files {
+        fmt.Fprintf(&body, "- `%s`\n", strings.TrimPrefix(file, "repo/"))
+    }
+    for _, rename := range d.Renamed {
+        fmt.Fprintf(&body, "- `%s` renamed to `%s`\n", strings.TrimPrefix(rename.From, "repo/"), strings.TrimPrefix(rename.To, "repo/"))
+    }
+    for _, file := range d.Deleted {
+        fmt.Fprintf(&body, "- `%s` deleted\n", strings.TrimPrefix(file, "repo/"))
+    }
+
+    if d.Model != "" {
+        fmt.Fprintf(&body, "\n## Model\n\nWritten by `%s`", d.Model)
+        if len(d.EscalatedFrom) > 0 {
+            fmt.Fprintf(&body, " after escalating from `%s`", strings.Join(d.EscalatedFrom, "`, `"))
+        }
+        body.WriteString(".\n")
+    }
+
+    body.WriteString("\n## Test results\n\nThe build and the tests passed.\n")
+    if output := strings.TrimSpace(testOutput); output != "" {
+        lines := strings.Split(output, "\n")
+        if len(lines) > maxPRTestOutputLines {
+            lines = lines[len(lines)-maxPRTestOutputLines:]
+        }
+        fmt.Fprintf(&body, "\n```\n%s\n```\n", strings.Join(lines, "\n"))
+    }
+    return body.String()
+}
@@ -0,0 +1,54 @@
+package assistant
+
+import (
+    "fmt"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+    "github.com/thomasdullien/coding-assistant/assistant/tokens"
+)
+
+// Build and test logs sent back to the model are cut to this many tokens.
+// The first errors are the ones that matter, and later ones are often
+// consequences of them.
+const maxDiagnosticsTokens = 4000
+
+// responseError is a problem with the model's reply that the model can fix
+// itself, such as a reply that cannot be parsed. It is sent back to the
+// model instead of failing the job.
+type responseError struct {
+    message string
+}
+
+func (e *responseError) Error() string {
+    return e.message
+}
+
+func newResponseError(format string, args ...interface{}) error {
+    return &responseError{message: fmt.Sprintf(format, args...)}
+}
+
+// diagnosticsMessage is the user message that reports a failed step of the
+// job, like the build, to the model.
+func diagnosticsMessage(problem string, output string) chatgpt.Message {
+    trimmed, cut := tokens.Truncate(output, maxDiagnosticsTokens)
+    if cut > 0 {
+        trimmed += fmt.Sprintf("\n[... %d more lines of output omitted ...]\n", cut)
+    }
+    return chatgpt.Message{
+        Role:    "user",
+        Content: fmt.Sprintf("%s, please address the following issues and send the fixed files again:\n%s", problem, trimmed),
+    }
+}
+
+// trimHistory returns the conversation without its oldest fix-up rounds if
+// it does not fit into budget tokens. The initial prompt and the latest
+// reply and diagnostics are always kept, so the model sees what it is
+// supposed to do and what it has to fix now.
+func trimHistory(history []chatgpt.Message, budget int) []chatgpt.Message {
+    trimmed := history
+    for countTokens(trimmed) > budget && len(trimmed) > 3 {
+        // Drop the oldest reply and the diagnostics that answered it.
+        trimmed = append([]chatgpt.Message{trimmed[0]}, trimmed[3:]...)
+    }
+    return trimmed
+}
@@ -0,0 +1,718 @@
+package assistant
+
+import (
+    "fmt"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "sync"
+
+    sitter "github.com/odvcencio/gotreesitter"
+    "github.com/odvcencio/gotreesitter/grammars"
+)
+
+// The extensions of the C++ files whose declarations are merged.
+var cppExtensions = map[string]bool{
+    ".cpp": true, ".cc": true, ".cxx": true, ".c++": true,
+    ".hpp": true, ".hh": true, ".hxx": true, ".h": true,
+}
+
+// isCppFile reports whether file is a C++ source or header file.
+func isCppFile(file string) bool {
+    return cppExtensions[strings.ToLower(filepath.Ext(file))]
+}
+
+// cppDecl is a declaration of a C++ file that the merge can match by name:
+// a function, a class, a variable or a macro, as a whole with its template
+// header.
+type cppDecl struct {
+    kind      string   // "function", "prototype", "type", "forward", "variable", "macro" or "other"
+    keys      []string // Qualified names, with the parameter types for functions: "ns::A::f(int)"
+    name      string   // The qualified name without the parameter types, or the source for "other"
+    scope     string   // The enclosing namespaces, like "ns::", or empty
+    start     int      // Offset of the source, from its doc comment if it has one
+    bodyStart int      // Offset of the source without the doc comment
+    end       int      // Offset after the source, including a comment at the end of its line
+    doc       string   // The doc comment with its line break, or empty
+    body      string   // The source without the doc comment
+}
+
+// label names the declaration in problems for the model.
+func (d cppDecl) label() string {
+    if d.kind == "other" {
+        return fmt.Sprintf("%q", strings.SplitN(d.name, "\n", 2)[0])
+    }
+    return d.keys[0]
+}
+
+// cppInclude is an #include line of a C++ file.
+type cppInclude struct {
+    path  string // As written, like "<map>" or "\"util.hpp\""
+    start int
+    end   int    // Offset after the line break of the line
+}
+
+// cppFile is a parsed C++ file.
+type cppFile struct {
+    src        string
+    decls      []cppDecl
+    includes   []cppInclude
+    namespaces map[string]int // Offset of the closing brace of the last body of every namespace, by scope
+    errors     int            // Number of nodes tree-sitter could not parse
+    firstError int            // Line of the first of them
+}
+
+// Parsers take long to set up, so they are shared between merges; the
+// grammar is only loaded once the first C++ file is merged.
+var cppParsers = sync.OnceValue(func() *sitter.ParserPool {
+    return sitter.NewParserPool(grammars.CppLanguage())
+})
+
+// parseCppFile parses src with the tree-sitter C++ grammar and lists its
+// declarations. Namespaces, extern "C" blocks and preprocessor conditionals,
+// like include guards, are looked into; classes are declarations as a
+// whole.
+func parseCppFile(src string) (*cppFile, error) {
+    tree, err := cppParsers().Parse([]byte(src))
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse: %v", err)
+    }
+    defer tree.Release()
+
+    file := &cppFile{src: src, namespaces: make(map[string]int)}
+    root := tree.RootNode()
+    file.countErrors(root)
+    file.collect(root, "")
+    return file, nil
+}
+
+// cppType returns the grammar type of node, like "function_definition".
+func cppType(node *sitter.Node) string {
+    return node.Type(grammars.CppLanguage())
+}
+
+// cppField returns the child of node in the named field of the grammar, or
+// nil.
+func cppField(node *sitter.Node, name string) *sitter.Node {
+    return node.ChildByFieldName(name, grammars.CppLanguage())
+}
+
+// cppStart returns the offset of the first token of node. The runtime may
+// start a declaration that follows a comment at the start of the file at
+// the comment, which is a declaration of its own.
+func cppStart(node *sitter.Node) int {
+    for node.ChildCount() > 0 {
+        node = node.Child(0)
+    }
+    return int(node.StartByte())
+}
+
+// countErrors counts the nodes below node that tree-sitter could not parse.
+func (f *cppFile) countErrors(node *sitter.Node) {
+    if node.IsError() || node.IsMissing() {
+        if f.errors == 0 {
+            f.firstError = int(node.StartPoint().Row) + 1
+        }
+        f.errors++
+        return
+    }
+    if !node.HasError() {
+        return
+    }
+    for i := 0; i < int(node.ChildCount()); i++ {
+        f.countErrors(node.Child(i))
+    }
+}
+
+// collect lists the declarations of a node that contains them, in the
+// namespaces scope.
+func (f *cppFile) collect(container *sitter.Node, scope string) {
+    var doc *sitter.Node // The first line of the comments before the next declaration
+    last := -1           // The declaration before, for the comment at the end of its line
+    lastRow := -1        // The last line of the node before
+    for i := 0; i < int(container.ChildCount()); i++ {
+        node := container.Child(i)
+        field := container.FieldNameForChild(i, grammars.CppLanguage())
+        row := int(node.StartPoint().Row)
+        adjacent := i > 0 && row <= cppEndRow(container.Child(i-1))+1
+
+        // The semicolon after a class belongs to it, as does a comment on its last line
+        if !node.IsNamed() || field == "name" || field == "condition" {
+            if cppType(node) == ";" && last >= 0 && f.decls[last].end <= int(node.StartByte()) {
+                f.decls[last].end = int(node.EndByte())
+            }
+            continue
+        }
+        if cppType(node) == "comment" {
+            switch {
+            case row == lastRow:
+                if last >= 0 {
+                    f.decls[last].end = int(node.EndByte())
+                }
+            case doc == nil || !adjacent:
+                doc = node
+            }
+            continue
+        }
+        if !adjacent {
+            doc = nil
+        }
+        lastRow = cppEndRow(node)
+
+        switch cppType(node) {
+        case "namespace_definition":
+            name := "{anonymous}"
+            if nameNode := cppField(node, "name"); nameNode != nil {
+                name = squeeze(nameNode.Text([]byte(f.src)))
+            }
+            if body := cppField(node, "body"); body != nil {
+                f.namespaces[scope+name+"::"] = int(body.EndByte()) - 1
+                f.collect(body, scope+name+"::")
+            }
+            doc, last = nil, -1
+            continue
+        case "preproc_ifdef", "preproc_if", "preproc_else", "preproc_elif", "preproc_elifdef":
+            f.collect(node, scope)
+            doc, last = nil, -1
+            continue
+        case "linkage_specification":
+            if body := cppField(node, "body"); body != nil && cppType(body) == "declaration_list" {
+                f.collect(body, scope)
+                doc, last = nil, -1
+                continue
+            }
+        case "preproc_include":
+            if path := cppField(node, "path"); path != nil {
+                f.includes = append(f.includes, cppInclude{path: squeeze(path.Text([]byte(f.src))), start: cppStart(node), end: int(node.EndByte())})
+            }
+            doc, last = nil, -1
+            continue
+        }
+
+        decl := f.describe(node, scope)
+        decl.bodyStart = cppStart(node)
+        decl.start = decl.bodyStart
+        if doc != nil {
+            decl.start = int(doc.StartByte())
+            decl.doc = f.src[decl.start:decl.bodyStart]
+        }
+        // Preprocessor lines end with their line break, which is kept
+        decl.body = strings.TrimRight(f.src[decl.bodyStart:node.EndByte()], " \t\r\n")
+        decl.end = decl.bodyStart + len(decl.body)
+        f.decls = append(f.decls, decl)
+        doc, last = nil, len(f.decls)-1
+    }
+}
+
+// cppEndRow returns the last line of a node, which for preprocessor lines
+// is not the line after their line break.
+func cppEndRow(node *sitter.Node) int {
+    end := node.EndPoint()
+    if end.Column == 0 && end.Row > node.StartPoint().Row {
+        return int(end.Row) - 1
+    }
+    return int(end.Row)
+}
+
+// describe finds the kind and the names of a declaration.
+func (f *cppFile) describe(node *sitter.Node, scope string) cppDecl {
+    src := []byte(f.src)
+    decl := cppDecl{kind: "other", name: squeezeLines(node.Text(src)), scope: scope}
+    named := func(kind string, names ...string) cppDecl {
+        decl.kind = kind
+        decl.name = scope + names[0]
+        for _, name := range names {
+            decl.keys = append(decl.keys, scope+name)
+        }
+        return decl
+    }
+
+    switch cppType(node) {
+    case "template_declaration":
+        // The declaration after the template parameters
+        for i := 0; i < int(node.NamedChildCount()); i++ {
+            if child := node.NamedChild(i); cppType(child) != "template_parameter_list" && cppType(child) != "comment" {
+                if inner := f.describe(child, scope); inner.kind != "other" {
+                    return inner
+                }
+            }
+        }
+    case "function_definition":
+        if name, signature, ok := cppDeclarator(cppField(node, "declarator"), src); ok {
+            decl = named("function", name+signature)
+            decl.name = scope + name
+        }
+    case "declaration", "field_declaration":
+        var names []string
+        for i := 0; i < int(node.ChildCount()); i++ {
+            if node.FieldNameForChild(i, grammars.CppLanguage()) != "declarator" {
+                continue
+            }
+            name, signature, isFunction := cppDeclarator(node.Child(i), src)
+            if isFunction {
+                decl = named("prototype", name+signature)
+                decl.name = scope + name
+                return decl
+            }
+            if name != "" {
+                names = append(names, name)
+            }
+        }
+        if len(names) > 0 {
+            return named("variable", names...)
+        }
+        // A forward declaration like "class A;"
+        if typ := cppField(node, "type"); typ != nil {
+            if name := cppField(typ, "name"); name != nil && cppField(typ, "body") == nil {
+                return named("forward", squeeze(name.Text(src)))
+            }
+        }
+    case "class_specifier", "struct_specifier", "union_specifier", "enum_specifier":
+        if name := cppField(node, "name"); name != nil {
+            if cppField(node, "body") == nil {
+                return named("forward", squeeze(name.Text(src)))
+            }
+            return named("type", squeeze(name.Text(src)))
+        }
+    case "alias_declaration", "concept_definition":
+        if name := cppField(node, "name"); name != nil {
+            return named("type", squeeze(name.Text(src)))
+        }
+    case "type_definition":
+        var names []string
+        for i := 0; i < int(node.ChildCount()); i++ {
+            if node.FieldNameForChild(i, grammars.CppLanguage()) == "declarator" {
+                if name, _, _ := cppDeclarator(node.Child(i), src); name != "" {
+                    names = append(names, name)
+                }
+            }
+        }
+        if len(names) > 0 {
+            return named("type", names...)
+        }
+    case "preproc_def", "preproc_function_def":
+        if name := cppField(node, "name"); name != nil {
+            return named("macro", "#define "+name.Text(src))
+        }
+    case "linkage_specification":
+        if body := cppField(node, "body"); body != nil {
+            return f.describe(body, scope)
+        }
+    }
+    return decl
+}
+
+// cppDeclarator returns the name a declarator declares, and for functions
+// their parameter types, like "(int,const char*)", and whether it declares
+// a function.
+func cppDeclarator(node *sitter.Node, src []byte) (string, string, bool) {
+    signature := ""
+    isFunction := false
+    for node != nil {
+        switch cppType(node) {
+        case "function_declarator":
+            if !isFunction {
+                isFunction = true
+                signature = cppParameters(node, src)
+            }
+            node = cppField(node, "declarator")
+        case "pointer_declarator", "reference_declarator", "init_declarator", "array_declarator",
+            "parenthesized_declarator", "attributed_declarator":
+            inner := cppField(node, "declarator")
+            if inner == nil && node.NamedChildCount() > 0 {
+                inner = node.NamedChild(int(node.NamedChildCount()) - 1)
+            }
+            node = inner
+        default:
+            return squeeze(node.Text(src)), signature, isFunction
+        }
+    }
+    return "", signature, isFunction
+}
+
+// cppParameters returns the parameter types of a function declarator
+// without the parameter names and default values, and its qualifiers, so
+// that overloads can be told apart.
+func cppParameters(node *sitter.Node, src []byte) string {
+    var types []string
+    if parameters := cppField(node, "parameters"); parameters != nil {
+        for i := 0; i < int(parameters.NamedChildCount()); i++ {
+            parameter := parameters.NamedChild(i)
+            if cppType(parameter) == "comment" {
+                continue
+            }
+            start, end := int(parameter.StartByte()), int(parameter.EndByte())
+            if value := cppField(parameter, "default_value"); value != nil {
+                end = strings.LastIndexByte(string(src[start:value.StartByte()]), '=') + start
+            }
+            text := string(src[start:end])
+            // Cut out the name of the parameter
+            if declarator := cppField(parameter, "declarator"); declarator != nil {
+                name := declarator
+                for cppType(name) != "identifier" && name.NamedChildCount() > 0 {
+                    inner := cppField(name, "declarator")
+                    if inner == nil {
+                        inner = name.NamedChild(int(name.NamedChildCount()) - 1)
+                    }
+                    name = inner
+                }
+                if cppType(name) == "identifier" && int(name.EndByte()) <= end {
+                    text = string(src[start:name.StartByte()]) + string(src[name.EndByte():end])
+                }
+            }
+            types = append(types, cppPunctuationRegex.ReplaceAllString(squeezeLines(text), "$1"))
+        }
+    }
+    signature := "(" + strings.Join(types, ",") + ")"
+    for i := 0; i < int(node.ChildCount()); i++ {
+        switch child := node.Child(i); cppType(child) {
+        case "type_qualifier", "ref_qualifier":
+            signature += " " + child.Text(src)
+        }
+    }
+    return signature
+}
+
+// The spaces around punctuation do not matter in parameter types, like
+// "const char *" and "const char*".
+var cppPunctuationRegex = regexp.MustCompile(`\s*([^\w\s])\s*`)
+
+// squeeze removes the whitespace from a name, like "a :: b".
+func squeeze(name string) string {
+    return strings.Join(strings.Fields(name), "")
+}
+
+// squeezeLines collapses the whitespace of source, to compare declarations
+// that are not matched by name.
+func squeezeLines(source string) string {
+    return strings.Join(strings.Fields(source), " ")
+}
+
+// mergeCppDeclarations merges a partial C++ file from a reply into the
+// original file, both parsed with tree-sitter: each function, class,
+// variable or macro of the partial file replaces the one with the same
+// qualified name, like "ns::Parser::parse", overloads told apart by their
+// parameter types, and new ones are added next to their class or in their
+// namespace. Lines like "// delete: ns::Parser::parse" delete
+// declarations, and "// delete: #include <map>" includes. The includes of
+// the partial file are added to those of the original. Declarations the
+// partial file leaves out are kept as they are. Problems are returned for
+// the model to fix.
+func mergeCppDeclarations(file string, original string, partial string) (string, error) {
+    orig, err := parseCppFile(original)
+    if err != nil {
+        return "", fmt.Errorf("the original %s could not be parsed, send the entire file: %v", file, err)
+    }
+    part, err := parseCppFile(partial)
+    if err != nil {
+        return "", fmt.Errorf("the declarations for %s could not be parsed: %v", file, err)
+    }
+
+    // Collect the deletions between the declarations and drop their lines
+    // from the partial file
+    deletions, partial := splitDeletions(partial, func(offset int) bool {
+        for _, decl := range part.decls {
+            if offset >= decl.bodyStart && offset < decl.end {
+                return true
+            }
+        }
+        return false
+    })
+    if part, err = parseCppFile(partial); err != nil {
+        return "", fmt.Errorf("the declarations for %s could not be parsed: %v", file, err)
+    }
+    if part.errors > 0 {
+        return "", fmt.Errorf("the declarations for %s do not parse, near line %d", file, part.firstError)
+    }
+
+    // Index the original declarations by their kinds and keys, and by their names
+    index := make(map[string][]int)
+    names := make(map[string][]int)
+    for i, decl := range orig.decls {
+        for _, key := range decl.keys {
+            index[decl.kind+" "+key] = append(index[decl.kind+" "+key], i)
+        }
+        if decl.kind == "other" {
+            index["other "+decl.name] = append(index["other "+decl.name], i)
+        }
+        names[decl.kind+" "+decl.name] = append(names[decl.kind+" "+decl.name], i)
+    }
+    lookup := func(decl cppDecl) []int {
+        if decl.kind == "other" {
+            return index["other "+decl.name]
+        }
+        for _, key := range decl.keys {
+            if matches := index[decl.kind+" "+key]; len(matches) > 0 {
+                return matches
+            }
+        }
+        return nil
+    }
+
+    var edits []sourceEdit
+    var problems []string
+    touched := make(map[int]bool) // Original declarations already replaced or deleted
+
+    // Match the declarations of the partial file: by their keys, then a
+    // function whose parameters changed by its name, and then a name the
+    // reply did not qualify by the end of the qualified name. The last only
+    // if the reply left out the namespaces, so that its declarations are in
+    // a scope that has none in the file, or qualified the name with its
+    // class, like "A::reset" for "ns::A::reset"; a new "reset" next to
+    // other declarations is new, even if a class has a "reset".
+    matched := make(map[int]bool) // Original declarations some declaration of the reply has the key of
+    for _, decl := range part.decls {
+        for _, i := range lookup(decl) {
+            matched[i] = true
+        }
+    }
+    scopes := make(map[string]bool) // The scopes that have declarations in the file
+    for _, decl := range orig.decls {
+        scopes[decl.scope] = true
+    }
+    var added []int
+    placed := make(map[int]int) // The original declaration each one of the reply replaces or repeats
+    for j, decl := range part.decls {
+        matches := lookup(decl)
+        if len(matches) == 0 && decl.kind != "other" {
+            for _, i := range names[decl.kind+" "+decl.name] {
+                if !matched[i] {
+                    matches = append(matches, i)
+                }
+            }
+        }
+        if len(matches) == 0 && decl.kind != "other" && (!scopes[decl.scope] || cppOwner(decl) != "") {
+            for i, candidate := range orig.decls {
+                if candidate.kind == decl.kind && !matched[i] && strings.HasSuffix(candidate.keys[0], "::"+decl.keys[0]) {
+                    matches = append(matches, i)
+                }
+            }
+        }
+        switch {
+        case len(matches) == 0:
+            added = append(added, j)
+            continue
+        case decl.kind == "other":
+            // Repeated unchanged, like a using directive
+            placed[j] = matches[0]
+            continue
+        case len(matches) > 1:
+            problems = append(problems, fmt.Sprintf("%s matches %d declarations in %s; give the parameter types of overloads as they are, and delete the old one to change them", decl.label(), len(matches), file))
+            continue
+        case touched[matches[0]]:
+            problems = append(problems, fmt.Sprintf("%s is changed more than once", decl.label()))
+            continue
+        }
+        i := matches[0]
+        touched[i] = true
+        placed[j] = i
+        // Keep the doc comment of the original if the new one has none
+        start := orig.decls[i].start
+        if decl.doc == "" {
+            start = orig.decls[i].bodyStart
+        }
+        edits = append(edits, sourceEdit{start, orig.decls[i].end, decl.doc + decl.body})
+    }
+
+    // Delete declarations by their names, with the parameter types for overloads
+    var includeDeletions []string
+    for _, deletion := range deletions {
+        if strings.HasPrefix(deletion, "#include") {
+            includeDeletions = append(includeDeletions, squeeze(strings.TrimPrefix(deletion, "#include")))
+            continue
+        }
+        // Names need not be qualified, like "parse" for "ns::Parser::parse"
+        name := squeeze(deletion)
+        var matches []int
+        keys := make(map[string]bool)
+        for _, same := range []func(string) bool{
+            func(n string) bool { return n == name },
+            func(n string) bool { return strings.HasSuffix(n, "::"+name) },
+        } {
+            for i, decl := range orig.decls {
+                if decl.kind == "other" {
+                    continue
+                }
+                for _, key := range decl.keys {
+                    if same(key) || same(decl.name) {
+                        matches = append(matches, i)
+                        keys[key] = true
+                        break
+                    }
+                }
+            }
+            if len(matches) > 0 {
+                break
+            }
+        }
+        switch {
+        case len(matches) == 0:
+            problems = append(problems, fmt.Sprintf("%s cannot be deleted, %s declares no %s", deletion, file, deletion))
+            continue
+        case len(keys) > 1:
+            problems = append(problems, fmt.Sprintf("%s cannot be deleted, it is overloaded in %s; name it with its parameter types, like %s", deletion, file, orig.decls[matches[0]].keys[0]))
+            continue
+        }
+        // A prototype and a definition in the same file both go
+        for _, i := range matches {
+            if touched[i] {
+                problems = append(problems, fmt.Sprintf("%s is deleted, but also changed or deleted before", deletion))
+                continue
+            }
+            touched[i] = true
+            start, end := wholeLines(original, orig.decls[i].start, orig.decls[i].end)
+            // Drop one of the empty lines around it
+            if (start == 0 || strings.HasSuffix(original[:start], "\n\n")) && strings.HasPrefix(original[end:], "\n") {
+                end++
+            }
+            edits = append(edits, sourceEdit{start, end, ""})
+        }
+    }
+
+    // Merge the includes
+    present := make(map[string]bool)
+    for _, include := range orig.includes {
+        present[include.path] = true
+    }
+    for _, path := range includeDeletions {
+        found := false
+        for _, include := range orig.includes {
+            if include.path == path {
+                found = true
+                edits = append(edits, sourceEdit{include.start, include.end, ""})
+            }
+        }
+        if !found {
+            problems = append(problems, fmt.Sprintf("#include %s cannot be deleted, %s does not include it", path, file))
+        }
+    }
+    var includes []string
+    for _, include := range part.includes {
+        if !present[include.path] {
+            present[include.path] = true
+            includes = append(includes, strings.TrimSpace(partial[include.start:include.end])+"\n")
+        }
+    }
+    if len(includes) > 0 {
+        switch {
+        case len(orig.includes) > 0:
+            pos := orig.includes[len(orig.includes)-1].end
+            if !strings.HasSuffix(original[:pos], "\n") {
+                includes[0] = "\n" + includes[0]
+            }
+            edits = append(edits, sourceEdit{pos, pos, strings.Join(includes, "")})
+        case len(orig.decls) > 0:
+            edits = append(edits, sourceEdit{orig.decls[0].start, orig.decls[0].start, strings.Join(includes, "") + "\n"})
+        default:
+            edits = append(edits, sourceEdit{0, 0, strings.Join(includes, "") + "\n"})
+        }
+    }
+
+    if len(problems) > 0 {
+        return "", fmt.Errorf("the declarations for %s could not be merged:\n- %s", file, strings.Join(problems, "\n- "))
+    }
+
+    // Add new declarations next to their class, or to the declarations
+    // around them in the reply
+    for _, j := range added {
+        edits = append(edits, orig.insertion(part.decls, j, placed))
+    }
+
+    merged := strings.TrimRight(spliceEdits(original, edits), " \t\r\n") + "\n"
+    result, err := parseCppFile(merged)
+    if err != nil {
+        return "", fmt.Errorf("the merged %s could not be parsed: %v", file, err)
+    }
+    if result.errors > orig.errors {
+        return "", fmt.Errorf("the merged %s does not parse, near line %d; send the entire file", file, result.firstError)
+    }
+    return merged, nil
+}
+
+// insertion returns the edit that adds the new declaration j of the reply
+// to the file: after the last declaration of its class, like "ns::A" for
+// "ns::A::f", else after or before the declarations around it in the reply
+// that are in the file, placed, else after the last one in its namespace,
+// else at the end of its namespace. Namespaces the file does not have are
+// opened around it.
+func (f *cppFile) insertion(decls []cppDecl, j int, placed map[int]int) sourceEdit {
+    decl := decls[j]
+    text := decl.doc + decl.body
+    scope := decl.scope
+    for scope != "" {
+        if _, ok := f.namespaces[scope]; ok {
+            break
+        }
+        parts := strings.Split(strings.TrimSuffix(scope, "::"), "::")
+        namespace := parts[len(parts)-1]
+        text = "namespace " + namespace + " {\n\n" + text + "\n\n}  // namespace " + namespace
+        scope = strings.TrimSuffix(scope, namespace+"::")
+    }
+    if scope == decl.scope {
+        if owner := cppOwner(decl); owner != "" {
+            after := -1
+            for _, orig := range f.decls {
+                if orig.kind != "other" && (orig.name == owner || strings.HasPrefix(orig.name, owner+"::")) {
+                    after = orig.end
+                }
+            }
+            if after >= 0 {
+                return f.after(after, text)
+            }
+        }
+    }
+
+    // The declarations of the reply around it
+    for k := j - 1; k >= 0; k-- {
+        if i, ok := placed[k]; ok && f.decls[i].scope == scope {
+            return f.after(f.decls[i].end, text)
+        }
+    }
+    for k := j + 1; k < len(decls); k++ {
+        if i, ok := placed[k]; ok && f.decls[i].scope == scope {
+            return sourceEdit{f.decls[i].start, f.decls[i].start, text + "\n\n"}
+        }
+    }
+
+    after := -1
+    for _, orig := range f.decls {
+        if orig.scope == scope {
+            after = orig.end
+        }
+    }
+    switch brace, ok := f.namespaces[scope]; {
+    case after >= 0:
+        return f.after(after, text)
+    case ok:
+        return sourceEdit{brace, brace, "\n" + text + "\n\n"}
+    case len(f.decls) > 0:
+        return f.after(f.decls[len(f.decls)-1].end, text)
+    case strings.HasSuffix(f.src, "\n") || f.src == "":
+        return sourceEdit{len(f.src), len(f.src), "\n" + text + "\n"}
+    }
+    return sourceEdit{len(f.src), len(f.src), "\n\n" + text + "\n"}
+}
+
+// after returns the edit that adds text after the declaration ending at
+// pos, with an empty line before it and, if more code follows, after it.
+func (f *cppFile) after(pos int, text string) sourceEdit {
+    rest := f.src[pos:]
+    if strings.HasPrefix(rest, "\n") && !strings.HasPrefix(rest, "\n\n") && strings.TrimSpace(rest) != "" {
+        text += "\n"
+    }
+    return sourceEdit{pos, pos, "\n\n" + text}
+}
+
+// cppOwner returns the class a function is a member of, from its qualified
+// name without the namespaces it is in, or an empty string.
+func cppOwner(decl cppDecl) string {
+    if decl.kind != "function" && decl.kind != "prototype" {
+        return ""
+    }
+    qualified := strings.TrimPrefix(decl.name, decl.scope)
+    colons := strings.LastIndex(qualified, "::")
+    if colons < 0 {
+        return ""
+    }
+    return decl.scope + qualified[:colons]
+}
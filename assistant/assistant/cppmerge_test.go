@@ -0,0 +1,229 @@
+package assistant
+
+import (
+    "os"
+    "os/exec"
+    "strings"
+    "testing"
+)
+
+// The C++ grammar must not bring in cgo: the module builds without a C
+// compiler.
+func TestBuildWithoutCgo(t *testing.T) {
+    if testing.Short() {
+        t.Skip("builds the whole module")
+    }
+    gobin, err := exec.LookPath("go")
+    if err != nil {
+        t.Skip("no go command")
+    }
+    cmd := exec.Command(gobin, "build", "./...")
+    cmd.Dir = ".."
+    cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+    if output, err := cmd.CombinedOutput(); err != nil {
+        t.Fatalf("CGO_ENABLED=0 go build ./...: %v\n%s", err, output)
+    }
+}
+
+func TestMergeCppDeclarationsDeleteComments(t *testing.T) {
+    original := "void prune() {\n  cache.clear();\n}\n\nvoid old() {}\n"
+    partial := "void prune() {\n  // delete the cache\n  // delete: not a directive\n  cache.clear();\n}\n\n// delete: old\n"
+    merged, err := mergeCppDeclarations("p.cpp", original, partial)
+    if err != nil {
+        t.Fatalf("mergeCppDeclarations: %v", err)
+    }
+    for _, want := range []string{"// delete the cache", "// delete: not a directive"} {
+        if !strings.Contains(merged, want) {
+            t.Errorf("merged file lost %q:\n%s", want, merged)
+        }
+    }
+    if strings.Contains(merged, "old()") {
+        t.Errorf("old was not deleted:\n%s", merged)
+    }
+}
+
+const cppEngine = `#ifndef ENGINE_H
+#define ENGINE_H
+
+#include <vector>
+#include "util.hpp"
+
+namespace engine {
+
+// A holds the state.
+class A {
+ public:
+  int f();
+  void reset();
+};
+
+// f returns one.
+int A::f() { return 1; }
+
+void A::reset() {}
+
+int g(int a, const char* b = "x") { return a; }
+int g(double d) { return 0; }
+
+int h(int a) { return a; }
+
+static int counter = 0;
+
+}  // namespace engine
+
+#endif
+`
+
+func TestMergeCppDeclarations(t *testing.T) {
+    tests := []struct {
+        name     string
+        original string
+        partial  string
+        want     string // The merged file, if given
+        contains []string
+        absent   []string
+        wantErr  string
+    }{
+        {
+            name:     "method replaced in its namespace, doc kept",
+            original: cppEngine,
+            partial:  "namespace engine {\nint A::f() { return 2; }\n}\n",
+            contains: []string{"// f returns one.\nint A::f() { return 2; }"},
+            absent:   []string{"return 1;"},
+        },
+        {
+            name:     "new method after the others of its class",
+            original: cppEngine,
+            partial:  "namespace engine {\n// h is new.\nvoid A::clear() {}\n}\n",
+            contains: []string{"void A::reset() {}\n\n// h is new.\nvoid A::clear() {}\n"},
+        },
+        {
+            name:     "overload told apart by its parameter types",
+            original: cppEngine,
+            partial:  "namespace engine {\nint g(double value) { return 1; }\n}\n",
+            contains: []string{`int g(int a, const char* b = "x") { return a; }`, "int g(double value) { return 1; }"},
+            absent:   []string{"int g(double d)"},
+        },
+        {
+            name:     "changed parameters replace a function without overloads",
+            original: cppEngine,
+            partial:  "namespace engine {\nint h(long a) { return 0; }\n}\n",
+            contains: []string{"int h(long a) { return 0; }"},
+            absent:   []string{"int h(int a)"},
+        },
+        {
+            name:     "changed parameters of an overload are ambiguous",
+            original: cppEngine,
+            partial:  "namespace engine {\nint g(long l) { return 0; }\n}\n",
+            wantErr:  "matches 2 declarations",
+        },
+        {
+            name:     "new overload next to the existing one sent unchanged",
+            original: cppEngine,
+            partial:  "namespace engine {\nint h(int a) { return a; }\nint h(long a) { return 1; }\n}\n",
+            contains: []string{"int h(int a) { return a; }\n\nint h(long a) { return 1; }"},
+        },
+        {
+            name:     "reply without the namespace of the file",
+            original: "namespace ns {\n\nvoid reset() {}\n\n}  // namespace ns\n",
+            partial:  "void reset() { state = 0; }\n",
+            want:     "namespace ns {\n\nvoid reset() { state = 0; }\n\n}  // namespace ns\n",
+        },
+        {
+            name:     "new global function is not taken for a namespaced one",
+            original: "int main() { return 0; }\n\nnamespace ns {\n\nvoid reset() {}\n\n}  // namespace ns\n",
+            partial:  "void reset() { state = 0; }\n",
+            contains: []string{"void reset() {}", "void reset() { state = 0; }"},
+        },
+        {
+            name:     "method qualified by its class only",
+            original: cppEngine,
+            partial:  "void A::reset() { clear(); }\n",
+            contains: []string{"void A::reset() { clear(); }"},
+            absent:   []string{"void A::reset() {}"},
+        },
+        {
+            name:     "new namespace opened before the code that uses it",
+            original: "int main() { return 0; }\n",
+            partial:  "namespace x {\nint y() { return 1; }\n}\nint main() { return x::y(); }\n",
+            want:     "namespace x {\n\nint y() { return 1; }\n\n}  // namespace x\n\nint main() { return x::y(); }\n",
+        },
+        {
+            name:     "includes merged",
+            original: cppEngine,
+            partial:  "#include <map>\n#include <vector>\n\n// delete: #include \"util.hpp\"\n",
+            contains: []string{"#include <vector>\n#include <map>\n\nnamespace engine"},
+            absent:   []string{"util.hpp"},
+        },
+        {
+            name:     "includes added to a file without any",
+            original: "int main() { return 0; }\n",
+            partial:  "#include <cstdio>\n\nint main() { return puts(\"\"); }\n",
+            want:     "#include <cstdio>\n\nint main() { return puts(\"\"); }\n",
+        },
+        {
+            name:     "deletions by qualified and unqualified name",
+            original: cppEngine,
+            partial:  "// delete: engine::counter\n// delete: h\n",
+            absent:   []string{"counter", "int h("},
+            contains: []string{"int g(double d) { return 0; }\n\n}  // namespace engine"},
+        },
+        {
+            name:     "prototype and definition deleted together",
+            original: "int helper();\n\nint main() { return helper(); }\n\nint helper() { return 1; }\n",
+            partial:  "// delete: helper\nint main() { return 0; }\n",
+            want:     "int main() { return 0; }\n",
+        },
+        {
+            name:     "overloaded deletion needs the parameter types",
+            original: cppEngine,
+            partial:  "// delete: g\n",
+            wantErr:  "name it with its parameter types, like engine::g(int,const char*)",
+        },
+        {
+            name:     "overloaded deletion with the parameter types",
+            original: cppEngine,
+            partial:  "// delete: engine::g(double)\n",
+            absent:   []string{"int g(double d)"},
+            contains: []string{"int g(int a"},
+        },
+        {
+            name:     "deleting what the file does not declare",
+            original: cppEngine,
+            partial:  "// delete: nope\n",
+            wantErr:  "declares no nope",
+        },
+        {
+            name:     "reply that does not parse",
+            original: cppEngine,
+            partial:  "int g( {\n",
+            wantErr:  "do not parse",
+        },
+    }
+    for _, test := range tests {
+        merged, err := mergeCppDeclarations("engine.hpp", test.original, test.partial)
+        if test.wantErr != "" {
+            if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+                t.Errorf("%s: got %v, want error %q", test.name, err, test.wantErr)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if test.want != "" && merged != test.want {
+            t.Errorf("%s: got\n%s\nwant\n%s", test.name, merged, test.want)
+        }
+        for _, want := range test.contains {
+            if !strings.Contains(merged, want) {
+                t.Errorf("%s: %q missing from\n%s", test.name, want, merged)
+            }
+        }
+        for _, unwanted := range test.absent {
+            if strings.Contains(merged, unwanted) {
+                t.Errorf("%s: %q still in\n%s", test.name, unwanted, merged)
+            }
+        }
+    }
+}
@@ -0,0 +1,84 @@
+package assistant
+
+import (
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// A line of a partial file in the declarations format that deletes a
+// declaration, like "// delete: parseArgs", "// delete: Server.Close",
+// "// delete: import "os"" or "// delete: #include <map>". The colon is
+// required, so that comments like "// Delete expired entries" are not
+// taken for one.
+var deleteDeclRegex = regexp.MustCompile(`^[ \t]*// ?delete: +(\S.*?)\s*$`)
+
+// sourceEdit replaces the source from start to end with text.
+type sourceEdit struct {
+    start int
+    end   int
+    text  string
+}
+
+// spliceEdits applies edits to src. They must not overlap; insertions at
+// the same offset end up in the order they were made, and before an edit
+// that replaces the source from there.
+func spliceEdits(src string, edits []sourceEdit) string {
+    // Apply the edits from the end, so that the offsets stay valid
+    order := make([]int, len(edits))
+    for i := range order {
+        order[i] = i
+    }
+    sort.SliceStable(order, func(a, b int) bool {
+        first, second := edits[order[a]], edits[order[b]]
+        if first.start != second.start {
+            return first.start > second.start
+        }
+        if (first.end > first.start) != (second.end > second.start) {
+            return first.end > first.start
+        }
+        return order[a] > order[b]
+    })
+    for _, i := range order {
+        edit := edits[i]
+        src = src[:edit.start] + edit.text + src[edit.end:]
+    }
+    return src
+}
+
+// splitDeletions separates the delete lines of a partial file from its
+// source. Only lines between declarations count; inside reports whether an
+// offset of partial is within a declaration, where a delete line is an
+// ordinary comment.
+func splitDeletions(partial string, inside func(offset int) bool) ([]string, string) {
+    var deletions []string
+    var kept []string
+    offset := 0
+    for _, line := range strings.Split(partial, "\n") {
+        match := deleteDeclRegex.FindStringSubmatch(line)
+        if match != nil && !inside(offset) {
+            deletions = append(deletions, match[1])
+        } else {
+            kept = append(kept, line)
+        }
+        offset += len(line) + 1
+    }
+    return deletions, strings.Join(kept, "\n")
+}
+
+// wholeLines widens the range from start to end to the lines it is on, if
+// nothing else is on them, so that deleting it leaves no empty line.
+func wholeLines(src string, start int, end int) (int, int) {
+    lineStart := strings.LastIndexByte(src[:start], '\n') + 1
+    lineEnd := strings.IndexByte(src[end:], '\n')
+    if lineEnd < 0 {
+        lineEnd = len(src) - end
+    }
+    if strings.TrimSpace(src[lineStart:start]) != "" || strings.TrimSpace(src[end:end+lineEnd]) != "" {
+        return start, end
+    }
+    if end+lineEnd < len(src) {
+        lineEnd++
+    }
+    return lineStart, end + lineEnd
+}
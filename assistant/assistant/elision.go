@@ -0,0 +1,342 @@
+package assistant
+
+import (
+    "fmt"
+    "io/ioutil"
+    "math"
+    "os"
+    "regexp"
+    "strings"
+)
+
+// Files are only reconciled up to this many cells of the alignment table,
+// the lines of the reply times the lines of the original, which bounds the
+// memory needed to a few dozen megabytes.
+const maxElisionCells = 8000000
+
+// Scores of the alignment of a reply with the original file. Elided
+// original lines cost nothing, so that an elision takes up the unchanged
+// code around it, but only as far as no reply line matches it better.
+const (
+    matchScore   = 2  // A reply line equal to an original line
+    similarScore = 1  // A reply line that changes an original line
+    insertScore  = 0  // A reply line that is not in the original
+    deleteScore  = -1 // An original line left out of the reply
+)
+
+// A comment on a line of its own, in the comment styles of the common
+// languages, with its text in the first group.
+var elisionCommentRegex = regexp.MustCompile(`^\s*(?://+|#+|--|;+|/\*+|<!--|\*)\s*(.*?)\s*(?:\*+/|-->)?\s*$`)
+
+// The comment says that code was left out, like "// ...", "/* ... existing
+// code ... */" or "# rest of the file unchanged": it starts with an
+// ellipsis, or all of it says so. Comments that merely use such words, like
+// "// Leave the config unchanged", are code.
+var elisionTextRegex = regexp.MustCompile(`^(?:\.\.\.|…|\[\.\.\.\])`)
+var elisionPhraseRegex = regexp.MustCompile(`(?i)^(?:(?:` + elisionSubject + `)(?:,? ` + elisionState + `)?|` + elisionState + `)[.!:]?$`)
+
+const elisionSubject = `(?:the )?(?:rest|remainder) of (?:the )?(?:file|code|class|function|method|implementation|module|struct|imports?)` +
+    `|(?:the )?(?:existing|other|remaining|previous|unchanged|original) (?:code|methods|functions|imports|lines|fields|cases|tests|declarations|implementation)` +
+    `|code|lines|implementation`
+const elisionState = `(?:(?:is|are|remains?|stays?) )?(?:unchanged|omitted|elided|not shown|the same|as before|same as before)`
+
+// notElided is the owner of an original line that appears in the output
+// only as a reply line, or not at all, instead of the reply line of an
+// elision.
+const notElided = -1
+
+// isElision reports whether a reply line stands for unchanged code the
+// model left out.
+func isElision(line string) bool {
+    trimmed := strings.TrimSpace(line)
+    if trimmed == "..." || trimmed == "…" {
+        return true
+    }
+    match := elisionCommentRegex.FindStringSubmatch(line)
+    if match == nil {
+        return false
+    }
+    text := strings.TrimSpace(strings.TrimRight(match[1], ".… "))
+    return elisionTextRegex.MatchString(match[1]) || elisionPhraseRegex.MatchString(text)
+}
+
+// hasElisions reports whether content has a line that stands for unchanged
+// code.
+func hasElisions(content string) bool {
+    for _, line := range strings.Split(content, "\n") {
+        if isElision(line) {
+            return true
+        }
+    }
+    return false
+}
+
+// reconcileElisions fills in the code the model left out of the reply for
+// a file, marked with comments like "// ... rest unchanged", from the
+// original file at path. The reply is aligned with the original line by
+// line; each elision stands for the original lines between the reply lines
+// around it. If the original lines an elision stands for are not clear,
+// like when the lines around it appear several times in the file, nothing
+// is guessed and an error is returned.
+func reconcileElisions(path string, file string, content string) (string, error) {
+    originalBytes, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return "", fmt.Errorf("%s leaves out unchanged code, but the file is new", file)
+    }
+    if err != nil {
+        return "", fmt.Errorf("failed to read original file %s: %v", file, err)
+    }
+    var original []string
+    if len(originalBytes) > 0 {
+        original = strings.Split(strings.TrimSuffix(string(originalBytes), "\n"), "\n")
+    }
+    reply := strings.Split(content, "\n")
+
+    // Lines of the original that look like elisions are code, not elisions
+    originalLines := make(map[string]bool)
+    for _, line := range original {
+        originalLines[looseKey(line)] = true
+    }
+    elisions := make([]bool, len(reply))
+    for i, line := range reply {
+        elisions[i] = isElision(line) && !originalLines[looseKey(line)]
+    }
+
+    if (len(reply)+1)*(len(original)+1) > maxElisionCells {
+        return "", fmt.Errorf("%s is too large to fill in the code left out", file)
+    }
+    a := newAlignment(reply, original, elisions)
+    if line, ok := a.unique(); !ok {
+        return "", fmt.Errorf("the code left out at line %d of %s (%q) cannot be placed unambiguously in the original file", line+1, file, strings.TrimSpace(reply[line]))
+    }
+    return strings.Join(a.output(), "\n"), nil
+}
+
+// alignment lines up the reply for a file with the original file. Cell
+// (i, j) of the tables stands for the first i reply lines aligned with the
+// first j original lines. Moving right takes an original line: into the
+// elision if the i-th reply line is one, or out of the file. Moving down takes a reply
+// line: an inserted line, or the end of an elision. Moving diagonally takes
+// both, a reply line that matches or changes an original line.
+type alignment struct {
+    reply    []string
+    original []string
+    elisions []bool  // Whether each reply line is an elision
+    forward  []int32 // Best score from the start to each cell
+    backward []int32 // Best score from each cell to the end
+
+    // The lines normalized once for the comparisons of every cell: numbered
+    // by their looseKey, so that lines looseLine finds equal have the same
+    // number, and without their indentation for similarLines
+    replyKeys       []int32
+    originalKeys    []int32
+    replyTrimmed    []string
+    originalTrimmed []string
+}
+
+func newAlignment(reply []string, original []string, elisions []bool) *alignment {
+    a := &alignment{reply: reply, original: original, elisions: elisions}
+    keys := make(map[string]int32)
+    normalize := func(lines []string) ([]int32, []string) {
+        numbers := make([]int32, len(lines))
+        trimmed := make([]string, len(lines))
+        for i, line := range lines {
+            key := looseKey(line)
+            if _, seen := keys[key]; !seen {
+                keys[key] = int32(len(keys))
+            }
+            numbers[i] = keys[key]
+            trimmed[i] = strings.TrimSpace(line)
+        }
+        return numbers, trimmed
+    }
+    a.replyKeys, a.replyTrimmed = normalize(reply)
+    a.originalKeys, a.originalTrimmed = normalize(original)
+
+    cells := (len(reply) + 1) * (len(original) + 1)
+    a.forward = make([]int32, cells)
+    a.backward = make([]int32, cells)
+
+    // Fill the forward table from the start
+    for i := 0; i <= len(reply); i++ {
+        for j := 0; j <= len(original); j++ {
+            if i == 0 && j == 0 {
+                continue
+            }
+            best := int32(math.MinInt32)
+            if j > 0 {
+                best = max(best, a.forward[a.cell(i, j-1)]+a.rightScore(i))
+            }
+            if i > 0 {
+                best = max(best, a.forward[a.cell(i-1, j)]+insertScore)
+            }
+            if i > 0 && j > 0 {
+                if score, ok := a.diagonalScore(i-1, j-1); ok {
+                    best = max(best, a.forward[a.cell(i-1, j-1)]+score)
+                }
+            }
+            a.forward[a.cell(i, j)] = best
+        }
+    }
+
+    // Fill the backward table from the end
+    for i := len(reply); i >= 0; i-- {
+        for j := len(original); j >= 0; j-- {
+            if i == len(reply) && j == len(original) {
+                continue
+            }
+            best := int32(math.MinInt32)
+            if j < len(original) {
+                best = max(best, a.backward[a.cell(i, j+1)]+a.rightScore(i))
+            }
+            if i < len(reply) {
+                best = max(best, a.backward[a.cell(i+1, j)]+insertScore)
+            }
+            if i < len(reply) && j < len(original) {
+                if score, ok := a.diagonalScore(i, j); ok {
+                    best = max(best, a.backward[a.cell(i+1, j+1)]+score)
+                }
+            }
+            a.backward[a.cell(i, j)] = best
+        }
+    }
+    return a
+}
+
+func (a *alignment) cell(i int, j int) int {
+    return i*(len(a.original)+1) + j
+}
+
+// rightScore is the score of taking an original line in row i: free for
+// the elision at reply line i-1, a deletion anywhere else.
+func (a *alignment) rightScore(i int) int32 {
+    if i > 0 && a.elisions[i-1] {
+        return 0
+    }
+    return deleteScore
+}
+
+// diagonalScore is the score of aligning reply line i with original line
+// j, if they are similar enough to be aligned.
+func (a *alignment) diagonalScore(i int, j int) (int32, bool) {
+    if a.elisions[i] {
+        return 0, false
+    }
+    if a.replyKeys[i] == a.originalKeys[j] {
+        return matchScore, true
+    }
+    if similarLines(a.replyTrimmed[i], a.originalTrimmed[j]) {
+        return similarScore, true
+    }
+    return 0, false
+}
+
+// optimal reports whether a move with score from cell from to cell to is
+// part of a best alignment.
+func (a *alignment) optimal(from int, to int, score int32) bool {
+    best := a.backward[0]
+    return a.forward[from]+score+a.backward[to] == best
+}
+
+// unique checks that every original line belongs to the same elision, or
+// to none, in all best alignments. If not, the reply line of an elision
+// that could stand for different lines is returned with false.
+func (a *alignment) unique() (int, bool) {
+    owners := make([]int, len(a.original))
+    for j := range owners {
+        owners[j] = math.MinInt
+    }
+    // own records that original line j goes to owner in a best alignment,
+    // and reports false if it goes elsewhere in another one
+    own := func(j int, owner int) bool {
+        if owners[j] == math.MinInt || owners[j] == owner {
+            owners[j] = owner
+            return true
+        }
+        return false
+    }
+    for i := 0; i <= len(a.reply); i++ {
+        for j := 0; j < len(a.original); j++ {
+            owner := notElided
+            if i > 0 && a.elisions[i-1] {
+                owner = i - 1
+            }
+            if a.optimal(a.cell(i, j), a.cell(i, j+1), a.rightScore(i)) && !own(j, owner) {
+                return a.elisionNear(owner, owners[j]), false
+            }
+            if i == len(a.reply) {
+                continue
+            }
+            if score, ok := a.diagonalScore(i, j); ok && a.optimal(a.cell(i, j), a.cell(i+1, j+1), score) && !own(j, notElided) {
+                return a.elisionNear(notElided, owners[j]), false
+            }
+        }
+    }
+    return 0, true
+}
+
+// elisionNear returns the reply line of one of two owners that is an
+// elision.
+func (a *alignment) elisionNear(owner int, other int) int {
+    if owner != notElided {
+        return owner
+    }
+    return other
+}
+
+// output follows a best alignment back from the end and returns the lines
+// of the file: the reply lines, with every elision replaced by the
+// original lines it stands for.
+func (a *alignment) output() []string {
+    var lines []string
+    i, j := len(a.reply), len(a.original)
+    for i > 0 || j > 0 {
+        here := a.forward[a.cell(i, j)]
+        if j > 0 && a.forward[a.cell(i, j-1)]+a.rightScore(i) == here {
+            if i > 0 && a.elisions[i-1] {
+                lines = append(lines, a.original[j-1])
+            }
+            j--
+            continue
+        }
+        if i > 0 && j > 0 {
+            if score, ok := a.diagonalScore(i-1, j-1); ok && a.forward[a.cell(i-1, j-1)]+score == here {
+                lines = append(lines, a.reply[i-1])
+                i--
+                j--
+                continue
+            }
+        }
+        if !a.elisions[i-1] {
+            lines = append(lines, a.reply[i-1])
+        }
+        i--
+    }
+
+    // The lines were collected from the end
+    for left, right := 0, len(lines)-1; left < right; left, right = left+1, right-1 {
+        lines[left], lines[right] = lines[right], lines[left]
+    }
+    return lines
+}
+
+// similarLines reports whether a reply line looks like a changed version
+// of an original line: at least half of the longer one is a common prefix
+// and suffix, ignoring the indentation.
+func similarLines(a string, b string) bool {
+    a, b = strings.TrimSpace(a), strings.TrimSpace(b)
+    // The common part cannot be half of the longer line if the shorter
+    // one is not
+    if a == "" || b == "" || 2*min(len(a), len(b)) < max(len(a), len(b)) {
+        return false
+    }
+    prefix := 0
+    for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+        prefix++
+    }
+    suffix := 0
+    for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+        suffix++
+    }
+    return 2*(prefix+suffix) >= max(len(a), len(b))
+}
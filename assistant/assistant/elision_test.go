@@ -0,0 +1,109 @@
+package assistant
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestIsElision(t *testing.T) {
+    tests := []struct {
+        line string
+        want bool
+    }{
+        {"...", true},
+        {"    …", true},
+        {"// ...", true},
+        {"// ... existing code ...", true},
+        {"/* ... */", true},
+        {"<!-- ... -->", true},
+        {"# rest of the file unchanged", true},
+        {"/* rest of file unchanged */", true},
+        {"// Rest of the code remains the same.", true},
+        {"// other methods unchanged ...", true},
+        {"// existing code", true},
+        {"// unchanged", true},
+        {"-- code omitted", true},
+        {"// Leave the config unchanged when no flags are set", false},
+        {"// Delete omitted entries", false},
+        {"# The rest of the file is parsed lazily", false},
+        {"x := y // ...", false},
+        {"fmt.Println(\"...\")", false},
+    }
+    for _, test := range tests {
+        if got := isElision(test.line); got != test.want {
+            t.Errorf("isElision(%q) = %v, want %v", test.line, got, test.want)
+        }
+    }
+}
+
+func TestReconcileElisions(t *testing.T) {
+    tests := []struct {
+        name     string
+        original string
+        reply    string
+        want     string
+        wantErr  string
+    }{
+        {
+            name:     "elisions at both ends",
+            original: "package p\n\nfunc A() {\n\treturn\n}\n\nfunc B() {\n\treturn\n}\n\nfunc C() {}\n",
+            reply:    "package p\n\n// ... existing code ...\n\nfunc B() {\n\tprintln()\n}\n\n// ... rest of the file unchanged",
+            want:     "package p\n\nfunc A() {\n\treturn\n}\n\nfunc B() {\n\tprintln()\n}\n\nfunc C() {}",
+        },
+        {
+            name:     "comment that mentions unchanged is code",
+            original: "a\nb\nold()\nc\n",
+            reply:    "a\nb\n// Leave the config unchanged when no flags are set\nc",
+            want:     "a\nb\n// Leave the config unchanged when no flags are set\nc",
+        },
+        {
+            name:     "elision line that is in the original is code",
+            original: "a\n// ...\nb\n",
+            reply:    "a\n// ...\nb\nc",
+            want:     "a\n// ...\nb\nc",
+        },
+        {
+            name:     "repeated lines",
+            original: "x\ny\nx\ny\n",
+            reply:    "x\n// ...\n",
+            want:     "x\ny\nx\ny\n",
+        },
+        {
+            name:     "ambiguous between repeated lines",
+            original: "a\nx\nb\nx\nc\n",
+            reply:    "a\n// ...\nx changed\n// ...\nc",
+            wantErr:  "cannot be placed unambiguously",
+        },
+        {
+            name:     "ambiguous between two elisions",
+            original: "f(1)\nf(2)\n",
+            reply:    "// ...\nf(3)\n// ...",
+            wantErr:  "cannot be placed unambiguously",
+        },
+    }
+    dir := t.TempDir()
+    for _, test := range tests {
+        path := filepath.Join(dir, "file")
+        if err := os.WriteFile(path, []byte(test.original), 0644); err != nil {
+            t.Fatal(err)
+        }
+        got, err := reconcileElisions(path, "repo/file", test.reply)
+        switch {
+        case test.wantErr != "":
+            if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+                t.Errorf("%s: got %q, %v, want error %q", test.name, got, err, test.wantErr)
+            }
+        case err != nil:
+            t.Errorf("%s: %v", test.name, err)
+        case got != test.want:
+            t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+        }
+    }
+
+    // A new file has nothing to fill in from
+    if _, err := reconcileElisions(filepath.Join(dir, "missing"), "repo/missing", "// ..."); err == nil || !strings.Contains(err.Error(), "the file is new") {
+        t.Errorf("new file: got %v", err)
+    }
+}
@@ -0,0 +1,168 @@
+package assistant
+
+import (
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// In the marker and block formats, files are deleted and renamed with
+// lines of their own.
+var deleteFileRegex = regexp.MustCompile(`(?m)^\s*/\* DELETE FILE: (.*?) \*/\s*$`)
+var renameFileRegex = regexp.MustCompile(`(?m)^\s*/\* RENAME FILE: (.*?) -> (.*?) \*/\s*$`)
+
+// fileRename moves a file, both named as in the reply.
+type fileRename struct {
+    From string `json:"from"`
+    To   string `json:"to"`
+}
+
+// fileOperations are the files a reply deletes and renames. The files it
+// writes come with their content, separately.
+type fileOperations struct {
+    Deletes []string
+    Renames []fileRename
+}
+
+// parseFileOperations extracts the DELETE FILE and RENAME FILE lines from
+// a reply in the marker or block format.
+func parseFileOperations(response string) fileOperations {
+    var ops fileOperations
+    for _, match := range deleteFileRegex.FindAllStringSubmatch(response, -1) {
+        ops.Deletes = append(ops.Deletes, strings.TrimSpace(match[1]))
+    }
+    for _, match := range renameFileRegex.FindAllStringSubmatch(response, -1) {
+        ops.Renames = append(ops.Renames, fileRename{From: strings.TrimSpace(match[1]), To: strings.TrimSpace(match[2])})
+    }
+    return ops
+}
+
+func (ops fileOperations) empty() bool {
+    return len(ops.Deletes) == 0 && len(ops.Renames) == 0
+}
+
+// files returns every file the operations touch: the deleted files and
+// both names of the renamed ones.
+func (ops fileOperations) files() []string {
+    files := append([]string(nil), ops.Deletes...)
+    for _, rename := range ops.Renames {
+        files = append(files, rename.From, rename.To)
+    }
+    return files
+}
+
+// source returns the file whose current content a file of the reply
+// starts from: the old name of a renamed file, or the file itself.
+func (ops fileOperations) source(file string) string {
+    for _, rename := range ops.Renames {
+        if repoRelative(rename.To) == repoRelative(file) {
+            return rename.From
+        }
+    }
+    return file
+}
+
+// removed reports whether the operations delete file or rename it away.
+func (ops fileOperations) removed(file string) bool {
+    for _, deleted := range ops.Deletes {
+        if repoRelative(deleted) == repoRelative(file) {
+            return true
+        }
+    }
+    for _, rename := range ops.Renames {
+        if repoRelative(rename.From) == repoRelative(file) {
+            return true
+        }
+    }
+    return false
+}
+
+// readFile reads a file of the reply from the working copy at dir as it
+// will be once the operations are carried out: a renamed file has the
+// content of its old name, and deleted files do not exist.
+func (ops fileOperations) readFile(dir string, file string) ([]byte, error) {
+    if ops.removed(file) {
+        return nil, &os.PathError{Op: "open", Path: file, Err: os.ErrNotExist}
+    }
+    return ioutil.ReadFile(workPath(dir, ops.source(file)))
+}
+
+// check makes sure that the operations can be carried out in the working
+// copy at dir, next to the files the reply writes. All problems are
+// reported together, so that the model can correct them in one go.
+func (ops fileOperations) check(dir string, written map[string]string) error {
+    var problems []string
+    exists := func(file string) bool {
+        _, err := os.Stat(workPath(dir, file))
+        return err == nil
+    }
+    seen := make(map[string]bool)
+    claim := func(file string) {
+        if seen[repoRelative(file)] {
+            problems = append(problems, fmt.Sprintf("%s is deleted or renamed more than once", file))
+        }
+        seen[repoRelative(file)] = true
+    }
+
+    for _, file := range ops.Deletes {
+        claim(file)
+        if !exists(file) {
+            problems = append(problems, fmt.Sprintf("%s cannot be deleted, it does not exist", file))
+        }
+    }
+    for _, rename := range ops.Renames {
+        claim(rename.From)
+        claim(rename.To)
+        switch {
+        case repoRelative(rename.From) == repoRelative(rename.To):
+            problems = append(problems, fmt.Sprintf("%s is renamed to itself", rename.From))
+        case !exists(rename.From):
+            problems = append(problems, fmt.Sprintf("%s cannot be renamed, it does not exist", rename.From))
+        case exists(rename.To):
+            problems = append(problems, fmt.Sprintf("%s cannot be renamed to %s, which already exists", rename.From, rename.To))
+        }
+    }
+    for file := range written {
+        if ops.removed(file) {
+            problems = append(problems, fmt.Sprintf("%s is written, but also deleted or renamed; write a renamed file under its new name", file))
+        }
+    }
+
+    if len(problems) > 0 {
+        return newResponseError("the files could not be deleted or renamed, no changes were made:\n- %s", strings.Join(problems, "\n- "))
+    }
+    return nil
+}
+
+// apply carries out the operations in the working copy at dir with git mv
+// and git rm, so that the commit records them. Files git does not know,
+// like files created by an earlier attempt, are moved or removed directly.
+func (ops fileOperations) apply(dir string) error {
+    for _, rename := range ops.Renames {
+        from, to := repoRelative(rename.From), repoRelative(rename.To)
+        if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, filepath.FromSlash(to))), 0755); err != nil {
+            return fmt.Errorf("failed to create directory for %s: %v", rename.To, err)
+        }
+        if _, err := runGit(dir, "mv", "--", from, to); err != nil {
+            log.Printf("git mv of %s failed, renaming it directly: %v", rename.From, err)
+            if err := os.Rename(workPath(dir, from), workPath(dir, to)); err != nil {
+                return fmt.Errorf("failed to rename %s to %s: %v", rename.From, rename.To, err)
+            }
+        }
+        log.Printf("Renamed %s to %s", rename.From, rename.To)
+    }
+    for _, file := range ops.Deletes {
+        if _, err := runGit(dir, "rm", "-q", "-f", "--", repoRelative(file)); err != nil {
+            log.Printf("git rm of %s failed, removing it directly: %v", file, err)
+            if err := os.Remove(workPath(dir, file)); err != nil {
+                return fmt.Errorf("failed to delete %s: %v", file, err)
+            }
+        }
+        log.Printf("Deleted %s", file)
+    }
+    return nil
+}
@@ -7,21 +7,23 @@ import (
   "log"
   "bytes"
   "os"
+  "strings"
 
   "github.com/thomasdullien/coding-assistant/assistant/types"
 )
 
 
 
-// It takes the summary as an argument and renames the local branch.
-func renameBranch(summary string) error {
+// renameBranch renames the local branch oldName after the summary and
+// returns the new name.
+func renameBranch(oldName string, summary string) (string, error) {
     // Append timestamp to the branch name to avoid collision
     timestamp := time.Now().Format("20060102150405") // Format: YYYYMMDDHHMMSS
     newBranchName := fmt.Sprintf("assistant-%s-%s", summary, timestamp)
 
     // Run git command to rename the branch
     cmd := exec.Command("git", "branch",
-      "-m", "assistant-branch", newBranchName)
+      "-m", oldName, newBranchName)
     cmd.Dir = "repo"
 
     // Capture stdout and stderr
@@ -34,12 +36,12 @@ func renameBranch(summary string) error {
     if err != nil {
         // Log the output and error if the command fails
         log.Printf("Failed to rename branch. Stdout: %s, Stderr: %s", outBuf.String(), errBuf.String())
-        return fmt.Errorf("failed to rename branch: %v", err)
+        return "", fmt.Errorf("failed to rename branch: %v", err)
     }
 
     // Log the successful output
     log.Printf("Branch renamed successfully. Stdout: %s", outBuf.String())
-    return nil
+    return newBranchName, nil
 }
 
 func cloneAndCheckoutRepo(data *types.FormData) error {
@@ -78,11 +80,11 @@ func cloneAndCheckoutRepo(data *types.FormData) error {
     return nil
 }
 
-// commitAndPush stages changes, commits them, and pushes to the remote repository.
-// Logs detailed output in case of errors for each command.
-func commitAndPush(data *types.FormData) error {
-    // Run `git add .` to stage all changes
-    addCmd := exec.Command("git", "add", ".")
+// commitAndPush stages changes, commits them with the model's commit message, and pushes to the
+// remote repository. Logs detailed output in case of errors for each command.
+func commitAndPush(data *types.FormData, description changeDescription) error {
+    // Run `git add -A` to stage all changes, including deleted and renamed files
+    addCmd := exec.Command("git", "add", "-A")
     var addOutBuf, addErrBuf bytes.Buffer
     addCmd.Stdout = &addOutBuf
     addCmd.Stderr = &addErrBuf
@@ -93,8 +95,9 @@ func commitAndPush(data *types.FormData) error {
         return fmt.Errorf("failed to add changes: %v", err)
     }
 
-    // Run `git commit -m "Applying user prompt changes"` to create a commit
-    commitCmd := exec.Command("git", "commit", "-m", fmt.Sprintf("Applying changes from user prompt: %s", data.Prompt))
+    // Run `git commit -F -` to create a commit with the message from standard input
+    commitCmd := exec.Command("git", "commit", "-F", "-")
+    commitCmd.Stdin = strings.NewReader(description.commitMessage())
     var commitOutBuf, commitErrBuf bytes.Buffer
     commitCmd.Stdout = &commitOutBuf
     commitCmd.Stderr = &commitErrBuf
@@ -8,11 +8,12 @@ import (
   "github.com/thomasdullien/coding-assistant/assistant/types"
 )
 
-// createPullRequest creates a pull request using the GitHub CLI (`gh`) command.
+// createPullRequest creates a pull request using the GitHub CLI (`gh`) command, with the title
+// and description written by the model and the output of the tests that passed.
 // Logs detailed output in case of errors.
-func createPullRequest(data *types.FormData) (string, error) {
+func createPullRequest(data *types.FormData, description changeDescription, testOutput string) (string, error) {
     // Prepare the `gh` command to create a pull request
-    cmd := exec.Command("gh", "pr", "create", "--title", fmt.Sprintf("Automated Changes based on: %s", data.Prompt), "--body", fmt.Sprintf("Automated changes based on: %s", data.Prompt))
+    cmd := exec.Command("gh", "pr", "create", "--title", description.PRTitle, "--body", description.prBody(testOutput))
     cmd.Dir = "repo" // Set the working directory to the local repo
 
     // Capture stdout and stderr
@@ -0,0 +1,443 @@
+package assistant
+
+import (
+    "fmt"
+    "go/ast"
+    "go/format"
+    "go/parser"
+    "go/token"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+var packageClauseRegex = regexp.MustCompile(`(?m)^package\s`)
+
+// goDecl is a top-level declaration of a Go file, or one spec of a
+// declaration with parentheses, like one constant of a const block.
+type goDecl struct {
+    keys      []string    // "Name", or "Type.Method" for methods; several for "var a, b = ..."
+    tok       token.Token // token.FUNC, token.TYPE, token.VAR or token.CONST
+    start     int         // Offset of the source, from its doc comment if it has one
+    bodyStart int         // Offset of the source without the doc comment
+    end       int         // Offset after the source, including a comment at the end of its line
+    grouped   bool        // A spec of a declaration with parentheses
+    group     int         // Index of the declaration in the file, for the specs of a group
+    doc       string      // The doc comment with its line break, or empty
+    body      string      // The source without the doc comment; without the keyword for specs
+}
+
+// whole returns the source of the declaration as a declaration of its own.
+func (d goDecl) whole() string {
+    if d.tok == token.FUNC {
+        return d.doc + d.body
+    }
+    return d.doc + d.tok.String() + " " + d.body
+}
+
+// spec returns the source of the declaration as a spec of a group.
+func (d goDecl) spec() string {
+    return d.doc + d.body
+}
+
+// mergeGoDeclarations merges a partial Go file from a reply into the
+// original file: each top-level declaration of the partial file replaces
+// the one with the same name, methods keyed by their receiver type, and
+// new declarations are added, methods after the other methods of their
+// type. Lines like "// delete: Name" delete declarations, and
+// "// delete: import "path"" imports. The imports of the partial file are
+// added to those of the original, and the result is formatted with
+// go/format. Declarations the partial file leaves out are kept as they
+// are. Problems are returned for the model to fix.
+func mergeGoDeclarations(file string, original string, partial string) (string, error) {
+    fset := token.NewFileSet()
+    origFile, err := parser.ParseFile(fset, file, original, parser.ParseComments)
+    if err != nil {
+        return "", fmt.Errorf("the original %s does not parse, send the entire file: %v", file, err)
+    }
+    // The partial file may leave out the package clause
+    if !packageClauseRegex.MatchString(partial) {
+        partial = "package " + origFile.Name.Name + "\n\n" + partial
+    }
+    partFile, err := parser.ParseFile(token.NewFileSet(), file, partial, parser.ParseComments)
+    if err != nil {
+        return "", fmt.Errorf("the declarations for %s do not parse: %v", file, err)
+    }
+
+    // Collect the deletions between the declarations and drop their lines
+    // from the partial file
+    deletions, partial := splitDeletions(partial, func(offset int) bool {
+        pos := partFile.FileStart + token.Pos(offset)
+        for _, decl := range partFile.Decls {
+            if pos >= decl.Pos() && pos < decl.End() {
+                return true
+            }
+        }
+        return false
+    })
+    partFile, err = parser.ParseFile(fset, file, partial, parser.ParseComments)
+    if err != nil {
+        return "", fmt.Errorf("the declarations for %s do not parse: %v", file, err)
+    }
+    origDecls := goDecls(fset, origFile, original)
+    partDecls := goDecls(fset, partFile, partial)
+
+    // Index the original declarations by their keys
+    index := make(map[string][]int)
+    for i, decl := range origDecls {
+        for _, key := range decl.keys {
+            index[key] = append(index[key], i)
+        }
+    }
+    find := func(key string) (int, error) {
+        switch matches := index[key]; len(matches) {
+        case 0:
+            return -1, nil
+        case 1:
+            return matches[0], nil
+        default:
+            return -1, fmt.Errorf("%s is declared %d times in %s, send the entire file to change it", key, len(matches), file)
+        }
+    }
+
+    var edits []sourceEdit
+    var problems []string
+    touched := make(map[int]string) // Original declarations already replaced or deleted
+
+    // Delete declarations, and whole groups once all their specs are gone
+    var importDeletions []string
+    deletedSpecs := make(map[int]int)
+    for _, key := range deletions {
+        if strings.HasPrefix(key, "import ") {
+            importDeletions = append(importDeletions, strings.TrimSpace(strings.TrimPrefix(key, "import ")))
+            continue
+        }
+        i, err := find(key)
+        switch {
+        case err != nil:
+            problems = append(problems, err.Error())
+        case i < 0:
+            problems = append(problems, fmt.Sprintf("%s cannot be deleted, %s declares no %s", key, file, key))
+        case touched[i] != "":
+            problems = append(problems, fmt.Sprintf("%s is %s more than once", key, touched[i]))
+        default:
+            touched[i] = "deleted or changed"
+            start, end := origDecls[i].start, origDecls[i].end
+            if origDecls[i].grouped {
+                start, end = wholeLines(original, start, end)
+            }
+            edits = append(edits, sourceEdit{start, end, ""})
+            if origDecls[i].grouped {
+                deletedSpecs[origDecls[i].group]++
+            }
+        }
+    }
+    for group, count := range deletedSpecs {
+        specs := 0
+        for _, decl := range origDecls {
+            if decl.grouped && decl.group == group {
+                specs++
+            }
+        }
+        if specs != count {
+            continue
+        }
+        gen := origFile.Decls[group]
+        start, end := fset.Position(gen.Pos()).Offset, fset.Position(gen.End()).Offset
+        if doc := gen.(*ast.GenDecl).Doc; doc != nil {
+            start = fset.Position(doc.Pos()).Offset
+        }
+        // Replace the deletions of the specs with the deletion of the group
+        var rest []sourceEdit
+        for _, edit := range edits {
+            if edit.start < start || edit.end > end {
+                rest = append(rest, edit)
+            }
+        }
+        edits = append(rest, sourceEdit{start, end, ""})
+    }
+
+    // Replace changed declarations and add new ones
+    var added []goDecl
+    for _, decl := range partDecls {
+        i := -1
+        var findErr error
+        for _, key := range decl.keys {
+            if key == "_" {
+                continue
+            }
+            if i, findErr = find(key); findErr != nil || i >= 0 {
+                break
+            }
+        }
+        if findErr != nil {
+            problems = append(problems, findErr.Error())
+            continue
+        }
+        if i < 0 {
+            if !hasDecl(origDecls, decl) {
+                added = append(added, decl)
+            }
+            continue
+        }
+        if touched[i] != "" {
+            problems = append(problems, fmt.Sprintf("%s is %s more than once", decl.keys[0], touched[i]))
+            continue
+        }
+        touched[i] = "deleted or changed"
+        orig := origDecls[i]
+        text := decl.whole()
+        if orig.grouped {
+            text = decl.spec()
+        }
+        // Keep the doc comment of the original if the new one has none
+        start := orig.start
+        if decl.doc == "" {
+            start = orig.bodyStart
+        }
+        edits = append(edits, sourceEdit{start, orig.end, text})
+    }
+    if len(problems) > 0 {
+        return "", fmt.Errorf("the declarations for %s could not be merged:\n- %s", file, strings.Join(problems, "\n- "))
+    }
+
+    // Add new declarations: methods after the last declaration of their
+    // type, everything else at the end
+    for _, decl := range added {
+        pos := len(original)
+        if receiver := strings.SplitN(decl.keys[0], ".", 2); decl.tok == token.FUNC && len(receiver) == 2 {
+            for _, orig := range origDecls {
+                if orig.keys[0] == receiver[0] || strings.HasPrefix(orig.keys[0], receiver[0]+".") {
+                    pos = orig.end
+                    if orig.grouped {
+                        pos = fset.Position(origFile.Decls[orig.group].End()).Offset
+                    }
+                }
+            }
+        }
+        edits = append(edits, sourceEdit{pos, pos, "\n\n" + decl.whole()})
+    }
+
+    importEdits, err := mergeImports(fset, origFile, partFile, original, importDeletions)
+    if err != nil {
+        return "", fmt.Errorf("the imports of %s could not be merged: %v", file, err)
+    }
+    edits = append(edits, importEdits...)
+
+    merged := spliceEdits(original, edits)
+
+    formatted, err := format.Source([]byte(merged))
+    if err != nil {
+        return "", fmt.Errorf("the merged %s does not parse: %v", file, err)
+    }
+    return string(formatted), nil
+}
+
+// goDecls lists the top-level declarations of a parsed Go file, except
+// the imports, with the specs of declarations with parentheses listed one
+// by one.
+func goDecls(fset *token.FileSet, file *ast.File, src string) []goDecl {
+    offset := func(pos token.Pos) int {
+        return fset.Position(pos).Offset
+    }
+    // withDoc fills in the source range of a declaration
+    withDoc := func(decl goDecl, doc *ast.CommentGroup, start token.Pos, end token.Pos, comment *ast.CommentGroup) goDecl {
+        decl.bodyStart = offset(start)
+        decl.start = decl.bodyStart
+        if doc != nil {
+            decl.start = offset(doc.Pos())
+            decl.doc = src[decl.start:decl.bodyStart]
+        }
+        decl.end = offset(end)
+        if comment != nil && offset(comment.End()) > decl.end {
+            decl.end = offset(comment.End())
+        }
+        return decl
+    }
+
+    var decls []goDecl
+    for i, d := range file.Decls {
+        switch d := d.(type) {
+        case *ast.FuncDecl:
+            decl := withDoc(goDecl{keys: []string{funcKey(d)}, tok: token.FUNC, group: i}, d.Doc, d.Pos(), d.End(), nil)
+            decl.body = src[decl.bodyStart:decl.end]
+            decls = append(decls, decl)
+        case *ast.GenDecl:
+            if d.Tok == token.IMPORT {
+                continue
+            }
+            grouped := d.Lparen.IsValid()
+            for _, spec := range d.Specs {
+                decl := goDecl{tok: d.Tok, grouped: grouped, group: i}
+                var doc, comment *ast.CommentGroup
+                switch spec := spec.(type) {
+                case *ast.TypeSpec:
+                    decl.keys = []string{spec.Name.Name}
+                    doc, comment = spec.Doc, spec.Comment
+                case *ast.ValueSpec:
+                    for _, name := range spec.Names {
+                        decl.keys = append(decl.keys, name.Name)
+                    }
+                    doc, comment = spec.Doc, spec.Comment
+                }
+                if !grouped {
+                    doc = d.Doc
+                }
+                decl = withDoc(decl, doc, spec.Pos(), spec.End(), comment)
+                decl.body = src[decl.bodyStart:decl.end]
+                if !grouped {
+                    // The range covers the keyword, the body does not
+                    decl.bodyStart = offset(d.Pos())
+                    if d.Doc == nil {
+                        decl.start = decl.bodyStart
+                    }
+                }
+                decls = append(decls, decl)
+            }
+        }
+    }
+    return decls
+}
+
+// funcKey returns the key of a function, or "Type.Method" for a method,
+// without the pointer and the type parameters of the receiver.
+func funcKey(decl *ast.FuncDecl) string {
+    if decl.Recv == nil || len(decl.Recv.List) == 0 {
+        return decl.Name.Name
+    }
+    expr := decl.Recv.List[0].Type
+    for {
+        switch e := expr.(type) {
+        case *ast.StarExpr:
+            expr = e.X
+            continue
+        case *ast.IndexExpr:
+            expr = e.X
+            continue
+        case *ast.IndexListExpr:
+            expr = e.X
+            continue
+        case *ast.ParenExpr:
+            expr = e.X
+            continue
+        case *ast.Ident:
+            return e.Name + "." + decl.Name.Name
+        }
+        return decl.Name.Name
+    }
+}
+
+// hasDecl reports whether decls has a declaration with the same source as
+// decl, like an interface assertion "var _ I = (*T)(nil)" the reply
+// repeats.
+func hasDecl(decls []goDecl, decl goDecl) bool {
+    for _, orig := range decls {
+        if looseLine(orig.body, decl.body) && orig.tok == decl.tok {
+            return true
+        }
+    }
+    return false
+}
+
+// mergeImports returns the edits that add the imports of the partial file
+// the original lacks, and delete the imports with the given paths.
+func mergeImports(fset *token.FileSet, origFile *ast.File, partFile *ast.File, original string, deletions []string) ([]sourceEdit, error) {
+    offset := func(pos token.Pos) int {
+        return fset.Position(pos).Offset
+    }
+    importText := func(spec *ast.ImportSpec) string {
+        if spec.Name != nil {
+            return spec.Name.Name + " " + spec.Path.Value
+        }
+        return spec.Path.Value
+    }
+
+    var edits []sourceEdit
+    existing := make(map[string]bool)
+    for _, spec := range origFile.Imports {
+        existing[importText(spec)] = true
+    }
+
+    // Delete imports by their path
+    for _, deletion := range deletions {
+        path, err := strconv.Unquote(deletion)
+        if err != nil {
+            path = deletion
+        }
+        found := false
+        for _, d := range origFile.Decls {
+            gen, ok := d.(*ast.GenDecl)
+            if !ok || gen.Tok != token.IMPORT {
+                continue
+            }
+            for _, spec := range gen.Specs {
+                spec := spec.(*ast.ImportSpec)
+                if unquoted, _ := strconv.Unquote(spec.Path.Value); unquoted != path {
+                    continue
+                }
+                found = true
+                if gen.Lparen.IsValid() && len(gen.Specs) > 1 {
+                    end := offset(spec.End())
+                    if spec.Comment != nil {
+                        end = offset(spec.Comment.End())
+                    }
+                    start, end := wholeLines(original, offset(spec.Pos()), end)
+                    edits = append(edits, sourceEdit{start, end, ""})
+                } else {
+                    edits = append(edits, sourceEdit{offset(gen.Pos()), offset(gen.End()), ""})
+                }
+            }
+        }
+        if !found {
+            return nil, fmt.Errorf("import %q cannot be deleted, the file does not import it", path)
+        }
+    }
+
+    // Add the new imports to the first import group, or after the package clause
+    var added []string
+    for _, spec := range partFile.Imports {
+        if text := importText(spec); !existing[text] {
+            existing[text] = true
+            added = append(added, text)
+        }
+    }
+    if len(added) == 0 {
+        return edits, nil
+    }
+    for _, d := range origFile.Decls {
+        gen, ok := d.(*ast.GenDecl)
+        if !ok || gen.Tok != token.IMPORT || !gen.Lparen.IsValid() {
+            continue
+        }
+        pos := offset(gen.Rparen)
+        text := "\t" + strings.Join(added, "\n\t") + "\n"
+        if before := strings.TrimRight(original[:pos], " \t"); !strings.HasSuffix(before, "\n") {
+            text = "\n" + text
+        }
+        return append(edits, sourceEdit{pos, pos, text}), nil
+    }
+    // A single import without parentheses becomes a group with the new ones
+    if len(edits) == 0 && len(origFile.Imports) == 1 {
+        for _, d := range origFile.Decls {
+            if gen, ok := d.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+                spec := gen.Specs[0].(*ast.ImportSpec)
+                end := offset(spec.End())
+                if spec.Comment != nil {
+                    end = offset(spec.Comment.End())
+                }
+                text := "import (\n\t" + original[offset(spec.Pos()):end] + "\n\t" + strings.Join(added, "\n\t") + "\n)"
+                return []sourceEdit{{offset(gen.Pos()), end, text}}, nil
+            }
+        }
+    }
+    pos := offset(origFile.Name.End())
+    for _, d := range origFile.Decls {
+        if gen, ok := d.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+            pos = offset(gen.End())
+        }
+    }
+    if len(added) == 1 {
+        return append(edits, sourceEdit{pos, pos, "\n\nimport " + added[0]}), nil
+    }
+    return append(edits, sourceEdit{pos, pos, "\n\nimport (\n\t" + strings.Join(added, "\n\t") + "\n)"}), nil
+}
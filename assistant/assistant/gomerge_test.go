@@ -0,0 +1,203 @@
+package assistant
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestMergeGoDeclarationsDeleteComments(t *testing.T) {
+    original := "package p\n\nfunc Prune() {\n\tcache = nil\n}\n\nfunc Old() {}\n"
+    partial := "// Prune empties the cache.\nfunc Prune() {\n\t// Delete expired entries\n\t// delete: the rest\n\tcache = nil\n}\n\n// delete: Old\n"
+    merged, err := mergeGoDeclarations("p.go", original, partial)
+    if err != nil {
+        t.Fatalf("mergeGoDeclarations: %v", err)
+    }
+    for _, want := range []string{"// Delete expired entries", "// delete: the rest", "// Prune empties the cache."} {
+        if !strings.Contains(merged, want) {
+            t.Errorf("merged file lost %q:\n%s", want, merged)
+        }
+    }
+    if strings.Contains(merged, "func Old") {
+        t.Errorf("Old was not deleted:\n%s", merged)
+    }
+
+    // A top-level comment without the colon is a comment
+    merged, err = mergeGoDeclarations("p.go", original, "// Delete expired entries\nfunc Prune() {}\n")
+    if err != nil {
+        t.Fatalf("mergeGoDeclarations: %v", err)
+    }
+    if !strings.Contains(merged, "// Delete expired entries\nfunc Prune() {}") || !strings.Contains(merged, "func Old") {
+        t.Errorf("unexpected merge:\n%s", merged)
+    }
+}
+
+func TestMergeGoDeclarations(t *testing.T) {
+    original := `package p
+
+import "fmt"
+
+const (
+	A = 1
+	B = 2
+)
+
+var x, y int
+
+type T struct{}
+
+func (t *T) Get() int { return 1 }
+
+func (t T) Name() string { return "t" }
+
+type G[K comparable] struct{}
+
+func (g *G[K]) Get() int { return 2 }
+
+func Get() int { return 3 }
+
+func init() { fmt.Println() }
+
+var _ fmt.Stringer = (*T)(nil)
+`
+    tests := []struct {
+        name    string
+        partial string
+        want    string // Empty if the merge fails
+        problem string // Part of the error, if it fails
+    }{
+        {
+            name:    "methods are keyed by their receiver",
+            partial: "func (t *T) Get() int { return 10 }\n",
+            want:    strings.Replace(original, "func (t *T) Get() int { return 1 }", "func (t *T) Get() int { return 10 }", 1),
+        },
+        {
+            name:    "generic receivers",
+            partial: "func (g *G[V]) Get() int { return 20 }\n",
+            want:    strings.Replace(original, "func (g *G[K]) Get() int { return 2 }", "func (g *G[V]) Get() int { return 20 }", 1),
+        },
+        {
+            name:    "functions are not methods",
+            partial: "func Get() int { return 30 }\n",
+            want:    strings.Replace(original, "func Get() int { return 3 }", "func Get() int { return 30 }", 1),
+        },
+        {
+            name:    "the receiver may change from value to pointer",
+            partial: "func (t *T) Name() string { return \"T\" }\n",
+            want:    strings.Replace(original, "func (t T) Name() string { return \"t\" }", "func (t *T) Name() string { return \"T\" }", 1),
+        },
+        {
+            name:    "new methods go after the other methods of their type",
+            partial: "func (t *T) Set() {}\n",
+            want:    strings.Replace(original, "func (t T) Name() string { return \"t\" }\n", "func (t T) Name() string { return \"t\" }\n\nfunc (t *T) Set() {}\n", 1),
+        },
+        {
+            name:    "new functions go at the end",
+            partial: "func Put() {}\n",
+            want:    original + "\nfunc Put() {}\n",
+        },
+        {
+            name:    "a spec of a group is replaced in the group",
+            partial: "const B = 20\n",
+            want:    strings.Replace(original, "\tB = 2\n", "\tB = 20\n", 1),
+        },
+        {
+            name:    "a group in the reply replaces its specs",
+            partial: "const (\n\tA = 10\n\tB = 20\n)\n",
+            want:    strings.Replace(original, "\tA = 1\n\tB = 2\n", "\tA = 10\n\tB = 20\n", 1),
+        },
+        {
+            name:    "a spec with several names",
+            partial: "var y, x string\n",
+            want:    strings.Replace(original, "var x, y int", "var y, x string", 1),
+        },
+        {
+            name:    "deleting a spec of a group",
+            partial: "// delete: A\n",
+            want:    strings.Replace(original, "\tA = 1\n", "", 1),
+        },
+        {
+            name:    "deleting every spec deletes the group",
+            partial: "// delete: A\n// delete: B\n",
+            want:    strings.Replace(original, "const (\n\tA = 1\n\tB = 2\n)\n\n", "", 1),
+        },
+        {
+            name:    "deleting a method",
+            partial: "// delete: T.Name\n",
+            want:    strings.Replace(original, "func (t T) Name() string { return \"t\" }\n\n", "", 1),
+        },
+        {
+            name:    "imports are added to a single import",
+            partial: "import \"os\"\n\nfunc Get() int { return len(os.Args) }\n",
+            want:    strings.Replace(strings.Replace(original, "import \"fmt\"", "import (\n\t\"fmt\"\n\t\"os\"\n)", 1), "func Get() int { return 3 }", "func Get() int { return len(os.Args) }", 1),
+        },
+        {
+            name:    "imports already there are not added again",
+            partial: "import \"fmt\"\n\nfunc Get() int { return 3 }\n",
+            want:    original,
+        },
+        {
+            name:    "deleting an import",
+            partial: "// delete: import \"fmt\"\n// delete: init\n// delete: _\n",
+            want:    strings.Replace(original[:strings.Index(original, "\nfunc init")], "import \"fmt\"\n\n", "", 1),
+        },
+        {
+            name:    "repeated blank declarations are not added again",
+            partial: "var _ fmt.Stringer = (*T)(nil)\n",
+            want:    original,
+        },
+        {
+            name:    "blank declarations are added",
+            partial: "var _ fmt.Stringer = T{}\n",
+            want:    original + "\nvar _ fmt.Stringer = T{}\n",
+        },
+        {
+            name:    "unknown deletions",
+            partial: "// delete: Missing\n",
+            problem: "Missing cannot be deleted",
+        },
+        {
+            name:    "unknown import deletions",
+            partial: "// delete: import \"os\"\n",
+            problem: "import \"os\" cannot be deleted",
+        },
+        {
+            name:    "a declaration changed twice",
+            partial: "func Get() int { return 4 }\n\nfunc Get() int { return 5 }\n",
+            problem: "Get is deleted or changed more than once",
+        },
+        {
+            name:    "a reply that does not parse",
+            partial: "func Get( {\n",
+            problem: "do not parse",
+        },
+    }
+    for _, test := range tests {
+        merged, err := mergeGoDeclarations("p.go", original, test.partial)
+        if test.want == "" {
+            if err == nil || !strings.Contains(err.Error(), test.problem) {
+                t.Errorf("%s: got %v, want an error containing %q:\n%s", test.name, err, test.problem, merged)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if merged != test.want {
+            t.Errorf("%s: got\n%s\nwant\n%s", test.name, merged, test.want)
+        }
+    }
+
+    // Imports are added to an import group
+    grouped := "package p\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc F() { fmt.Println(os.Args) }\n"
+    merged, err := mergeGoDeclarations("p.go", grouped, "import \"strings\"\n\n// delete: import \"os\"\nfunc F() { fmt.Println(strings.Join(nil, \"\")) }\n")
+    if want := "package p\n\nimport (\n\t\"fmt\"\n\t\"strings\"\n)\n\nfunc F() { fmt.Println(strings.Join(nil, \"\")) }\n"; err != nil || merged != want {
+        t.Errorf("import group: got %v\n%s\nwant\n%s", err, merged, want)
+    }
+
+    // Several init functions cannot be told apart
+    inits := "package p\n\nfunc init() {}\n\nfunc init() {}\n"
+    if _, err := mergeGoDeclarations("p.go", inits, "func init() { x() }\n"); err == nil || !strings.Contains(err.Error(), "init is declared 2 times") {
+        t.Errorf("several init functions: got %v", err)
+    }
+}
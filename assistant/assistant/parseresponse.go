@@ -2,43 +2,74 @@ package assistant
 
 import (
   "regexp"
-  "io/ioutil"
-  "fmt"
   "strings"
 )
 
+// Regex to match the START and END delimiters with file paths, ensuring they
+// are surrounded by newlines
+var fileStartRegex = regexp.MustCompile(`(?m)^\s*/\* START OF FILE: (.*?) \*/\s*$`)
+var fileEndRegex = regexp.MustCompile(`(?m)^\s*/\* END OF FILE: .*? \*/\s*$`)
+
+// fileParser extracts entire files from a reply in one of the formats
+// models use for them.
+type fileParser struct {
+    name  string // For the log, e.g. "file markers"
+    parse func(response string) map[string]string
+}
+
+// fileParsers are tried in order until one finds a file. Models asked for
+// file markers sometimes reply with Markdown code blocks instead.
+var fileParsers = []fileParser{
+    {"file markers", parseMarkedFiles},
+    {"Markdown code blocks", parseFencedFiles},
+}
+
+// Matches "Summary: $summary", where $summary contains only alphanumeric
+// characters and dashes, also with Markdown emphasis around the label, like
+// "**Summary:** fix-parser" or "__Summary__: fix-parser".
+var summaryRegex = regexp.MustCompile(`Summary(?:\*\*|__)?:(?:\*\*|__)?\s*([a-zA-Z0-9-]+)`)
+
+// findSummary returns the summary of a reply in any of the formats with a
+// Summary line, and whether it has one.
+func findSummary(response string) (string, bool) {
+    match := summaryRegex.FindStringSubmatch(response)
+    if match == nil {
+        return "", false
+    }
+    return match[1], true
+}
+
 // parseResponseForFiles extracts the content for each file and a summary string from the response.
-// It returns a map of file paths and their contents, the extracted summary string, and a boolean indicating success.
-func parseResponseForFiles(response string) (map[string]string, string, bool) {
-    filesContent := make(map[string]string)
+// It returns a map of file paths and their contents, the extracted summary string, the name of the
+// parser that found the files, and a boolean indicating success. A reply without files is a success
+// if it has a summary, since it may only delete or rename files.
+func parseResponseForFiles(response string) (map[string]string, string, string, bool) {
+    summary, found := findSummary(response)
+    if !found {
+        return nil, "", "", false
+    }
 
-    // Regex to match the START and END delimiters with file paths, ensuring they 
-    //are surrounded by newlines
-    startRegex := regexp.MustCompile(`(?m)^\s*/\* START OF FILE: (.*?) \*/\s*$`)
-    endRegex := regexp.MustCompile(`(?m)^\s*/\* END OF FILE: .*? \*/\s*$`)
-    
-    // Regex to match "Summary: $summary", where $summary contains only alphanumeric characters and dashes
-    summaryRegex := regexp.MustCompile(`Summary: ([a-zA-Z0-9-]+)`)
-    summaryMatch := summaryRegex.FindStringSubmatch(response)
-    var summary string
-    if len(summaryMatch) > 1 {
-        summary = summaryMatch[1]
-    } else {
-        return nil, "", false // No summary found
+    for _, parser := range fileParsers {
+        if filesContent := parser.parse(response); len(filesContent) > 0 {
+            return filesContent, summary, parser.name, true
+        }
     }
+    return map[string]string{}, summary, "", true
+}
+
+// parseMarkedFiles extracts the files between START OF FILE and END OF FILE markers.
+func parseMarkedFiles(response string) map[string]string {
+    filesContent := make(map[string]string)
 
     // Find all start matches and iterate over them
-    startMatches := startRegex.FindAllStringSubmatchIndex(response, -1)
-    if len(startMatches) == 0 {
-        return nil, "", false // No files found
-    }
+    startMatches := fileStartRegex.FindAllStringSubmatchIndex(response, -1)
 
     for _, startMatch := range startMatches {
         end := startMatch[1]
         filename := response[startMatch[2]:startMatch[3]] // Extract filename from capture group
 
         // Find the corresponding end delimiter starting from the end of the start delimiter
-        endMatch := endRegex.FindStringIndex(response[end:])
+        endMatch := fileEndRegex.FindStringIndex(response[end:])
         if endMatch == nil {
             continue // If there's no matching END delimiter, skip this file
         }
@@ -48,55 +79,168 @@ func parseResponseForFiles(response string) (map[string]string, string, bool) {
         contentEnd := end + endMatch[0]
         content := strings.TrimSpace(response[contentStart:contentEnd])
 
-        // Store the filename and its content in the map
-        filesContent[filename] = content
+        // Store the filename and its content in the map, without a code
+        // fence the model may have put around it inside the markers
+        filesContent[filename] = stripFence(content)
     }
 
-    return filesContent, summary, true
+    return filesContent
 }
 
+// A Markdown code fence: three or more backticks or tildes, then the info
+// string, like "go" or "go title=main.go".
+var fenceRegex = regexp.MustCompile("^\\s*(`{3,}|~{3,})\\s*(.*?)\\s*$")
 
-func spliceFileWithOriginal(filePath, newContent string) (string, error) {
-    // Read the original file from the repository
-    originalContentBytes, err := ioutil.ReadFile(filePath)
-    if err != nil {
-        return "", fmt.Errorf("failed to read original file %s: %v", filePath, err)
-    }
-    originalContent := string(originalContentBytes)
+// A file name in the info string of a fence, like "title=main.go" or
+// "go:main.go".
+var infoFileRegex = regexp.MustCompile(`(?:^|\s)(?:title|file|filename|path|name)\s*=\s*["']?([^"'\s]+)|^[\w+#-]+:(\S+)$`)
 
-    // Split the response into sections before and after the placeholder
-    parts := strings.Split(newContent, "// ... (other functions remain unchanged)")
-    if len(parts) != 2 {
-        return "", fmt.Errorf("unexpected content format, placeholder not properly split in %s", filePath)
-    }
+// A word that looks like a file name: with a directory or an extension
+// that starts with a letter, and not an abbreviation like "e.g".
+var fileNameRegex = regexp.MustCompile(`[\w./\\-]*[\w-]{2,}(?:/[\w.-]+|\.[A-Za-z][A-Za-z0-9]{0,9})\b`)
 
-    beforePlaceholder := parts[0]
-    afterPlaceholder := parts[1]
+// The first line of a block that only names its file, like "// main.go" or
+// "# File: repo/main.go".
+var nameCommentRegex = regexp.MustCompile(`^\s*(?://|#|--|/\*)\s*(?:(?i:file(?:name)?|path):\s*)?([\w./\\-]+)\s*(?:\*/)?\s*$`)
 
-    // Extract the last few lines of "beforePlaceholder"
-    beforeLines := strings.Split(beforePlaceholder, "\n")
-    linesToMatch := 5
-    if len(beforeLines) < linesToMatch {
-        linesToMatch = len(beforeLines)
-    }
-    lastFewLines := strings.Join(beforeLines[len(beforeLines)-linesToMatch:], "\n")
+// A line that names a file with a label, like "File: main.go", "**File:**
+// `main.go`" or, on the first line of a block, "// File: main.go".
+var fileLabelRegex = regexp.MustCompile(`^\s*(?:(?://|#|--|/\*)\s*)?(?:\*\*|__)?(?i:file(?:name)?|path)(?:\*\*|__)?\s*:(.*)$`)
+
+// A Markdown heading, like "### repo/main.go".
+var headingRegex = regexp.MustCompile(`^\s{0,3}#{1,6}\s+(.*)$`)
+
+// How many lines before a fence are searched for its file name.
+const fenceNameLines = 3
+
+// The parts of a reply that describe the change. Code blocks in them are
+// examples, not files.
+var descriptionBlocks = []string{"COMMIT BODY", "PR DESCRIPTION"}
+
+// parseFencedFiles extracts the files in Markdown code blocks. The name of
+// a file is taken from the info string of its fence, from a "File:" line
+// on its first line, or from a heading or a "File:" line just before the
+// fence. Blocks without a name, like example commands, and the blocks in
+// the commit body and the pull request description are skipped.
+func parseFencedFiles(response string) map[string]string {
+    filesContent := make(map[string]string)
+    lines := strings.Split(withoutDescription(response), "\n")
+    for i := 0; i < len(lines); i++ {
+        open := fenceRegex.FindStringSubmatch(lines[i])
+        if open == nil {
+            continue
+        }
 
-    // Search for the last few lines in the original file
-    beforeIndex := strings.LastIndex(originalContent, lastFewLines)
-    if beforeIndex == -1 {
-        return "", fmt.Errorf("could not find matching section for 'before' in original file %s", filePath)
+        // Find the closing fence, made of the same character, at least as long
+        end := i + 1
+        for ; end < len(lines); end++ {
+            if close := fenceRegex.FindStringSubmatch(lines[end]); close != nil && close[2] == "" && close[1][0] == open[1][0] && len(close[1]) >= len(open[1]) {
+                break
+            }
+        }
+        block := lines[i+1 : min(end, len(lines))]
+
+        name := fenceInfoName(open[2])
+        if len(block) > 0 && name == "" {
+            if match := fileLabelRegex.FindStringSubmatch(block[0]); match != nil {
+                if name = fileNameIn(match[1]); name != "" {
+                    block = block[1:]
+                }
+            }
+        }
+        if name == "" {
+            name = nameBefore(lines, i)
+        }
+        // A comment on the first line that repeats the name is an artifact
+        // of the fence, not part of the file
+        if len(block) > 0 && name != "" {
+            if match := nameCommentRegex.FindStringSubmatch(block[0]); match != nil && repoRelative(match[1]) == repoRelative(name) {
+                block = block[1:]
+            }
+        }
+        if name != "" {
+            filesContent[name] = strings.TrimSpace(strings.Join(block, "\n"))
+        }
+        i = end
     }
+    return filesContent
+}
 
-    // Extract the content from the original file after the placeholder
-    afterIndex := strings.Index(originalContent[beforeIndex:], afterPlaceholder)
-    if afterIndex == -1 {
-        return "", fmt.Errorf("could not find matching section for 'after' in original file %s", filePath)
+// withoutDescription blanks the commit body and the pull request
+// description of a reply, keeping its lines.
+func withoutDescription(response string) string {
+    for _, name := range descriptionBlocks {
+        for {
+            start := strings.Index(response, "/* START OF "+name+" */")
+            if start < 0 {
+                break
+            }
+            end := strings.Index(response[start:], "/* END OF "+name+" */")
+            if end < 0 {
+                end = len(response)
+            } else {
+                end += start + len("/* END OF "+name+" */")
+            }
+            blank := strings.Repeat("\n", strings.Count(response[start:end], "\n"))
+            response = response[:start] + blank + response[end:]
+        }
     }
+    return response
+}
 
-    // Splice the sections together
-    splicedContent := originalContent[:beforeIndex] + beforePlaceholder + originalContent[beforeIndex+afterIndex:] + afterPlaceholder
+// fenceInfoName returns the file name in the info string of a fence, or
+// an empty string.
+func fenceInfoName(info string) string {
+    if match := infoFileRegex.FindStringSubmatch(info); match != nil {
+        return match[1] + match[2]
+    }
+    // The info string may be the file name itself, or a language and a file name
+    fields := strings.Fields(info)
+    if len(fields) > 0 && fileNameRegex.FindString(fields[len(fields)-1]) == fields[len(fields)-1] {
+        return fields[len(fields)-1]
+    }
+    return ""
+}
 
-    return splicedContent, nil
+// nameBefore returns the file name that the closest line before line
+// fence names, if it is a heading like "### repo/main.go" or a "File:"
+// line, looking at most fenceNameLines lines back past empty lines.
+func nameBefore(lines []string, fence int) string {
+    for i := fence - 1; i >= 0 && i >= fence-fenceNameLines; i-- {
+        if strings.TrimSpace(lines[i]) == "" {
+            continue
+        }
+        if match := headingRegex.FindStringSubmatch(lines[i]); match != nil {
+            return fileNameIn(match[1])
+        }
+        if match := fileLabelRegex.FindStringSubmatch(lines[i]); match != nil {
+            return fileNameIn(match[1])
+        }
+        return ""
+    }
+    return ""
 }
 
+// fileNameIn returns the last word of text that looks like a file name, or
+// an empty string.
+func fileNameIn(text string) string {
+    names := fileNameRegex.FindAllString(text, -1)
+    if len(names) == 0 {
+        return ""
+    }
+    return names[len(names)-1]
+}
 
+// stripFence removes a code fence around content, if there is one.
+func stripFence(content string) string {
+    lines := strings.Split(content, "\n")
+    if len(lines) < 2 {
+        return content
+    }
+    open := fenceRegex.FindStringSubmatch(lines[0])
+    close := fenceRegex.FindStringSubmatch(lines[len(lines)-1])
+    if open == nil || close == nil || close[2] != "" || close[1][0] != open[1][0] {
+        return content
+    }
+    return strings.TrimSpace(strings.Join(lines[1:len(lines)-1], "\n"))
+}
@@ -0,0 +1,98 @@
+package assistant
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseFencedFiles(t *testing.T) {
+    tests := []struct {
+        name     string
+        response string
+        want     map[string]string
+    }{
+        {
+            name:     "info string",
+            response: "Here it is:\n\n```go title=main.go\npackage main\n```\n",
+            want:     map[string]string{"main.go": "package main"},
+        },
+        {
+            name:     "heading",
+            response: "### repo/util.go\n\n```go\npackage util\n```\n",
+            want:     map[string]string{"repo/util.go": "package util"},
+        },
+        {
+            name:     "File line before the fence",
+            response: "**File:** `cmd/app.go`\n```go\npackage main\n```\n",
+            want:     map[string]string{"cmd/app.go": "package main"},
+        },
+        {
+            name:     "File comment on the first line",
+            response: "```go\n// File: main.go\npackage main\n```\n",
+            want:     map[string]string{"main.go": "package main"},
+        },
+        {
+            name:     "comment repeating the name is dropped",
+            response: "```go main.go\n// main.go\npackage main\n```\n",
+            want:     map[string]string{"main.go": "package main"},
+        },
+        {
+            name:     "prose naming a file does not name the block",
+            response: "Update main.go like this:\n\n```go\npackage main\n```\n",
+            want:     map[string]string{},
+        },
+        {
+            name:     "blocks without names are skipped",
+            response: "Run the tests:\n\n```sh\ngo test ./...\n```\n",
+            want:     map[string]string{},
+        },
+        {
+            name: "blocks in the description are examples",
+            response: "### main.go\n```go\npackage main\n```\n" +
+                "/* START OF PR DESCRIPTION */\n### config.go\n```go\nvar x = 1\n```\n/* END OF PR DESCRIPTION */\n" +
+                "/* START OF COMMIT BODY */\nFile: util.go\n```go\nvar y = 2\n```\n/* END OF COMMIT BODY */\n",
+            want: map[string]string{"main.go": "package main"},
+        },
+    }
+    for _, test := range tests {
+        if got := parseFencedFiles(test.response); !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+        }
+    }
+}
+
+func TestParseResponseForFilesPrefersMarkers(t *testing.T) {
+    response := "/* START OF FILE: repo/main.go */\npackage main\n/* END OF FILE: repo/main.go */\n" +
+        "### other.go\n```go\npackage other\n```\nSummary: add-main\n"
+    files, summary, parser, ok := parseResponseForFiles(response)
+    if !ok || summary != "add-main" || parser != "file markers" {
+        t.Fatalf("got %q, %q, %v", summary, parser, ok)
+    }
+    if want := map[string]string{"repo/main.go": "package main"}; !reflect.DeepEqual(files, want) {
+        t.Errorf("got %q, want %q", files, want)
+    }
+}
+
+func TestSummaryInEveryFormat(t *testing.T) {
+    for _, line := range []string{"Summary: fix-loop", "**Summary:** fix-loop", "**Summary**: fix-loop", "__Summary:__ fix-loop", "Summary:fix-loop"} {
+        if summary, found := findSummary("Done.\n" + line + "\n"); !found || summary != "fix-loop" {
+            t.Errorf("findSummary(%q) = %q, %v", line, summary, found)
+        }
+
+        markers := "/* START OF FILE: repo/a.go */\npackage a\n/* END OF FILE: repo/a.go */\n" + line + "\n"
+        if _, summary, _, ok := parseResponseForFiles(markers); !ok || summary != "fix-loop" {
+            t.Errorf("markers with %q: got %q, %v", line, summary, ok)
+        }
+        diff := "/* START OF DIFF */\n--- a/a.go\n+++ b/a.go\n@@ -1 +1 @@\n-a\n+b\n/* END OF DIFF */\n" + line + "\n"
+        if _, summary, ok := parseResponseForDiff(diff); !ok || summary != "fix-loop" {
+            t.Errorf("diff with %q: got %q, %v", line, summary, ok)
+        }
+        blocks := line + "\n/* START OF EDITS: repo/a.go */\n<<<<<<< SEARCH\na\n=======\nb\n>>>>>>> REPLACE\n/* END OF EDITS: repo/a.go */\n"
+        if _, summary, err := parseResponseForEdits(blocks); err != nil || summary != "fix-loop" {
+            t.Errorf("blocks with %q: got %q, %v", line, summary, err)
+        }
+    }
+    if _, found := findSummary("No summary here.\n"); found {
+        t.Error("findSummary found a summary in a reply without one")
+    }
+}
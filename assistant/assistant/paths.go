@@ -0,0 +1,158 @@
+package assistant
+
+import (
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// The prompt names the files of the repository relative to the working
+// directory of the job, where it is cloned to "repo".
+const repoPrefix = "repo/"
+
+// Build and test output names the files of a candidate by its working copy.
+var candidatePrefixRegex = regexp.MustCompile(`^` + candidateDir + `/candidate-\d+/`)
+
+// repoPath maps a file name used by the model or the user onto the
+// repository root: "repo/main.go", "./main.go", "main.go" and the absolute
+// path of the file in the clone or in a candidate's working copy all
+// become "main.go". The root itself is ".". Names that lead out of the
+// repository or into its .git directory are rejected.
+func repoPath(name string) (string, error) {
+    clean := strings.Trim(strings.TrimSpace(name), "`'\"")
+    clean = strings.ReplaceAll(clean, "\\", "/")
+    if clean == "" || strings.ContainsRune(clean, 0) {
+        return "", fmt.Errorf("path %q is not a valid file name", name)
+    }
+
+    // Absolute paths are only accepted inside the working directory of the job
+    if filepath.IsAbs(clean) || strings.HasPrefix(clean, "/") {
+        cwd, err := os.Getwd()
+        if err != nil {
+            return "", fmt.Errorf("failed to get working directory: %v", err)
+        }
+        rel, err := filepath.Rel(cwd, filepath.FromSlash(clean))
+        if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+            return "", fmt.Errorf("path %s is outside the repository", name)
+        }
+        clean = filepath.ToSlash(rel)
+    }
+
+    clean = path.Clean(clean)
+    if strings.HasPrefix(clean+"/", repoPrefix) {
+        clean = path.Clean(strings.TrimPrefix(clean+"/", repoPrefix))
+    } else if prefix := candidatePrefixRegex.FindString(clean + "/"); prefix != "" {
+        clean = path.Clean(strings.TrimPrefix(clean+"/", prefix))
+    }
+    if clean == ".." || strings.HasPrefix(clean, "../") {
+        return "", fmt.Errorf("path %s is outside the repository", name)
+    }
+    for _, part := range strings.Split(clean, "/") {
+        if part == ".git" {
+            return "", fmt.Errorf("path %s is not accessible", name)
+        }
+    }
+    return clean, nil
+}
+
+// resolveRepoPath returns where a file name, mapped by repoPath, is on disk
+// in the working copy at root. The file need not exist, but the part of
+// its path that does must not lead out of the working copy through a
+// symbolic link.
+func resolveRepoPath(root string, name string) (string, error) {
+    rel, err := repoPath(name)
+    if err != nil {
+        return "", err
+    }
+    full := filepath.Join(root, filepath.FromSlash(rel))
+
+    // Where the longest existing part of the path really is decides
+    existing := full
+    for {
+        if _, err := os.Lstat(existing); err == nil {
+            break
+        }
+        parent := filepath.Dir(existing)
+        if parent == existing {
+            break
+        }
+        existing = parent
+    }
+    real, err := filepath.EvalSymlinks(existing)
+    if err != nil {
+        return "", fmt.Errorf("path %s leads through a broken symbolic link", name)
+    }
+    realRoot, err := filepath.EvalSymlinks(root)
+    if err != nil {
+        return "", err
+    }
+    inside, err := filepath.Rel(realRoot, real)
+    if err != nil || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+        return "", fmt.Errorf("path %s is outside the repository", name)
+    }
+    return full, nil
+}
+
+// pathChecker maps the file names of a reply onto the repository with
+// repoPath and resolveRepoPath, collecting the problems, so that all of
+// them can be sent back to the model in one go.
+type pathChecker struct {
+    dir      string // The working copy
+    problems []string
+}
+
+// clean returns the name a reply used for a file as "repo/" and its path
+// from the repository root, the form the rest of the job uses, or an
+// empty string if it is rejected.
+func (c *pathChecker) clean(name string) string {
+    if _, err := resolveRepoPath(c.dir, name); err != nil {
+        c.problems = append(c.problems, err.Error())
+        return ""
+    }
+    rel, _ := repoPath(name)
+    if rel == "." {
+        c.problems = append(c.problems, fmt.Sprintf("path %s is the repository itself, not a file", name))
+        return ""
+    }
+    return repoPrefix + rel
+}
+
+// files cleans the names of the written files, which must not name the
+// same file twice.
+func (c *pathChecker) files(filesContent map[string]string) map[string]string {
+    cleaned := make(map[string]string)
+    for name, content := range filesContent {
+        file := c.clean(name)
+        if file == "" {
+            continue
+        }
+        if _, seen := cleaned[file]; seen {
+            c.problems = append(c.problems, fmt.Sprintf("%s is sent more than once under different names", file))
+        }
+        cleaned[file] = content
+    }
+    return cleaned
+}
+
+// operations cleans the names of the deleted and renamed files.
+func (c *pathChecker) operations(ops fileOperations) fileOperations {
+    var cleaned fileOperations
+    for _, file := range ops.Deletes {
+        cleaned.Deletes = append(cleaned.Deletes, c.clean(file))
+    }
+    for _, rename := range ops.Renames {
+        cleaned.Renames = append(cleaned.Renames, fileRename{From: c.clean(rename.From), To: c.clean(rename.To)})
+    }
+    return cleaned
+}
+
+// err returns the problems found as an error for the model, or nil.
+func (c *pathChecker) err() error {
+    if len(c.problems) == 0 {
+        return nil
+    }
+    return newResponseError("some file names could not be used, no changes were made:\n- %s\nName files by their path in the repository, as in the prompt.", strings.Join(c.problems, "\n- "))
+}
@@ -0,0 +1,137 @@
+package assistant
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestRepoPath(t *testing.T) {
+    cwd, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name string
+        want string // Empty if the name is rejected
+    }{
+        {"main.go", "main.go"},
+        {"repo/main.go", "main.go"},
+        {"./main.go", "main.go"},
+        {"./repo/cmd/../main.go", "main.go"},
+        {" `repo/main.go` ", "main.go"},
+        {"\"main.go\"", "main.go"},
+        {"repo\\cmd\\tool.go", "cmd/tool.go"},
+        {"repo", "."},
+        {"repo/", "."},
+        {"candidates/candidate-3/cmd/tool.go", "cmd/tool.go"},
+        {"candidates/other/tool.go", "candidates/other/tool.go"},
+        {filepath.Join(cwd, "repo", "main.go"), "main.go"},
+        {filepath.Join(cwd, "candidates", "candidate-1", "main.go"), "main.go"},
+        {"", ""},
+        {"repo/a\x00b", ""},
+        {"..", ""},
+        {"../main.go", ""},
+        {"repo/../../main.go", ""},
+        {"repo/cmd/../../../main.go", ""},
+        {"..\\main.go", ""},
+        {"/etc/passwd", ""},
+        {filepath.Dir(cwd) + "/other/main.go", ""},
+        {".git/config", ""},
+        {"repo/.git/hooks/pre-commit", ""},
+        {"vendor/.git/HEAD", ""},
+    }
+    for _, test := range tests {
+        got, err := repoPath(test.name)
+        if test.want == "" {
+            if err == nil {
+                t.Errorf("repoPath(%q) = %q, want an error", test.name, got)
+            }
+            continue
+        }
+        if err != nil || got != test.want {
+            t.Errorf("repoPath(%q) = %q, %v, want %q", test.name, got, err, test.want)
+        }
+    }
+}
+
+func TestResolveRepoPath(t *testing.T) {
+    root := filepath.Join(t.TempDir(), "repo")
+    outside := t.TempDir()
+    if err := os.MkdirAll(filepath.Join(root, "cmd"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    links := map[string]string{
+        "escape":     outside,
+        "cmd/inside": filepath.Join(root, "cmd"),
+        "dangling":   filepath.Join(outside, "missing"),
+        "passwd":     "/etc/passwd",
+    }
+    for link, target := range links {
+        if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    tests := []struct {
+        name string
+        want string // Relative to root; empty if the name is rejected
+    }{
+        {"repo/cmd/tool.go", "cmd/tool.go"},
+        {"repo/new/dir/file.go", "new/dir/file.go"},
+        {"repo/cmd/inside/tool.go", "cmd/inside/tool.go"},
+        {"repo/escape", ""},
+        {"repo/escape/file.go", ""},
+        {"repo/escape/new/file.go", ""},
+        {"repo/passwd", ""},
+        {"repo/dangling", ""},
+        {"repo/../escape", ""},
+        {"repo/.git/config", ""},
+    }
+    for _, test := range tests {
+        got, err := resolveRepoPath(root, test.name)
+        if test.want == "" {
+            if err == nil {
+                t.Errorf("resolveRepoPath(%q) = %q, want an error", test.name, got)
+            }
+            continue
+        }
+        if want := filepath.Join(root, filepath.FromSlash(test.want)); err != nil || got != want {
+            t.Errorf("resolveRepoPath(%q) = %q, %v, want %q", test.name, got, err, want)
+        }
+    }
+}
+
+func TestPathChecker(t *testing.T) {
+    checker := pathChecker{dir: t.TempDir()}
+    files := checker.files(map[string]string{
+        "repo/main.go": "a",
+        "./main.go":    "b",
+        "lib.go":       "c",
+        "../x.go":      "d",
+    })
+    if _, ok := files["repo/lib.go"]; !ok || len(files) != 2 {
+        t.Errorf("files: got %v", files)
+    }
+    ops := checker.operations(fileOperations{
+        Deletes: []string{"repo"},
+        Renames: []fileRename{{From: "old.go", To: ".git/new.go"}},
+    })
+    if ops.Renames[0].From != "repo/old.go" {
+        t.Errorf("operations: got %+v", ops)
+    }
+
+    err := checker.err()
+    if err == nil {
+        t.Fatal("no error for the rejected names")
+    }
+    for _, problem := range []string{"repo/main.go is sent more than once", "../x.go is outside", "repo is the repository itself", ".git/new.go is not accessible"} {
+        if !strings.Contains(err.Error(), problem) {
+            t.Errorf("error %q does not mention %q", err, problem)
+        }
+    }
+    if (&pathChecker{dir: t.TempDir()}).err() != nil {
+        t.Error("error without problems")
+    }
+}
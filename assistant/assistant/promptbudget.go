@@ -0,0 +1,117 @@
+package assistant
+
+import (
+    "fmt"
+    "path/filepath"
+    "sort"
+    "strings"
+
+    "github.com/thomasdullien/coding-assistant/assistant/tokens"
+)
+
+// Files that are left over after the important ones are only shortened if
+// at least this many tokens remain; below that they are left out entirely.
+const minTruncatedTokens = 500
+
+// The notes that name the shortened and left out files come after the
+// files, when the budget may be used up, so this many tokens of it are kept
+// for them. Files that do not fit into the notes are only counted.
+const promptNotesTokens = 300
+
+// promptReport describes how the dependency files were fitted into the
+// token budget of the model.
+type promptReport struct {
+    Budget    int      // Tokens available for the prompt
+    Used      int      // Tokens used by the prompt
+    Included  []string // Files included in full
+    Truncated []string // Files of which only the beginning was included
+    Omitted   []string // Files left out
+}
+
+// String summarizes the report for logs and the progress page.
+func (r promptReport) String() string {
+    summary := fmt.Sprintf("Prompt uses %d of %d tokens, %d files included", r.Used, r.Budget, len(r.Included))
+    if len(r.Truncated) > 0 {
+        summary += fmt.Sprintf(", shortened: %s", strings.Join(r.Truncated, ", "))
+    }
+    if len(r.Omitted) > 0 {
+        summary += fmt.Sprintf(", left out: %s", strings.Join(r.Omitted, ", "))
+    }
+    return summary
+}
+
+// fileListNote returns a note of intro followed by files, in at most
+// maxTokens tokens. The files that do not fit are counted at the end.
+func fileListNote(intro string, files []string, maxTokens int) string {
+    if len(files) == 0 {
+        return ""
+    }
+    // Keep room for the count of the files left out of the list
+    used := tokens.Count("\n"+intro) + tokens.Count(fmt.Sprintf(" and %d more\n", len(files)))
+    listed := 0
+    for i, file := range files {
+        separator := ", "
+        if i == 0 {
+            separator = ""
+        }
+        cost := tokens.Count(separator + file)
+        if used+cost > maxTokens {
+            break
+        }
+        used += cost
+        listed++
+    }
+
+    note := "\n" + intro + strings.Join(files[:listed], ", ")
+    switch {
+    case listed == 0:
+        note += fmt.Sprintf("%d files", len(files))
+    case listed < len(files):
+        note += fmt.Sprintf(" and %d more", len(files)-listed)
+    }
+    return note + "\n"
+}
+
+// rankDependencies orders the dependency files by how likely the model is
+// to need them: the files the user asked to change first, then files in the
+// same directories, then everything else, and test files last. The order
+// within each group is kept.
+func rankDependencies(deps []string, requested []string) []string {
+    requestedSet := make(map[string]bool)
+    requestedDirs := make(map[string]bool)
+    for _, file := range requested {
+        file = strings.TrimPrefix(file, "repo/")
+        requestedSet[file] = true
+        requestedDirs[filepath.Dir(file)] = true
+    }
+
+    rank := func(dep string) int {
+        file := strings.TrimPrefix(dep, "repo/")
+        switch {
+        case requestedSet[file]:
+            return 0
+        case strings.HasSuffix(file, "_test.go"):
+            return 3
+        case requestedDirs[filepath.Dir(file)]:
+            return 1
+        }
+        return 2
+    }
+
+    ranked := append([]string(nil), deps...)
+    sort.SliceStable(ranked, func(i, j int) bool {
+        return rank(ranked[i]) < rank(ranked[j])
+    })
+    return ranked
+}
+
+// isRequestedFile reports whether dep is one of the files the user asked to
+// change. Those must never be shortened, since the model echoes them back.
+func isRequestedFile(dep string, requested []string) bool {
+    for _, file := range requested {
+        if strings.TrimPrefix(file, "repo/") == strings.TrimPrefix(dep, "repo/") {
+            return true
+        }
+    }
+    return false
+}
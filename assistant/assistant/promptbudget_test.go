@@ -0,0 +1,68 @@
+package assistant
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/thomasdullien/coding-assistant/assistant/redact"
+    "github.com/thomasdullien/coding-assistant/assistant/tokens"
+)
+
+func TestFileListNote(t *testing.T) {
+    files := []string{"repo/a.go", "repo/b.go", "repo/c.go"}
+    tests := []struct {
+        maxTokens int
+        want      string
+    }{
+        {1000, "\nLeft out: repo/a.go, repo/b.go, repo/c.go\n"},
+        {16, "\nLeft out: repo/a.go and 2 more\n"},
+        {8, "\nLeft out: 3 files\n"},
+    }
+    for _, test := range tests {
+        got := fileListNote("Left out: ", files, test.maxTokens)
+        if got != test.want {
+            t.Errorf("fileListNote(%d) = %q, want %q", test.maxTokens, got, test.want)
+        }
+        if used := tokens.Count(got); used > test.maxTokens {
+            t.Errorf("fileListNote(%d) uses %d tokens", test.maxTokens, used)
+        }
+    }
+    if got := fileListNote("Left out: ", nil, 100); got != "" {
+        t.Errorf("fileListNote without files = %q", got)
+    }
+}
+
+func TestBuildPromptStaysWithinBudget(t *testing.T) {
+    dir := t.TempDir()
+    var deps []string
+    for i := 0; i < 200; i++ {
+        dep := filepath.Join(dir, fmt.Sprintf("some/long/directory/name/file_number_%d.go", i))
+        if err := os.MkdirAll(filepath.Dir(dep), 0755); err != nil {
+            t.Fatal(err)
+        }
+        content := strings.Repeat(fmt.Sprintf("var value%d = %d\n", i, i), 60)
+        if err := os.WriteFile(dep, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+        deps = append(deps, dep)
+    }
+
+    for _, budget := range []int{1000, 3000, 10000} {
+        prompt, report, err := buildPrompt("Change the values.", deps, nil, budget, redact.New())
+        if err != nil {
+            t.Fatalf("buildPrompt(%d): %v", budget, err)
+        }
+        if len(report.Omitted) == 0 {
+            t.Fatalf("buildPrompt(%d): nothing was left out", budget)
+        }
+        if used := tokens.Count(prompt); used > budget || report.Used > budget {
+            t.Errorf("buildPrompt(%d): prompt uses %d tokens, report says %d", budget, used, report.Used)
+        }
+        if !strings.Contains(prompt, "were left out to fit the context window") {
+            t.Errorf("buildPrompt(%d): no note about the files left out", budget)
+        }
+    }
+}
@@ -0,0 +1,258 @@
+package assistant
+
+import (
+    "fmt"
+    "os"
+    "regexp"
+    "strings"
+)
+
+var editsStartRegex = regexp.MustCompile(`^\s*/\* START OF EDITS: (.*?) \*/\s*$`)
+var editsEndRegex = regexp.MustCompile(`^\s*/\* END OF EDITS: .*? \*/\s*$`)
+var searchRegex = regexp.MustCompile(`^<{5,9} SEARCH\s*$`)
+var dividerRegex = regexp.MustCompile(`^={5,9}\s*$`)
+var replaceRegex = regexp.MustCompile(`^>{5,9} REPLACE\s*$`)
+
+// fileEdits are the search/replace blocks of one file.
+type fileEdits struct {
+    path   string // As named in the reply, like "repo/main.go"
+    blocks []editBlock
+}
+
+// editBlock replaces the lines of search with the lines of replace. An
+// empty search creates a new file.
+type editBlock struct {
+    number  int // Counted from 1 within the file, for reports
+    search  []string
+    replace []string
+}
+
+// blockMatch is how the lines of a search block are compared with the
+// file, from the strictest to the most lenient.
+type blockMatch struct {
+    name     string
+    equal    func(a, b string) bool
+    reindent bool // The replacement takes the indentation of the file
+}
+
+var blockMatches = []blockMatch{
+    {"exactly", exactLine, false},
+    {"ignoring whitespace", spacedLine, false},
+    {"ignoring indentation", indentedLine, true},
+}
+
+// parseResponseForEdits extracts the search/replace blocks of each file
+// between the START OF EDITS and END OF EDITS markers, and the summary,
+// from the response. A reply may have no blocks if it only deletes or
+// renames files.
+func parseResponseForEdits(response string) ([]fileEdits, string, error) {
+    summary, found := findSummary(response)
+    if !found {
+        return nil, "", fmt.Errorf("no Summary line found")
+    }
+
+    var edits []fileEdits
+    var current *fileEdits
+    var block *editBlock
+    inReplace := false
+    for _, line := range strings.Split(response, "\n") {
+        line = strings.TrimSuffix(line, "\r")
+        switch {
+        case current == nil:
+            if match := editsStartRegex.FindStringSubmatch(line); match != nil {
+                edits = append(edits, fileEdits{path: strings.TrimSpace(match[1])})
+                current = &edits[len(edits)-1]
+            }
+        case block == nil && editsEndRegex.MatchString(line):
+            current = nil
+        case block == nil && searchRegex.MatchString(line):
+            current.blocks = append(current.blocks, editBlock{number: len(current.blocks) + 1})
+            block = &current.blocks[len(current.blocks)-1]
+            inReplace = false
+        case block == nil:
+            // Text between the blocks
+        case !inReplace && dividerRegex.MatchString(line):
+            inReplace = true
+        case inReplace && replaceRegex.MatchString(line):
+            block = nil
+        case inReplace:
+            block.replace = append(block.replace, line)
+        default:
+            block.search = append(block.search, line)
+        }
+    }
+
+    if block != nil {
+        return nil, "", fmt.Errorf("block %d of %s is not closed; end every block with a >>>>>>> REPLACE line", block.number, current.path)
+    }
+    if current != nil {
+        return nil, "", fmt.Errorf("the edits of %s do not end with the END OF EDITS marker", current.path)
+    }
+    return edits, summary, nil
+}
+
+// applyEdits applies the search/replace blocks to the working copy at dir,
+// as ops will leave it, and returns the new content of every file they
+// change, without writing anything. The blocks of a file apply in order, each to the file as the
+// blocks before it left it. If a block matches nothing or more than one
+// place, the error names every such block, so that the model can correct
+// them.
+func applyEdits(dir string, edits []fileEdits, ops fileOperations) (map[string]string, error) {
+    filesContent := make(map[string]string)
+    var rejections []string
+    for _, file := range edits {
+        // A file may come in several sections of the reply
+        original, seen := filesContent[file.path]
+        exists := seen
+        if !seen {
+            content, err := ops.readFile(dir, file.path)
+            switch {
+            case err == nil:
+                original = string(content)
+                exists = true
+            case !os.IsNotExist(err):
+                return nil, fmt.Errorf("failed to read %s: %v", file.path, err)
+            }
+        }
+
+        updated, rejected := applyBlocks(file, original, exists)
+        if len(rejected) > 0 {
+            rejections = append(rejections, rejected...)
+            continue
+        }
+        filesContent[file.path] = updated
+    }
+
+    if len(rejections) > 0 {
+        return nil, newResponseError("the edits could not be applied, no changes were made:\n- %s\nSend all blocks again, corrected.", strings.Join(rejections, "\n- "))
+    }
+    return filesContent, nil
+}
+
+// applyBlocks applies the blocks of file to original, which is empty if
+// the file does not exist yet. The new content is returned, or a
+// description of every block that could not be applied.
+func applyBlocks(file fileEdits, original string, exists bool) (string, []string) {
+    var lines []string
+    if original != "" {
+        lines = strings.Split(strings.TrimSuffix(original, "\n"), "\n")
+    }
+
+    var rejections []string
+    for _, block := range file.blocks {
+        prefix := fmt.Sprintf("block %d of %s", block.number, file.path)
+        if len(block.search) > 0 {
+            prefix += fmt.Sprintf(" (searching for %q)", block.search[0])
+        }
+
+        // An empty search creates the file
+        if len(block.search) == 0 {
+            if exists {
+                rejections = append(rejections, fmt.Sprintf("%s has an empty SEARCH section, but the file already exists; search for the lines to change", prefix))
+                continue
+            }
+            lines = append(lines, block.replace...)
+            exists = true
+            continue
+        }
+        if !exists {
+            rejections = append(rejections, fmt.Sprintf("%s: the file does not exist; leave the SEARCH section empty to create it", prefix))
+            continue
+        }
+
+        settled := false // Applied, or rejected as ambiguous
+        for _, match := range blockMatches {
+            positions := findBlock(lines, block.search, match.equal)
+            if len(positions) == 0 {
+                continue
+            }
+            if len(positions) > 1 {
+                var numbers []string
+                for _, pos := range positions {
+                    numbers = append(numbers, fmt.Sprint(pos+1))
+                }
+                rejections = append(rejections, fmt.Sprintf("%s matches %s at %d places, starting at lines %s; add lines around it to make it unique", prefix, match.name, len(positions), strings.Join(numbers, ", ")))
+                settled = true
+                break
+            }
+            replace := block.replace
+            if match.reindent {
+                replace = reindent(replace, block.search, lines[positions[0]:positions[0]+len(block.search)])
+            }
+            lines = splice(lines, positions[0], len(block.search), replace)
+            settled = true
+            break
+        }
+        if settled {
+            continue
+        }
+        mismatch, found := closestMismatch(lines, block.search, 0)
+        if !found {
+            rejections = append(rejections, fmt.Sprintf("%s matches nothing, none of its lines are in the file", prefix))
+        } else {
+            rejections = append(rejections, fmt.Sprintf("%s matches nothing; %s", prefix, mismatch))
+        }
+    }
+
+    if len(lines) == 0 {
+        return "", rejections
+    }
+    return strings.Join(lines, "\n") + "\n", rejections
+}
+
+// findBlock returns every position where search matches lines.
+func findBlock(lines []string, search []string, equal func(a, b string) bool) []int {
+    var positions []int
+    for pos := 0; pos+len(search) <= len(lines); pos++ {
+        if matchesAt(lines, search, pos, equal) {
+            positions = append(positions, pos)
+        }
+    }
+    return positions
+}
+
+// spacedLine compares lines with the same indentation, but ignoring
+// trailing whitespace and how much whitespace separates their words.
+func spacedLine(a, b string) bool {
+    return leadingWhitespace(a) == leadingWhitespace(b) && looseLine(a, b)
+}
+
+// indentedLine compares lines ignoring all whitespace differences,
+// including their indentation.
+func indentedLine(a, b string) bool {
+    return looseLine(a, b)
+}
+
+// reindent gives the lines of replace the indentation of the file: each
+// indentation of the search block is mapped to the indentation of the line
+// of the file it matched, and replacement lines take the mapping of the
+// longest search indentation they start with.
+func reindent(replace []string, search []string, matched []string) []string {
+    indents := make(map[string]string)
+    for i, line := range search {
+        if strings.TrimSpace(line) != "" {
+            indents[leadingWhitespace(line)] = leadingWhitespace(matched[i])
+        }
+    }
+    result := make([]string, len(replace))
+    for i, line := range replace {
+        result[i] = line
+        if strings.TrimSpace(line) == "" {
+            continue
+        }
+        from := ""
+        for indent := range indents {
+            if strings.HasPrefix(line, indent) && len(indent) >= len(from) {
+                from = indent
+            }
+        }
+        if to, ok := indents[from]; ok {
+            result[i] = to + line[len(from):]
+        }
+    }
+    return result
+}
+
+func leadingWhitespace(line string) string {
+    return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
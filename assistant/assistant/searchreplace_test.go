@@ -0,0 +1,207 @@
+package assistant
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestParseResponseForEdits(t *testing.T) {
+    response := "Summary: fix-loop\n" +
+        "/* START OF EDITS: repo/main.go */\n" +
+        "Fix the loop.\n" +
+        "<<<<<<< SEARCH\n" +
+        "for {\n" +
+        "=======\n" +
+        "for i := 0; i < n; i++ {\n" +
+        ">>>>>>> REPLACE\n" +
+        "/* END OF EDITS: repo/main.go */\n" +
+        "/* START OF EDITS: repo/new.go */\n" +
+        "<<<<<<< SEARCH\n" +
+        "=======\n" +
+        "package main\n" +
+        ">>>>>>> REPLACE\n" +
+        "/* END OF EDITS: repo/new.go */\n"
+    edits, summary, err := parseResponseForEdits(response)
+    if err != nil {
+        t.Fatalf("parseResponseForEdits: %v", err)
+    }
+    if summary != "fix-loop" {
+        t.Errorf("summary: got %q", summary)
+    }
+    if len(edits) != 2 || edits[0].path != "repo/main.go" || edits[1].path != "repo/new.go" {
+        t.Fatalf("got %+v", edits)
+    }
+    block := edits[0].blocks[0]
+    if len(edits[0].blocks) != 1 || strings.Join(block.search, "|") != "for {" || strings.Join(block.replace, "|") != "for i := 0; i < n; i++ {" {
+        t.Errorf("main.go: got %+v", edits[0].blocks)
+    }
+    if len(edits[1].blocks) != 1 || len(edits[1].blocks[0].search) != 0 {
+        t.Errorf("new.go: got %+v", edits[1].blocks)
+    }
+
+    unclosed := []string{
+        "Summary: x\n/* START OF EDITS: repo/a.go */\n<<<<<<< SEARCH\na\n=======\nb\n/* END OF EDITS: repo/a.go */\n",
+        "Summary: x\n/* START OF EDITS: repo/a.go */\n<<<<<<< SEARCH\na\n=======\nb\n>>>>>>> REPLACE\n",
+        "/* START OF EDITS: repo/a.go */\n/* END OF EDITS: repo/a.go */\n",
+    }
+    for _, bad := range unclosed {
+        if _, _, err := parseResponseForEdits(bad); err == nil {
+            t.Errorf("parseResponseForEdits(%q) succeeded", bad)
+        }
+    }
+}
+
+func TestApplyBlocks(t *testing.T) {
+    original := "func f() {\n\tif x {\n\t\treturn  1\n\t}\n\treturn 2\n}\n"
+    tests := []struct {
+        name     string
+        original string
+        exists   bool
+        blocks   []editBlock
+        want     string
+        rejected string // Part of the only rejection, if any
+    }{
+        {
+            name:     "exact",
+            original: original,
+            exists:   true,
+            blocks:   []editBlock{{number: 1, search: []string{"\treturn 2"}, replace: []string{"\treturn 3"}}},
+            want:     "func f() {\n\tif x {\n\t\treturn  1\n\t}\n\treturn 3\n}\n",
+        },
+        {
+            name:     "ignoring whitespace",
+            original: original,
+            exists:   true,
+            blocks:   []editBlock{{number: 1, search: []string{"\t\treturn 1 "}, replace: []string{"\t\treturn 0"}}},
+            want:     "func f() {\n\tif x {\n\t\treturn 0\n\t}\n\treturn 2\n}\n",
+        },
+        {
+            name:     "ignoring indentation reindents the replacement",
+            original: original,
+            exists:   true,
+            blocks: []editBlock{{
+                number:  1,
+                search:  []string{"if x {", "    return 1", "}"},
+                replace: []string{"if x && y {", "    log(x)", "    return 1", "}"},
+            }},
+            want: "func f() {\n\tif x && y {\n\t\tlog(x)\n\t\treturn 1\n\t}\n\treturn 2\n}\n",
+        },
+        {
+            name:     "blocks apply in order",
+            original: original,
+            exists:   true,
+            blocks: []editBlock{
+                {number: 1, search: []string{"\treturn 2"}, replace: []string{"\treturn 3"}},
+                {number: 2, search: []string{"\treturn 3"}, replace: []string{"\treturn 4"}},
+            },
+            want: "func f() {\n\tif x {\n\t\treturn  1\n\t}\n\treturn 4\n}\n",
+        },
+        {
+            name:     "the strictest match wins",
+            original: "a\n  a\n",
+            exists:   true,
+            blocks:   []editBlock{{number: 1, search: []string{"a"}, replace: []string{"b"}}},
+            want:     "b\n  a\n",
+        },
+        {
+            name:     "ambiguous",
+            original: "x\ny\nx\n",
+            exists:   true,
+            blocks:   []editBlock{{number: 1, search: []string{"x"}, replace: []string{"z"}}},
+            rejected: "matches exactly at 2 places, starting at lines 1, 3",
+        },
+        {
+            name:     "ambiguous ignoring indentation",
+            original: "  x\n\tx\n",
+            exists:   true,
+            blocks:   []editBlock{{number: 1, search: []string{"x"}, replace: []string{"z"}}},
+            rejected: "matches ignoring indentation at 2 places",
+        },
+        {
+            name:     "no match",
+            original: original,
+            exists:   true,
+            blocks:   []editBlock{{number: 1, search: []string{"\treturn 2", "}", "extra"}, replace: []string{"\treturn 3"}}},
+            rejected: "matches nothing;",
+        },
+        {
+            name:     "none of the lines",
+            original: original,
+            exists:   true,
+            blocks:   []editBlock{{number: 1, search: []string{"missing"}, replace: nil}},
+            rejected: "none of its lines are in the file",
+        },
+        {
+            name:   "empty search creates the file",
+            blocks: []editBlock{{number: 1, replace: []string{"package p", "", "var x = 1"}}},
+            want:   "package p\n\nvar x = 1\n",
+        },
+        {
+            name:     "empty search on an existing file",
+            original: original,
+            exists:   true,
+            blocks:   []editBlock{{number: 1, replace: []string{"package p"}}},
+            rejected: "the file already exists",
+        },
+        {
+            name:     "search in a missing file",
+            blocks:   []editBlock{{number: 1, search: []string{"a"}, replace: []string{"b"}}},
+            rejected: "the file does not exist",
+        },
+    }
+    for _, test := range tests {
+        file := fileEdits{path: "repo/f.go", blocks: test.blocks}
+        got, rejected := applyBlocks(file, test.original, test.exists)
+        if test.rejected != "" {
+            if len(rejected) != 1 || !strings.Contains(rejected[0], test.rejected) {
+                t.Errorf("%s: got rejections %q, want one containing %q", test.name, rejected, test.rejected)
+            }
+            continue
+        }
+        if len(rejected) > 0 {
+            t.Errorf("%s: rejected: %q", test.name, rejected)
+            continue
+        }
+        if got != test.want {
+            t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+        }
+    }
+}
+
+func TestReindent(t *testing.T) {
+    tests := []struct {
+        name    string
+        replace []string
+        search  []string
+        matched []string
+        want    []string
+    }{
+        {
+            name:    "spaces to tabs",
+            replace: []string{"if y {", "    z()", "}"},
+            search:  []string{"if x {", "    z()", "}"},
+            matched: []string{"\tif x {", "\t\tz()", "\t}"},
+            want:    []string{"\tif y {", "\t\tz()", "\t}"},
+        },
+        {
+            name:    "deeper lines keep their extra indentation",
+            replace: []string{"  a", "      b"},
+            search:  []string{"  a"},
+            matched: []string{"\ta"},
+            want:    []string{"\ta", "\t    b"},
+        },
+        {
+            name:    "blank lines stay as they are",
+            replace: []string{"a", "", "b"},
+            search:  []string{"a"},
+            matched: []string{"    a"},
+            want:    []string{"    a", "", "    b"},
+        },
+    }
+    for _, test := range tests {
+        got := reindent(test.replace, test.search, test.matched)
+        if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+            t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+        }
+    }
+}
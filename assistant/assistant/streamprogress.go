@@ -0,0 +1,95 @@
+package assistant
+
+import (
+    "regexp"
+    "strings"
+
+    "github.com/thomasdullien/coding-assistant/assistant/types"
+)
+
+// In structured replies, each file starts with its "path" property.
+var jsonPathRegex = regexp.MustCompile(`"path"\s*:\s*"((?:[^"\\]|\\.)*)"`)
+
+// How much of a structured reply without a complete "path" property is
+// kept for the next delta, enough for the start of one.
+const jsonPathTail = 256
+
+// Lines longer than this are file content, not delimiters, and are not kept.
+const maxDelimiterLine = 4096
+
+// In diffs, each file starts with its "+++" line.
+var diffFileRegex = regexp.MustCompile(`^\+\+\+ (?:b/)?(\S+)`)
+
+// fileTracker watches a streamed reply for the file delimiters, so that the
+// web interface can show which file the model is currently writing.
+type fileTracker struct {
+    progress   types.ProgressFunc
+    format     string // The reply format, see replyFormat
+    partial    string // Text after the last complete line
+    long       bool   // The text of the current line was dropped for its length
+    current    string
+}
+
+// write consumes the next piece of the streamed reply.
+func (t *fileTracker) write(delta string) {
+    // The text before the delta has no newline, so only the delta is searched
+    newline := strings.IndexByte(delta, '\n')
+    if newline >= 0 {
+        newline += len(t.partial)
+    }
+    t.partial += delta
+    if t.format == "json" {
+        t.writeStructured()
+        return
+    }
+    for ; newline >= 0; newline = strings.IndexByte(t.partial, '\n') {
+        line := t.partial[:newline]
+        t.partial = t.partial[newline+1:]
+        if t.long {
+            t.long = false
+            continue
+        }
+
+        startRegex, endRegex := fileStartRegex, fileEndRegex
+        switch t.format {
+        case "diff":
+            startRegex, endRegex = diffFileRegex, diffEndRegex
+        case "blocks":
+            startRegex, endRegex = editsStartRegex, editsEndRegex
+        }
+        if match := startRegex.FindStringSubmatch(line); match != nil {
+            t.current = match[1]
+            t.progress(types.ProgressUpdate{Kind: "file", Text: t.current})
+        } else if t.current != "" && endRegex.MatchString(line) {
+            t.current = ""
+            t.progress(types.ProgressUpdate{Kind: "file", Text: ""})
+        }
+    }
+    // Drop the text of a line too long to be a delimiter
+    if len(t.partial) > maxDelimiterLine {
+        t.partial = ""
+        t.long = true
+    }
+}
+
+// writeStructured reports every "path" property once it is complete. JSON
+// replies often come without newlines, so partial keeps the text after the
+// last match instead of the last line, and of that only the last "path" key
+// or, without one, at most jsonPathTail bytes, so that long file contents
+// are not searched again for every delta.
+func (t *fileTracker) writeStructured() {
+    for {
+        match := jsonPathRegex.FindStringSubmatchIndex(t.partial)
+        if match == nil {
+            keep := strings.LastIndex(t.partial, `"path"`)
+            if keep < 0 || len(t.partial)-keep > jsonPathTail {
+                keep = max(0, len(t.partial)-jsonPathTail)
+            }
+            t.partial = t.partial[keep:]
+            return
+        }
+        t.current = t.partial[match[2]:match[3]]
+        t.partial = t.partial[match[1]:]
+        t.progress(types.ProgressUpdate{Kind: "file", Text: t.current})
+    }
+}
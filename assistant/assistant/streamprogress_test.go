@@ -0,0 +1,47 @@
+package assistant
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/thomasdullien/coding-assistant/assistant/types"
+)
+
+// trackFiles streams reply to a fileTracker in pieces of size bytes and
+// returns the files it reports, and the most text it kept at once.
+func trackFiles(format string, reply string, size int) ([]string, int) {
+    var files []string
+    tracker := fileTracker{format: format, progress: func(update types.ProgressUpdate) {
+        files = append(files, update.Text)
+    }}
+    kept := 0
+    for i := 0; i < len(reply); i += size {
+        tracker.write(reply[i:min(i+size, len(reply))])
+        kept = max(kept, len(tracker.partial))
+    }
+    return files, kept
+}
+
+func TestFileTracker(t *testing.T) {
+    content := strings.Repeat("x", 100000)
+    markers := "/* START OF FILE: repo/a.go */\n" + content + "\n/* END OF FILE: repo/a.go */\n/* START OF FILE: repo/b.go */\nb\n/* END OF FILE: repo/b.go */\n"
+    structured := `{"files": [{"path": "repo/a.go", "content": "` + content + `"}, {"path" : "repo/b.go", "content": "b"}]}`
+    for _, size := range []int{1, 7, 4096} {
+        files, kept := trackFiles("markers", markers, size)
+        if want := []string{"repo/a.go", "", "repo/b.go", ""}; strings.Join(files, "|") != strings.Join(want, "|") {
+            t.Errorf("markers in pieces of %d: got %q, want %q", size, files, want)
+        }
+        if kept > maxDelimiterLine+size {
+            t.Errorf("markers in pieces of %d: kept %d bytes", size, kept)
+        }
+
+        files, kept = trackFiles("json", structured, size)
+        if want := []string{"repo/a.go", "repo/b.go"}; strings.Join(files, "|") != strings.Join(want, "|") {
+            t.Errorf("json in pieces of %d: got %q, want %q", size, files, want)
+        }
+        // The content between the paths is not kept
+        if kept > jsonPathTail+size {
+            t.Errorf("json in pieces of %d: kept %d bytes", size, kept)
+        }
+    }
+}
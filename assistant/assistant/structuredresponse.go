@@ -0,0 +1,100 @@
+package assistant
+
+import (
+    "encoding/json"
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// fileEdit is the new content of one file in a structured response.
+type fileEdit struct {
+    Path    string `json:"path"`
+    Content string `json:"content"`
+}
+
+// structuredResponse is the reply of the structured edit protocol, see
+// chatgpt.CreateStructuredRequest.
+type structuredResponse struct {
+    Summary       string       `json:"summary"`
+    CommitMessage string       `json:"commit_message"`
+    CommitBody    string       `json:"commit_body"`
+    PRTitle       string       `json:"pr_title"`
+    PRDescription string       `json:"pr_description"`
+    Files         []fileEdit   `json:"files"`
+    Deletes       []string     `json:"deletes"`
+    Renames       []fileRename `json:"renames"`
+}
+
+// operations returns the files the response deletes and renames.
+func (r structuredResponse) operations() fileOperations {
+    return fileOperations{Deletes: r.Deletes, Renames: r.Renames}
+}
+
+// changeDescription returns the commit and pull request text of the response.
+func (r structuredResponse) changeDescription() changeDescription {
+    return changeDescription{
+        CommitSubject: r.CommitMessage,
+        CommitBody:    r.CommitBody,
+        PRTitle:       r.PRTitle,
+        PRDescription: r.PRDescription,
+    }
+}
+
+var summaryWordsRegex = regexp.MustCompile(`^[a-zA-Z0-9]+(-[a-zA-Z0-9]+){0,2}$`)
+
+// parseStructuredResponse decodes and validates a structured response. All
+// problems are reported together, so that they can be sent back to the
+// model in one go.
+func parseStructuredResponse(response string) (structuredResponse, error) {
+    var parsed structuredResponse
+    decoder := json.NewDecoder(strings.NewReader(response))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&parsed); err != nil {
+        return parsed, fmt.Errorf("reply is not valid JSON for the file edits schema: %v", err)
+    }
+
+    var problems []string
+    parsed.Summary = strings.TrimSpace(parsed.Summary)
+    if !summaryWordsRegex.MatchString(parsed.Summary) {
+        problems = append(problems, fmt.Sprintf("summary %q is not one to three words separated by dashes", parsed.Summary))
+    }
+    description := parsed.changeDescription()
+    if err := description.validate(); err != nil {
+        problems = append(problems, err.Error())
+    }
+    if len(parsed.Files) == 0 && len(parsed.Deletes) == 0 && len(parsed.Renames) == 0 {
+        problems = append(problems, "files, deletes and renames are all empty")
+    }
+    seen := make(map[string]bool)
+    for i, file := range parsed.Files {
+        path := strings.TrimSpace(file.Path)
+        switch {
+        case path == "":
+            problems = append(problems, fmt.Sprintf("files[%d] has an empty path", i))
+        case seen[path]:
+            problems = append(problems, fmt.Sprintf("file %s is returned more than once", path))
+        case strings.TrimSpace(file.Content) == "":
+            problems = append(problems, fmt.Sprintf("file %s has empty content", path))
+        }
+        seen[path] = true
+        parsed.Files[i].Path = path
+    }
+    for i, path := range parsed.Deletes {
+        parsed.Deletes[i] = strings.TrimSpace(path)
+        if parsed.Deletes[i] == "" {
+            problems = append(problems, fmt.Sprintf("deletes[%d] is empty", i))
+        }
+    }
+    for i, rename := range parsed.Renames {
+        parsed.Renames[i] = fileRename{From: strings.TrimSpace(rename.From), To: strings.TrimSpace(rename.To)}
+        if parsed.Renames[i].From == "" || parsed.Renames[i].To == "" {
+            problems = append(problems, fmt.Sprintf("renames[%d] has an empty path", i))
+        }
+    }
+
+    if len(problems) > 0 {
+        return parsed, fmt.Errorf("invalid structured response: %s", strings.Join(problems, "; "))
+    }
+    return parsed, nil
+}
@@ -0,0 +1,270 @@
+package assistant
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+    "github.com/thomasdullien/coding-assistant/assistant/redact"
+    "github.com/thomasdullien/coding-assistant/assistant/tokens"
+)
+
+// The model may make this many rounds of tool calls per attempt before it
+// has to reply with its changes.
+const maxToolTurns = 20
+
+// Tool results are cut to this many tokens, so that a single large file
+// or search cannot fill up the context window.
+const maxToolResultTokens = 4000
+
+// grep and find_symbol stop after this many matching lines.
+const maxToolMatches = 200
+
+// repoTools are the tools offered to the model. All of them work on the
+// cloned repository only, see toolRunner.
+var repoTools = []chatgpt.Tool{
+    newTool("read_file", "Read a file of the repository.",
+        `{"type": "object", "properties": {"path": {"type": "string", "description": "Path relative to the repository root"}}, "required": ["path"]}`),
+    newTool("list_dir", "List the files and directories in a directory of the repository. Directories end with a slash.",
+        `{"type": "object", "properties": {"path": {"type": "string", "description": "Path relative to the repository root, \".\" for the root"}}, "required": ["path"]}`),
+    newTool("grep", "Search the files of the repository for lines matching a regular expression (RE2 syntax). Returns path:line: text for every match.",
+        `{"type": "object", "properties": {"pattern": {"type": "string"}, "path": {"type": "string", "description": "Directory or file to search, the whole repository if empty"}}, "required": ["pattern"]}`),
+    newTool("find_symbol", "Find where a function, method, type, class, macro or variable is defined.",
+        `{"type": "object", "properties": {"name": {"type": "string", "description": "Identifier, without namespace or receiver"}}, "required": ["name"]}`),
+    newTool("run_tests", "Run the tests of the repository in its current state and return whether they pass and their output.",
+        `{"type": "object", "properties": {}}`),
+}
+
+func newTool(name string, description string, parameters string) chatgpt.Tool {
+    return chatgpt.Tool{
+        Type: "function",
+        Function: chatgpt.FunctionDefinition{
+            Name:        name,
+            Description: description,
+            Parameters:  json.RawMessage(parameters),
+        },
+    }
+}
+
+// toolArguments holds the arguments of all tools; each uses some of them.
+type toolArguments struct {
+    Path    string `json:"path"`
+    Pattern string `json:"pattern"`
+    Name    string `json:"name"`
+}
+
+// toolRunner executes tool calls in the repository at root. Paths given by
+// the model are confined to root, also through symbolic links.
+type toolRunner struct {
+    ctx      context.Context
+    root     string
+    repoType string
+}
+
+// run executes a tool call and returns the result for the model. Errors are
+// returned as the result too, so the model can correct its call.
+func (r *toolRunner) run(call chatgpt.ToolCall) string {
+    var args toolArguments
+    if call.Function.Arguments != "" {
+        if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+            return fmt.Sprintf("Error: arguments are not valid JSON: %v", err)
+        }
+    }
+
+    var result string
+    var err error
+    switch call.Function.Name {
+    case "read_file":
+        result, err = r.readFile(args.Path)
+    case "list_dir":
+        result, err = r.listDir(args.Path)
+    case "grep":
+        result, err = r.grep(args.Pattern, args.Path)
+    case "find_symbol":
+        result, err = r.findSymbol(args.Name)
+    case "run_tests":
+        ok, output := runTestsOrBuild(r.ctx, r.root, r.repoType, false)
+        result = "Tests failed:\n" + output
+        if ok {
+            result = "Tests passed:\n" + output
+        }
+    default:
+        err = fmt.Errorf("unknown tool %q", call.Function.Name)
+    }
+    if err != nil {
+        return "Error: " + err.Error()
+    }
+
+    // Mask the secrets in what the model gets to see
+    redactor := redact.FromContext(r.ctx)
+    if call.Function.Name == "read_file" {
+        result = redactor.RedactFile(filepath.Join("repo", args.Path), result)
+    } else {
+        result = redactor.Redact(result)
+    }
+
+    trimmed, cut := tokens.Truncate(result, maxToolResultTokens)
+    if cut > 0 {
+        trimmed += fmt.Sprintf("\n[... %d more lines omitted ...]\n", cut)
+    }
+    return trimmed
+}
+
+// resolve returns the path on disk of a path in the repository, named
+// like the files in the prompt or relative to the repository root, see
+// resolveRepoPath. Paths leading out of the repository, directly or
+// through a symbolic link, are rejected, as is the .git directory.
+func (r *toolRunner) resolve(path string) (string, error) {
+    if path == "" {
+        path = "."
+    }
+    full, err := resolveRepoPath(r.root, path)
+    if err != nil {
+        return "", err
+    }
+    if _, err := os.Stat(full); err != nil {
+        return "", fmt.Errorf("%s does not exist", path)
+    }
+    return full, nil
+}
+
+func (r *toolRunner) readFile(path string) (string, error) {
+    full, err := r.resolve(path)
+    if err != nil {
+        return "", err
+    }
+    content, err := ioutil.ReadFile(full)
+    if err != nil {
+        return "", fmt.Errorf("failed to read %s: %v", path, err)
+    }
+    return string(content), nil
+}
+
+func (r *toolRunner) listDir(path string) (string, error) {
+    full, err := r.resolve(path)
+    if err != nil {
+        return "", err
+    }
+    entries, err := ioutil.ReadDir(full)
+    if err != nil {
+        return "", fmt.Errorf("failed to list %s: %v", path, err)
+    }
+    var listing strings.Builder
+    for _, entry := range entries {
+        if entry.Name() == ".git" {
+            continue
+        }
+        listing.WriteString(entry.Name())
+        if entry.IsDir() {
+            listing.WriteString("/")
+        }
+        listing.WriteString("\n")
+    }
+    if listing.Len() == 0 {
+        return path + " is empty", nil
+    }
+    return listing.String(), nil
+}
+
+func (r *toolRunner) grep(pattern string, path string) (string, error) {
+    re, err := regexp.Compile(pattern)
+    if err != nil {
+        return "", fmt.Errorf("invalid pattern: %v", err)
+    }
+    return r.search(path, func(line string) bool { return re.MatchString(line) })
+}
+
+// findSymbol looks for lines that look like the definition of name in Go
+// or C++ code. This is a heuristic, but cheaper than asking the model to
+// grep and filter the uses out itself.
+func (r *toolRunner) findSymbol(name string) (string, error) {
+    if !regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`).MatchString(name) {
+        return "", fmt.Errorf("%q is not an identifier", name)
+    }
+    quoted := regexp.QuoteMeta(name)
+    patterns := []*regexp.Regexp{
+        // Go functions, methods, types, variables and constants
+        regexp.MustCompile(`^\s*func\s+(\([^)]*\)\s*)?` + quoted + `\s*[\[(]`),
+        regexp.MustCompile(`^\s*(type|var|const)\s+` + quoted + `\b`),
+        // C++ types, namespaces and macros
+        regexp.MustCompile(`\b(class|struct|union|enum|enum\s+class|namespace|typedef|using)\s+` + quoted + `\b`),
+        regexp.MustCompile(`^\s*#\s*define\s+` + quoted + `\b`),
+        // C++ functions: a return type, or a class for constructors
+        regexp.MustCompile(`^\s*[\w:<>,*&~]+[\s*&]+(\w+::)*~?` + quoted + `\s*\(`),
+        regexp.MustCompile(`^\s*(\w+::)+~?` + quoted + `\s*\(`),
+    }
+    // Statements that look like a return type followed by a call
+    statement := regexp.MustCompile(`^\s*(return|else|throw|new|delete|case|co_return|co_yield)\b`)
+    return r.search("", func(line string) bool {
+        if statement.MatchString(line) {
+            return false
+        }
+        for _, pattern := range patterns {
+            if pattern.MatchString(line) {
+                return true
+            }
+        }
+        return false
+    })
+}
+
+// search returns path:line: text for the lines of the text files under path
+// that match.
+func (r *toolRunner) search(path string, match func(line string) bool) (string, error) {
+    full, err := r.resolve(path)
+    if err != nil {
+        return "", err
+    }
+
+    var files []string
+    err = filepath.Walk(full, func(file string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if info.IsDir() && info.Name() == ".git" {
+            return filepath.SkipDir
+        }
+        if info.Mode().IsRegular() {
+            files = append(files, file)
+        }
+        return nil
+    })
+    if err != nil {
+        return "", fmt.Errorf("failed to walk %s: %v", path, err)
+    }
+    sort.Strings(files)
+
+    var matches []string
+    for _, file := range files {
+        content, err := ioutil.ReadFile(file)
+        if err != nil || bytes.IndexByte(content, 0) >= 0 {
+            // Skip unreadable and binary files
+            continue
+        }
+        rel, _ := filepath.Rel(r.root, file)
+        scanner := bufio.NewScanner(bytes.NewReader(content))
+        scanner.Buffer(nil, len(content)+1)
+        for number := 1; scanner.Scan(); number++ {
+            if match(scanner.Text()) {
+                matches = append(matches, fmt.Sprintf("%s:%d: %s", filepath.ToSlash(rel), number, strings.TrimSpace(scanner.Text())))
+                if len(matches) == maxToolMatches {
+                    matches = append(matches, fmt.Sprintf("[stopped after %d matches]", maxToolMatches))
+                    return strings.Join(matches, "\n"), nil
+                }
+            }
+        }
+    }
+    if len(matches) == 0 {
+        return "No matches", nil
+    }
+    return strings.Join(matches, "\n"), nil
+}
@@ -0,0 +1,511 @@
+package assistant
+
+import (
+    "fmt"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Context lines at the edges of a hunk that may be ignored when the hunk
+// does not match otherwise, like the fuzz factor of patch.
+const maxHunkFuzz = 2
+
+var diffStartRegex = regexp.MustCompile(`(?m)^\s*/\* START OF DIFF \*/\s*$`)
+var diffEndRegex = regexp.MustCompile(`(?m)^\s*/\* END OF DIFF \*/\s*$`)
+var hunkHeaderRegex = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// filePatch is the part of a unified diff that changes, creates, deletes
+// or renames one file.
+type filePatch struct {
+    path      string // As named in the reply, like "repo/main.go"
+    oldPath   string // Differs from path if the file is renamed
+    isNew     bool   // The old file is /dev/null
+    isDeleted bool   // The new file is /dev/null
+    hunks     []hunk
+
+    // Set by "\ No newline at end of file" after a removed line, or after
+    // an added or unchanged one
+    oldNoNewline bool
+    newNoNewline bool
+}
+
+// hunk is one "@@" section of a diff.
+type hunk struct {
+    header   string   // The "@@ -a,b +c,d @@" line, for reports
+    oldStart int      // Line of the old file the hunk starts at, counted from 1; 0 if the header has none
+    lines    []string // With their ' ', '-' or '+' prefix
+}
+
+// parseResponseForDiff extracts the unified diff between the START OF DIFF
+// and END OF DIFF markers and the summary from the response.
+func parseResponseForDiff(response string) (string, string, bool) {
+    summary, found := findSummary(response)
+    if !found {
+        return "", "", false
+    }
+    start := diffStartRegex.FindStringIndex(response)
+    if start == nil {
+        return "", "", false
+    }
+    end := diffEndRegex.FindStringIndex(response[start[1]:])
+    if end == nil {
+        return "", "", false
+    }
+    return response[start[1] : start[1]+end[0]], summary, true
+}
+
+// parseUnifiedDiff splits a unified diff into the patches of its files. A
+// file is renamed with git's "rename from" and "rename to" lines or with
+// different names on its --- and +++ lines, and deleted with a +++ line of
+// /dev/null. It accepts what models commonly get wrong: hunk headers
+// without line numbers, and empty lines for unchanged empty lines.
+func parseUnifiedDiff(diff string) ([]filePatch, error) {
+    var patches []filePatch
+    var current *filePatch
+    var currentHunk *hunk
+    emptyLines := 0 // Empty lines not yet known to belong to the hunk
+    renameFrom := "" // The old name of a file renamed by git's rename lines
+    // The lines of each side the "@@" header of the hunk says are still to
+    // come, or -1 if it has no line counts
+    oldLeft, newLeft := -1, -1
+
+    lines := strings.Split(diff, "\n")
+    for i := 0; i < len(lines); i++ {
+        line := strings.TrimSuffix(lines[i], "\r")
+        switch {
+        case strings.HasPrefix(line, "rename from "):
+            renameFrom = strings.TrimSpace(line[len("rename from "):])
+            currentHunk = nil
+        case strings.HasPrefix(line, "rename to ") && renameFrom != "":
+            patches = append(patches, filePatch{path: strings.TrimSpace(line[len("rename to "):]), oldPath: renameFrom})
+            current = &patches[len(patches)-1]
+            currentHunk = nil
+            renameFrom = ""
+        case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ") && fileHeaderAt(lines, i, oldLeft-emptyLines, newLeft-emptyLines):
+            oldPath := diffPath(line[4:])
+            newPath := diffPath(strings.TrimSuffix(lines[i+1], "\r")[4:])
+            i++
+            currentHunk = nil
+            emptyLines = 0
+            oldLeft, newLeft = -1, -1
+            // The --- and +++ lines after git's rename lines name the same files
+            if current != nil && len(current.hunks) == 0 && current.oldPath == oldPath && current.path == newPath {
+                continue
+            }
+            patch := filePatch{path: newPath, oldPath: oldPath, isNew: oldPath == "/dev/null"}
+            if newPath == "/dev/null" {
+                patch.path, patch.isDeleted = oldPath, true
+            }
+            if patch.isNew {
+                patch.oldPath = newPath
+            }
+            patches = append(patches, patch)
+            current = &patches[len(patches)-1]
+        case strings.HasPrefix(line, "@@"):
+            if current == nil {
+                return nil, fmt.Errorf("hunk %q comes before the --- and +++ lines naming its file", line)
+            }
+            h := hunk{header: line}
+            oldLeft, newLeft = -1, -1
+            if match := hunkHeaderRegex.FindStringSubmatch(line); match != nil {
+                h.oldStart, _ = strconv.Atoi(match[1])
+                oldLeft, newLeft = hunkCount(match[2]), hunkCount(match[4])
+            }
+            current.hunks = append(current.hunks, h)
+            currentHunk = &current.hunks[len(current.hunks)-1]
+            emptyLines = 0
+        case currentHunk == nil:
+            // Text between the files, like "diff --git" or "index" lines
+        case line == "":
+            emptyLines++
+        case line[0] == ' ' || line[0] == '-' || line[0] == '+':
+            for ; emptyLines > 0; emptyLines-- {
+                currentHunk.lines = append(currentHunk.lines, " ")
+                oldLeft, newLeft = oldLeft-1, newLeft-1
+            }
+            currentHunk.lines = append(currentHunk.lines, line)
+            if line[0] != '+' {
+                oldLeft--
+            }
+            if line[0] != '-' {
+                newLeft--
+            }
+        case strings.HasPrefix(line, `\`) && len(currentHunk.lines) > 0:
+            // "\ No newline at end of file" for the line before
+            switch currentHunk.lines[len(currentHunk.lines)-1][0] {
+            case '-':
+                current.oldNoNewline = true
+            case '+':
+                current.newNoNewline = true
+            default:
+                current.oldNoNewline, current.newNoNewline = true, true
+            }
+        default:
+            // Anything else ends the hunk
+            currentHunk = nil
+            emptyLines = 0
+            oldLeft, newLeft = -1, -1
+        }
+    }
+
+    if len(patches) == 0 {
+        return nil, fmt.Errorf("the diff changes no files; start the changes of each file with --- and +++ lines")
+    }
+    for _, patch := range patches {
+        if len(patch.hunks) == 0 && !patch.isDeleted && patch.oldPath == patch.path {
+            return nil, fmt.Errorf("the diff of %s has no hunks", patch.path)
+        }
+    }
+    return patches, nil
+}
+
+// hunkCount returns the line count of one side of a hunk header, which is
+// 1 if the header leaves it out.
+func hunkCount(count string) int {
+    if count == "" {
+        return 1
+    }
+    n, _ := strconv.Atoi(count)
+    return n
+}
+
+// fileHeaderAt reports whether the "---" and "+++" lines at lines[i] start
+// the changes of a file, rather than being a removed line starting with
+// "-- " and an added one starting with "++ " in a hunk. Within a hunk with
+// line counts they are one only once the counts are used up, or if a hunk
+// header follows them, in case the counts are wrong.
+func fileHeaderAt(lines []string, i int, oldLeft int, newLeft int) bool {
+    if oldLeft <= 0 && newLeft <= 0 {
+        return true
+    }
+    return i+2 < len(lines) && strings.HasPrefix(lines[i+2], "@@")
+}
+
+// diffPath returns the path of a --- or +++ line, without the "a/" or "b/"
+// prefix of git and without a timestamp.
+func diffPath(name string) string {
+    if tab := strings.IndexByte(name, '\t'); tab >= 0 {
+        name = name[:tab]
+    }
+    name = strings.TrimSpace(name)
+    if strings.HasPrefix(name, "a/") || strings.HasPrefix(name, "b/") {
+        name = name[2:]
+    }
+    return name
+}
+
+// applyDiff applies a unified diff to the working copy at dir and returns
+// the new content of every file it changes or creates, and the files it
+// deletes and renames, without changing anything. If a hunk cannot be
+// placed, the error reports every rejected hunk, so that the model can
+// correct them.
+func applyDiff(dir string, diff string) (map[string]string, fileOperations, error) {
+    var ops fileOperations
+    patches, err := parseUnifiedDiff(diff)
+    if err != nil {
+        return nil, ops, newResponseError("the diff could not be parsed: %v", err)
+    }
+
+    // Map the file names onto the repository before reading anything
+    checker := &pathChecker{dir: dir}
+    for i := range patches {
+        patches[i].path = checker.clean(patches[i].path)
+        patches[i].oldPath = checker.clean(patches[i].oldPath)
+    }
+    if err := checker.err(); err != nil {
+        return nil, ops, err
+    }
+    for _, patch := range patches {
+        switch {
+        case patch.isDeleted:
+            ops.Deletes = append(ops.Deletes, patch.path)
+        case !patch.isNew && repoRelative(patch.oldPath) != repoRelative(patch.path):
+            ops.Renames = append(ops.Renames, fileRename{From: patch.oldPath, To: patch.path})
+        }
+    }
+
+    filesContent := make(map[string]string)
+    var rejections []string
+    for _, patch := range patches {
+        // The hunks of a deleted file need not apply
+        if patch.isDeleted {
+            continue
+        }
+        if _, seen := filesContent[patch.path]; seen {
+            rejections = append(rejections, fmt.Sprintf("%s is changed twice; put all hunks of a file under one --- and +++ header", patch.path))
+            continue
+        }
+        original := ""
+        content, err := ops.readFile(dir, patch.path)
+        switch {
+        case err == nil && patch.isNew:
+            rejections = append(rejections, fmt.Sprintf("%s is created with --- /dev/null, but it already exists", patch.path))
+            continue
+        case err == nil:
+            original = string(content)
+        case os.IsNotExist(err) && !patch.isNew:
+            rejections = append(rejections, fmt.Sprintf("%s does not exist; use --- /dev/null to create a file", ops.source(patch.path)))
+            continue
+        case !os.IsNotExist(err):
+            return nil, ops, fmt.Errorf("failed to read %s: %v", patch.path, err)
+        }
+
+        updated, rejected := applyPatch(patch, original)
+        if len(rejected) > 0 {
+            rejections = append(rejections, rejected...)
+            continue
+        }
+        filesContent[patch.path] = updated
+    }
+
+    if len(rejections) > 0 {
+        return nil, ops, newResponseError("the diff could not be applied, no changes were made:\n- %s\nSend the complete corrected diff again.", strings.Join(rejections, "\n- "))
+    }
+    return filesContent, ops, nil
+}
+
+// applyPatch applies the hunks of patch to original, in order. Each hunk is
+// looked for where its header says, corrected by how far the hunks before
+// it moved, and then ever further away in the file. Lines are compared
+// exactly, then with whitespace collapsed, and then without up to
+// maxHunkFuzz context lines at either edge. The new content is returned,
+// or a description of every hunk that could not be placed.
+func applyPatch(patch filePatch, original string) (string, []string) {
+    var lines []string
+    if original != "" {
+        lines = strings.Split(strings.TrimSuffix(original, "\n"), "\n")
+    }
+
+    var rejections []string
+    shift := 0   // How far the hunks applied so far moved the lines after them
+    minPos := 0  // Hunks apply in order and must not overlap
+    for i, h := range patch.hunks {
+        oldLines, newLines := h.sides()
+        expected := minPos
+        if h.oldStart > 0 {
+            expected = h.oldStart - 1 + shift
+        }
+
+        // A hunk without context or removed lines inserts at its position
+        if len(oldLines) == 0 {
+            pos := expected
+            if h.oldStart > 0 {
+                pos = h.oldStart + shift // "-5,0" inserts after line 5
+            }
+            if pos < minPos {
+                pos = minPos
+            }
+            if pos > len(lines) {
+                pos = len(lines)
+            }
+            lines = splice(lines, pos, 0, newLines)
+            minPos = pos + len(newLines)
+            shift += len(newLines)
+            continue
+        }
+
+        pos, trimStart, trimEnd := findHunk(lines, h, oldLines, expected, minPos)
+        if pos < 0 {
+            rejections = append(rejections, describeRejection(patch.path, i+1, h, lines, oldLines, minPos))
+            continue
+        }
+        oldPart := oldLines[trimStart : len(oldLines)-trimEnd]
+        newPart := h.replace(trimStart, trimEnd, lines[pos:pos+len(oldPart)])
+        lines = splice(lines, pos, len(oldPart), newPart)
+        if h.oldStart > 0 {
+            shift = pos - trimStart - (h.oldStart - 1)
+        }
+        shift += len(newPart) - len(oldPart)
+        minPos = pos + len(newPart)
+    }
+
+    if len(lines) == 0 {
+        return "", rejections
+    }
+    // The file keeps ending without a newline, unless the diff says so
+    newline := original == "" || strings.HasSuffix(original, "\n") || patch.oldNoNewline
+    if patch.newNoNewline {
+        newline = false
+    }
+    if !newline {
+        return strings.Join(lines, "\n"), rejections
+    }
+    return strings.Join(lines, "\n") + "\n", rejections
+}
+
+// sides returns the lines the hunk expects in the old file and the lines
+// that replace them, without their prefixes.
+func (h hunk) sides() ([]string, []string) {
+    var oldLines, newLines []string
+    for _, line := range h.lines {
+        switch line[0] {
+        case ' ':
+            oldLines = append(oldLines, line[1:])
+            newLines = append(newLines, line[1:])
+        case '-':
+            oldLines = append(oldLines, line[1:])
+        case '+':
+            newLines = append(newLines, line[1:])
+        }
+    }
+    return oldLines, newLines
+}
+
+// replace returns the lines that replace matched, the lines of the file
+// the hunk was placed on without trimStart and trimEnd context lines at its
+// edges. Context lines keep their text in the file, which may differ from
+// the hunk in whitespace.
+func (h hunk) replace(trimStart int, trimEnd int, matched []string) []string {
+    var replacement []string
+    old := 0
+    for _, line := range h.lines[trimStart : len(h.lines)-trimEnd] {
+        switch line[0] {
+        case ' ':
+            replacement = append(replacement, matched[old])
+            old++
+        case '-':
+            old++
+        case '+':
+            replacement = append(replacement, line[1:])
+        }
+    }
+    return replacement
+}
+
+// contextEdges returns the number of context lines at the start and at the
+// end of the hunk, which are the same in oldLines and newLines.
+func (h hunk) contextEdges() (int, int) {
+    leading, trailing := 0, 0
+    for _, line := range h.lines {
+        if line[0] != ' ' {
+            break
+        }
+        leading++
+    }
+    for i := len(h.lines) - 1; i >= 0 && h.lines[i][0] == ' '; i-- {
+        trailing++
+    }
+    if leading == len(h.lines) {
+        trailing = 0
+    }
+    return leading, trailing
+}
+
+// findHunk looks for oldLines in lines, starting at expected and moving
+// away from it in both directions, but not before minPos. It returns the
+// position of the match and how many context lines were left out at its
+// start and end, or -1 if there is no match.
+func findHunk(lines []string, h hunk, oldLines []string, expected int, minPos int) (int, int, int) {
+    leading, trailing := h.contextEdges()
+    for fuzz := 0; fuzz <= maxHunkFuzz; fuzz++ {
+        trimStart, trimEnd := min(fuzz, leading), min(fuzz, trailing)
+        if fuzz > 0 && trimStart+trimEnd == 0 {
+            break
+        }
+        if trimStart+trimEnd >= len(oldLines) {
+            break
+        }
+        part := oldLines[trimStart : len(oldLines)-trimEnd]
+        for _, equal := range []func(a, b string) bool{exactLine, looseLine} {
+            if pos := searchLines(lines, part, expected+trimStart, minPos, equal); pos >= 0 {
+                return pos, trimStart, trimEnd
+            }
+        }
+    }
+    return -1, 0, 0
+}
+
+// searchLines returns the position of part in lines closest to expected,
+// but not before minPos, or -1.
+func searchLines(lines []string, part []string, expected int, minPos int, equal func(a, b string) bool) int {
+    last := len(lines) - len(part)
+    for distance := 0; expected-distance >= minPos || expected+distance <= last; distance++ {
+        for _, pos := range []int{expected + distance, expected - distance} {
+            if pos >= minPos && pos <= last && matchesAt(lines, part, pos, equal) {
+                return pos
+            }
+        }
+    }
+    return -1
+}
+
+func matchesAt(lines []string, part []string, pos int, equal func(a, b string) bool) bool {
+    for i, line := range part {
+        if !equal(lines[pos+i], line) {
+            return false
+        }
+    }
+    return true
+}
+
+func exactLine(a, b string) bool {
+    return a == b
+}
+
+// looseLine compares lines with their whitespace collapsed, since models
+// often get indentation and trailing spaces wrong.
+func looseLine(a, b string) bool {
+    return looseKey(a) == looseKey(b)
+}
+
+// looseKey returns line with its whitespace collapsed, the same for all
+// lines looseLine finds equal.
+func looseKey(line string) string {
+    return strings.Join(strings.Fields(line), " ")
+}
+
+// describeRejection explains why a hunk could not be placed: where the
+// closest match in the file is and the first line that differs there.
+func describeRejection(path string, number int, h hunk, lines []string, oldLines []string, minPos int) string {
+    prefix := fmt.Sprintf("hunk %d of %s (%s)", number, path, h.header)
+    mismatch, found := closestMismatch(lines, oldLines, minPos)
+    if !found {
+        return fmt.Sprintf("%s: none of its context or removed lines are in the file, the first one is %q", prefix, oldLines[0])
+    }
+    if mismatch == "" {
+        return prefix + ": it overlaps the hunk before it"
+    }
+    return prefix + ": " + mismatch
+}
+
+// closestMismatch finds the position at or after minPos where most of want
+// matches lines, and describes the first line that differs there. It
+// reports false if no line of want is in lines, and an empty description
+// if want matches completely.
+func closestMismatch(lines []string, want []string, minPos int) (string, bool) {
+    // Find the position where most lines match
+    best, bestMatches := -1, 0
+    for pos := minPos; pos < len(lines); pos++ {
+        matches := 0
+        for i, line := range want {
+            if pos+i < len(lines) && looseLine(lines[pos+i], line) {
+                matches++
+            }
+        }
+        if matches > bestMatches {
+            best, bestMatches = pos, matches
+        }
+    }
+    if best < 0 {
+        return "", false
+    }
+    for i, line := range want {
+        if best+i >= len(lines) {
+            return fmt.Sprintf("the closest match starts at line %d, but the file ends before the line %q", best+1, line), true
+        }
+        if !looseLine(lines[best+i], line) {
+            return fmt.Sprintf("the closest match starts at line %d, where line %d is %q instead of %q", best+1, best+i+1, lines[best+i], line), true
+        }
+    }
+    return "", true
+}
+
+// splice replaces count lines at pos with replacement.
+func splice(lines []string, pos int, count int, replacement []string) []string {
+    result := make([]string, 0, len(lines)-count+len(replacement))
+    result = append(result, lines[:pos]...)
+    result = append(result, replacement...)
+    return append(result, lines[pos+count:]...)
+}
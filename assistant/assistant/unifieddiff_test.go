@@ -0,0 +1,217 @@
+package assistant
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParseUnifiedDiff(t *testing.T) {
+    diff := "diff --git a/old.go b/new.go\n" +
+        "rename from old.go\n" +
+        "rename to new.go\n" +
+        "--- a/old.go\n" +
+        "+++ b/new.go\n" +
+        "@@ -1,3 +1,3 @@\n" +
+        " a\n" +
+        "\n" +
+        "-b\n" +
+        "+c\n" +
+        "--- a/gone.go\n" +
+        "+++ /dev/null\n" +
+        "--- /dev/null\n" +
+        "+++ b/fresh.go\n" +
+        "@@\n" +
+        "+package fresh\n"
+    patches, err := parseUnifiedDiff(diff)
+    if err != nil {
+        t.Fatalf("parseUnifiedDiff: %v", err)
+    }
+    if len(patches) != 3 {
+        t.Fatalf("got %d patches, want 3: %+v", len(patches), patches)
+    }
+    rename, deletion, creation := patches[0], patches[1], patches[2]
+    if rename.oldPath != "old.go" || rename.path != "new.go" || len(rename.hunks) != 1 || rename.hunks[0].oldStart != 1 {
+        t.Errorf("rename: got %+v", rename)
+    }
+    // The empty line in the hunk is an unchanged empty line
+    if want := []string{" a", " ", "-b", "+c"}; !reflect.DeepEqual(rename.hunks[0].lines, want) {
+        t.Errorf("rename hunk: got %q, want %q", rename.hunks[0].lines, want)
+    }
+    if !deletion.isDeleted || deletion.path != "gone.go" {
+        t.Errorf("deletion: got %+v", deletion)
+    }
+    if !creation.isNew || creation.path != "fresh.go" || creation.hunks[0].oldStart != 0 {
+        t.Errorf("creation: got %+v", creation)
+    }
+
+    for _, bad := range []string{"no diff here", "@@ -1 +1 @@\n-a\n+b\n", "--- a/x.go\n+++ b/x.go\n"} {
+        if _, err := parseUnifiedDiff(bad); err == nil {
+            t.Errorf("parseUnifiedDiff(%q) succeeded", bad)
+        }
+    }
+}
+
+func TestApplyPatch(t *testing.T) {
+    original := "package p\n\nfunc a() {\n\treturn\n}\n\nfunc b() {\n\treturn\n}\n"
+    tests := []struct {
+        name     string
+        hunks    []hunk
+        want     string
+        rejected string // In the rejection, if the hunk must not apply
+    }{
+        {
+            name:  "exact at its line",
+            hunks: []hunk{{oldStart: 3, lines: []string{" func a() {", "-\treturn", "+\treturn 1", " }"}}},
+            want:  "package p\n\nfunc a() {\n\treturn 1\n}\n\nfunc b() {\n\treturn\n}\n",
+        },
+        {
+            name:  "wrong line number",
+            hunks: []hunk{{oldStart: 1, lines: []string{" func b() {", "-\treturn", "+\treturn 2", " }"}}},
+            want:  "package p\n\nfunc a() {\n\treturn\n}\n\nfunc b() {\n\treturn 2\n}\n",
+        },
+        {
+            name:  "no line number",
+            hunks: []hunk{{lines: []string{" func b() {", "-\treturn", "+\treturn 2"}}},
+            want:  "package p\n\nfunc a() {\n\treturn\n}\n\nfunc b() {\n\treturn 2\n}\n",
+        },
+        {
+            name:  "different whitespace",
+            hunks: []hunk{{oldStart: 7, lines: []string{" func b()  {", "-    return", "+\treturn 2"}}},
+            want:  "package p\n\nfunc a() {\n\treturn\n}\n\nfunc b() {\n\treturn 2\n}\n",
+        },
+        {
+            name:  "context at the edges that does not match",
+            hunks: []hunk{{oldStart: 3, lines: []string{" func x() {", "-\treturn", "+\treturn 1", " } // a"}}},
+            want:  "package p\n\nfunc a() {\n\treturn 1\n}\n\nfunc b() {\n\treturn\n}\n",
+        },
+        {
+            name: "later hunk placed after the shift of the earlier one",
+            hunks: []hunk{
+                {oldStart: 1, lines: []string{" package p", "+", "+import \"fmt\""}},
+                {oldStart: 8, lines: []string{" func b() {", "-\treturn", "+\tfmt.Println()"}},
+            },
+            want: "package p\n\nimport \"fmt\"\n\nfunc a() {\n\treturn\n}\n\nfunc b() {\n\tfmt.Println()\n}\n",
+        },
+        {
+            name:  "insertion without context",
+            hunks: []hunk{{oldStart: 10, lines: []string{"+", "+func c() {}"}}},
+            want:  original + "\nfunc c() {}\n",
+        },
+        {
+            name:     "no match",
+            hunks:    []hunk{{header: "@@ -3 +3 @@", oldStart: 3, lines: []string{" func a() {", "-\treturn nil", "+\treturn 1", " }"}}},
+            rejected: "hunk 1 of main.go (@@ -3 +3 @@)",
+        },
+        {
+            name: "hunks out of order",
+            hunks: []hunk{
+                {header: "@@ -7 +7 @@", lines: []string{" func b() {", "-\treturn", "+\treturn 2"}},
+                {header: "@@ -3 +3 @@", lines: []string{" func a() {", "-\treturn", "+\treturn 1"}},
+            },
+            rejected: "hunk 2 of main.go",
+        },
+    }
+    for _, test := range tests {
+        got, rejected := applyPatch(filePatch{path: "main.go", hunks: test.hunks}, original)
+        if test.rejected != "" {
+            if len(rejected) != 1 || !strings.Contains(rejected[0], test.rejected) {
+                t.Errorf("%s: got rejections %q, want one with %q", test.name, rejected, test.rejected)
+            }
+            continue
+        }
+        if len(rejected) > 0 {
+            t.Errorf("%s: rejected: %q", test.name, rejected)
+        } else if got != test.want {
+            t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+        }
+    }
+}
+
+func TestApplyDiff(t *testing.T) {
+    dir := t.TempDir()
+    if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    files, ops, err := applyDiff(dir, "--- a/repo/main.go\n+++ b/repo/main.go\n@@ -3 +3 @@\n-func main() {}\n+func main() { run() }\n--- /dev/null\n+++ b/repo/run.go\n@@ -0,0 +1 @@\n+package main\n")
+    if err != nil {
+        t.Fatalf("applyDiff: %v", err)
+    }
+    want := map[string]string{"repo/main.go": "package main\n\nfunc main() { run() }\n", "repo/run.go": "package main\n"}
+    if !reflect.DeepEqual(files, want) || !ops.empty() {
+        t.Errorf("got %q, %+v, want %q", files, ops, want)
+    }
+
+    // Nothing applies unless every hunk does
+    for _, diff := range []string{
+        "--- a/main.go\n+++ b/main.go\n@@ -3 +3 @@\n-func other() {}\n+func main() { run() }\n",
+        "--- a/missing.go\n+++ b/missing.go\n@@ -1 +1 @@\n-a\n+b\n",
+        "--- /dev/null\n+++ b/main.go\n@@ -0,0 +1 @@\n+package main\n",
+        "--- a/../outside.go\n+++ b/../outside.go\n@@ -1 +1 @@\n-a\n+b\n",
+    } {
+        if files, _, err := applyDiff(dir, diff); err == nil {
+            t.Errorf("applyDiff(%q) = %q, want an error", diff, files)
+        }
+    }
+}
+
+func TestDiffEdgeLines(t *testing.T) {
+    tests := []struct {
+        name     string
+        original string
+        diff     string
+        patches  int // Files the diff changes, if not 1
+        want     string
+    }{
+        {
+            name:     "the newline at the end is removed",
+            original: "a\nb\n",
+            diff:     "--- a/f.txt\n+++ b/f.txt\n@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+            want:     "a\nb",
+        },
+        {
+            name:     "the newline at the end is added",
+            original: "a\nb",
+            diff:     "--- a/f.txt\n+++ b/f.txt\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+            want:     "a\nb\n",
+        },
+        {
+            name:     "a file without a newline at the end keeps it that way",
+            original: "a\nb\nc",
+            diff:     "--- a/f.txt\n+++ b/f.txt\n@@ -1,2 +1,2 @@\n-a\n+x\n b\n",
+            want:     "x\nb\nc",
+        },
+        {
+            name:     "changed lines that look like file headers",
+            original: "-- old comment\nselect 1;\n",
+            diff:     "--- a/q.sql\n+++ b/q.sql\n@@ -1,2 +1,2 @@\n--- old comment\n+++ new comment\n select 1;\n",
+            want:     "++ new comment\nselect 1;\n",
+        },
+        {
+            name:     "file headers after a hunk with wrong counts",
+            original: "a\n",
+            diff:     "--- a/f.txt\n+++ b/f.txt\n@@ -1,5 +1,5 @@\n-a\n+b\n--- a/g.txt\n+++ b/g.txt\n@@ -1 +1 @@\n-c\n+d\n",
+            patches:  2,
+            want:     "b\n",
+        },
+    }
+    for _, test := range tests {
+        patches, err := parseUnifiedDiff(test.diff)
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if want := max(test.patches, 1); len(patches) != want {
+            t.Errorf("%s: got %d patches, want %d: %+v", test.name, len(patches), want, patches)
+            continue
+        }
+        got, rejected := applyPatch(patches[0], test.original)
+        if len(rejected) > 0 {
+            t.Errorf("%s: rejected: %q", test.name, rejected)
+        } else if got != test.want {
+            t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+        }
+    }
+}
@@ -2,6 +2,7 @@ package chatgpt
 
 import (
     "bytes"
+    "context"
     "encoding/json"
     "fmt"
     "io/ioutil"
@@ -10,106 +11,184 @@ import (
     "log"
 )
 
-const openAIEndpoint = "https://api.openai.com/v1/chat/completions"
+// DefaultEndpoint is the OpenAI chat completions API. OPENAI_ENDPOINT
+// replaces it, e.g. with a proxy or the fake server in cmd/fakellm.
+const DefaultEndpoint = "https://api.openai.com/v1/chat/completions"
+
+// DefaultModel is the OpenAI model used when a job does not ask for another one.
+const DefaultModel = "gpt-4o-mini"
 
 type ChatGPTRequest struct {
-    Model    string   `json:"model"`
-    Messages []Message `json:"messages"`
+    Model         string         `json:"model"`
+    Messages      []Message      `json:"messages"`
+    Stream        bool           `json:"stream,omitempty"`
+    StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+    // ResponseFormat requests structured output, see CreateStructuredRequest.
+    ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+
+    // Tools the model may call instead of replying, see tools.go.
+    Tools []Tool `json:"tools,omitempty"`
+    // ToolChoice "none" makes the model reply even though Tools are set.
+    ToolChoice string `json:"tool_choice,omitempty"`
+
+    // Sampling parameters, see llm.ApplyParams. Unset ones are left to the
+    // server. OpenAI wants MaxCompletionTokens instead of MaxTokens.
+    Temperature         *float64 `json:"temperature,omitempty"`
+    MaxTokens           int      `json:"max_tokens,omitempty"`
+    MaxCompletionTokens int      `json:"max_completion_tokens,omitempty"`
+    Seed                *int64   `json:"seed,omitempty"`
+    ReasoningEffort     string   `json:"reasoning_effort,omitempty"`
+}
+
+// StreamOptions asks for a final chunk with the token usage of a streamed reply.
+type StreamOptions struct {
+    IncludeUsage bool `json:"include_usage"`
 }
 
 type Message struct {
     Role    string `json:"role"`
     Content string `json:"content"`
+
+    // Set on assistant messages that call tools
+    ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+    // Set on "tool" messages, which carry the result of a tool call
+    ToolCallID string `json:"tool_call_id,omitempty"`
 }
 
 type ChatGPTResponse struct {
     Choices []struct {
-        Message Message `json:"message"`
+        Message      Message `json:"message"`
+        FinishReason string  `json:"finish_reason"`
     } `json:"choices"`
+    Usage Usage `json:"usage"`
+}
+
+// Usage is the token usage reported for a request.
+type Usage struct {
+    PromptTokens     int `json:"prompt_tokens"`
+    CompletionTokens int `json:"completion_tokens"`
+    TotalTokens      int `json:"total_tokens"`
+}
+
+// Reply is the result of a request: the text of the reply, the tools the
+// model wants to call, why the model stopped, and the tokens it used. Usage
+// is zero if the server did not report it.
+type Reply struct {
+    Content      string     `json:"content"`
+    ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+    FinishReason string     `json:"finish_reason"`
+    Usage        Usage      `json:"usage"`
+
+    // Cache is "hit" or "miss" if the reply went through llm.ResponseCache.
+    Cache string `json:"-"`
 }
 
-const systemprompt = `You are an expert C++ and Golang developer assistant. 
-Please execute the task described below with the following guidelines:
-
-1. When replying, please reply with entire .cpp or .hpp files, not just the
-   changes. 
-2. Delimit the files with the following markers:
-   - Start each file with '/* START OF FILE: $filename */' 
-   - End each file with '/* END OF FILE: $filename */'
-3. If parts of the file are unchanged, do not omit or summarize them. Instead, 
-   include the entire file. *This is extremely important*.
-5. Additionally, include the following:
-   - A three-word summary of the PR changes in the format "Summary: $summary".
-     The summary should be a maximum of three words separated by dashes, and
-     not include any other punctuation or special characters.
-   - A one-line commit message in the format "Commit-Message: $message"
-6. Absolutely do not remove comments. It is OK to suggest improvements to
-   comments.
-7. Ensure that you never return two copies of the same file, each file should
-   only be present once.
-
-Please ensure your replies strictly adhere to these rules to avoid ambiguity
-and issues in creating PRs out of your changes. This is very important.
-`
-
-// CreateRequest prepares the prompt request for ChatGPT
-func CreateRequest(prompt string) ChatGPTRequest {
+// CreateRequest prepares the request for the given model. messages is the
+// conversation so far, without the system prompt, which is added in front.
+// The system prompt of a job is rendered by the prompts package.
+func CreateRequest(model string, systemPrompt string, messages []Message) ChatGPTRequest {
     return ChatGPTRequest{
-        Model: "gpt-4o-mini",
-        Messages: []Message{
-            {Role: "system", Content: systemprompt},
-            {Role: "user", Content: prompt},
-        },
+        Model:    model,
+        Messages: append([]Message{{Role: "system", Content: systemPrompt}}, messages...),
     }
 }
 
 // SendRequest sends the prompt to ChatGPT and retrieves the response
-func SendRequest(request ChatGPTRequest) (string, error) {
+func SendRequest(ctx context.Context, request ChatGPTRequest) (Reply, error) {
+    endpoint, apiKey, err := openAIConfig()
+    if err != nil {
+        return Reply{}, err
+    }
+    return SendRequestTo(ctx, endpoint, apiKey, request)
+}
+
+// openAIConfig returns the endpoint and API key for OpenAI requests. The key
+// is only required for the real API; servers set with OPENAI_ENDPOINT may
+// not need one.
+func openAIConfig() (string, string, error) {
+    endpoint := os.Getenv("OPENAI_ENDPOINT")
+    if endpoint == "" {
+        endpoint = DefaultEndpoint
+    }
     apiKey := os.Getenv("OPENAI_API_KEY")
-    if apiKey == "" {
+    if apiKey == "" && endpoint == DefaultEndpoint {
         log.Printf("OPENAI_API_KEY environment variable is not set")
-        return "", fmt.Errorf("OPENAI_API_KEY environment variable is not set")
+        return "", "", fmt.Errorf("OPENAI_API_KEY environment variable is not set")
     }
+    return endpoint, apiKey, nil
+}
 
-    requestBody, err := json.Marshal(request)
-    if err != nil {
-        return "", err
-    }
+// SendRequestTo sends the prompt to any OpenAI-compatible chat completions
+// endpoint (OpenAI itself, llama.cpp server, Ollama, ...). The Authorization
+// header is omitted if apiKey is empty, which is what most local servers expect.
+// Transient failures are retried according to DefaultRetryPolicy.
+func SendRequestTo(ctx context.Context, endpoint string, apiKey string, request ChatGPTRequest) (Reply, error) {
+    var reply Reply
+    err := Retry(ctx, DefaultRetryPolicy, func(ctx context.Context) error {
+        var err error
+        reply, err = sendRequestOnce(ctx, endpoint, apiKey, request)
+        return err
+    })
+    return reply, err
+}
 
-    req, err := http.NewRequest("POST", openAIEndpoint, bytes.NewBuffer(requestBody))
+// sendRequestOnce makes a single attempt of SendRequestTo.
+func sendRequestOnce(ctx context.Context, endpoint string, apiKey string, request ChatGPTRequest) (Reply, error) {
+    req, err := newHTTPRequest(ctx, endpoint, apiKey, request)
     if err != nil {
-        return "", err
+        return Reply{}, err
     }
-    log.Printf("Request: %v", req)
-    req.Header.Set("Authorization", "Bearer "+apiKey)
-    req.Header.Set("Content-Type", "application/json")
 
-    // Log the request for debugging.
-    fmt.Println("ChatGPT request:", string(requestBody))
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    resp, err := Do(req)
     if err != nil {
-        return "", err
+        return Reply{}, err
     }
     defer resp.Body.Close()
 
     if resp.StatusCode != http.StatusOK {
         body, _ := ioutil.ReadAll(resp.Body)
-        return "", fmt.Errorf("ChatGPT API error: %s", string(body))
+        return Reply{}, ClassifyHTTPError(resp.StatusCode, resp.Header, body)
     }
 
     var chatResponse ChatGPTResponse
     err = json.NewDecoder(resp.Body).Decode(&chatResponse)
     if err != nil {
         log.Printf("Failed to decode response: %v", err)
-        return "", err
+        return Reply{}, err
     }
-    log.Printf("ChatGPT response: %v", chatResponse)
+    log.Printf("ChatGPT response: %d choices, %d prompt and %d completion tokens", len(chatResponse.Choices), chatResponse.Usage.PromptTokens, chatResponse.Usage.CompletionTokens)
 
     if len(chatResponse.Choices) > 0 {
-        return chatResponse.Choices[0].Message.Content, nil
+        return Reply{
+            Content:      chatResponse.Choices[0].Message.Content,
+            ToolCalls:    chatResponse.Choices[0].Message.ToolCalls,
+            FinishReason: chatResponse.Choices[0].FinishReason,
+            Usage:        chatResponse.Usage,
+        }, nil
     }
 
-    return "", fmt.Errorf("no response from ChatGPT")
+    return Reply{}, fmt.Errorf("no response from ChatGPT")
 }
 
+// newHTTPRequest builds the POST request for a chat completions endpoint.
+func newHTTPRequest(ctx context.Context, endpoint string, apiKey string, request ChatGPTRequest) (*http.Request, error) {
+    requestBody, err := json.Marshal(request)
+    if err != nil {
+        return nil, err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(requestBody))
+    if err != nil {
+        return nil, err
+    }
+    if apiKey != "" {
+        req.Header.Set("Authorization", "Bearer "+apiKey)
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    // Log only the size: the body has the repository content, and the
+    // headers the API key
+    log.Printf("ChatGPT request: %d messages, %d bytes", len(request.Messages), len(requestBody))
+    return req, nil
+}
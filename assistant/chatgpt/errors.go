@@ -0,0 +1,105 @@
+package chatgpt
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ErrorKind classifies a failed API request.
+type ErrorKind string
+
+const (
+    ErrorRateLimit  ErrorKind = "rate limit"
+    ErrorQuota      ErrorKind = "quota exceeded"
+    ErrorOverloaded ErrorKind = "overloaded"
+    ErrorServer     ErrorKind = "server error"
+    ErrorNetwork    ErrorKind = "network error"
+    ErrorAuth       ErrorKind = "authentication"
+    ErrorBadRequest ErrorKind = "bad request"
+    ErrorOther      ErrorKind = "other"
+)
+
+// APIError is returned for requests that the API (or the network) rejected.
+type APIError struct {
+    Kind       ErrorKind
+    StatusCode int           // 0 for network errors
+    RetryAfter time.Duration // Delay requested by the server, 0 if none
+    Message    string
+}
+
+func (e *APIError) Error() string {
+    if e.StatusCode == 0 {
+        return fmt.Sprintf("API %s: %s", e.Kind, e.Message)
+    }
+    return fmt.Sprintf("API %s (HTTP %d): %s", e.Kind, e.StatusCode, e.Message)
+}
+
+// Retryable reports whether sending the same request again may succeed.
+func (e *APIError) Retryable() bool {
+    switch e.Kind {
+    case ErrorRateLimit, ErrorOverloaded, ErrorServer, ErrorNetwork:
+        return true
+    }
+    return false
+}
+
+// ClassifyHTTPError turns a non-200 response into an APIError. It knows the
+// status codes used by OpenAI, Anthropic and the common local servers.
+func ClassifyHTTPError(statusCode int, header http.Header, body []byte) *APIError {
+    apiErr := &APIError{
+        StatusCode: statusCode,
+        RetryAfter: parseRetryAfter(header),
+        Message:    strings.TrimSpace(string(body)),
+    }
+
+    switch {
+    case statusCode == http.StatusTooManyRequests:
+        // OpenAI also uses 429 when the account is out of credit, which
+        // no amount of waiting fixes.
+        if strings.Contains(apiErr.Message, "insufficient_quota") {
+            apiErr.Kind = ErrorQuota
+        } else {
+            apiErr.Kind = ErrorRateLimit
+        }
+    case statusCode == http.StatusServiceUnavailable || statusCode == 529:
+        // 529 is Anthropic's "overloaded" status.
+        apiErr.Kind = ErrorOverloaded
+    case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+        apiErr.Kind = ErrorAuth
+    case statusCode == http.StatusRequestTimeout || statusCode >= 500:
+        apiErr.Kind = ErrorServer
+    case statusCode >= 400:
+        apiErr.Kind = ErrorBadRequest
+    default:
+        apiErr.Kind = ErrorOther
+    }
+    return apiErr
+}
+
+// parseRetryAfter reads the delay requested by the server. It understands
+// the standard Retry-After header (seconds or HTTP date) and the
+// retry-after-ms header sent by OpenAI.
+func parseRetryAfter(header http.Header) time.Duration {
+    if ms := header.Get("Retry-After-Ms"); ms != "" {
+        if value, err := strconv.ParseFloat(ms, 64); err == nil && value > 0 {
+            return time.Duration(value * float64(time.Millisecond))
+        }
+    }
+
+    retryAfter := header.Get("Retry-After")
+    if retryAfter == "" {
+        return 0
+    }
+    if seconds, err := strconv.ParseFloat(retryAfter, 64); err == nil && seconds > 0 {
+        return time.Duration(seconds * float64(time.Second))
+    }
+    if date, err := http.ParseTime(retryAfter); err == nil {
+        if delay := time.Until(date); delay > 0 {
+            return delay
+        }
+    }
+    return 0
+}
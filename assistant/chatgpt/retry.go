@@ -0,0 +1,104 @@
+package chatgpt
+
+import (
+    "context"
+    "errors"
+    "log"
+    "math/rand"
+    "net/http"
+    "time"
+)
+
+// RequestTimeout is the deadline for a single attempt of a request,
+// including reading the whole (possibly streamed) reply.
+var RequestTimeout = 10 * time.Minute
+
+// RetryPolicy controls how often and how fast failed requests are retried.
+type RetryPolicy struct {
+    MaxAttempts int           // Total number of attempts, including the first
+    BaseDelay   time.Duration // Delay before the first retry
+    MaxDelay    time.Duration // Upper bound for any single delay
+}
+
+// DefaultRetryPolicy waits 2s, 4s, 8s, ... up to two minutes between
+// attempts, which rides out the typical rate limit window.
+var DefaultRetryPolicy = RetryPolicy{
+    MaxAttempts: 6,
+    BaseDelay:   2 * time.Second,
+    MaxDelay:    2 * time.Minute,
+}
+
+// Retry calls send until it succeeds, fails with an error that is not a
+// retryable APIError, the attempts of the policy are used up, or ctx is
+// done. Every attempt gets its own deadline of RequestTimeout. Between
+// attempts it backs off exponentially with jitter, or waits as long as the
+// server asked for in Retry-After.
+func Retry(ctx context.Context, policy RetryPolicy, send func(ctx context.Context) error) error {
+    var err error
+    for attempt := 1; ; attempt++ {
+        attemptCtx, cancel := context.WithTimeout(ctx, RequestTimeout)
+        err = send(attemptCtx)
+        cancel()
+        if err == nil {
+            return nil
+        }
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+
+        var apiErr *APIError
+        if !errors.As(err, &apiErr) || !apiErr.Retryable() {
+            return err
+        }
+        if attempt >= policy.MaxAttempts {
+            log.Printf("Giving up after %d attempts: %v", attempt, err)
+            return err
+        }
+
+        delay := backoffDelay(policy, attempt)
+        if apiErr.RetryAfter > 0 {
+            delay = apiErr.RetryAfter
+            if delay > policy.MaxDelay {
+                delay = policy.MaxDelay
+            }
+        }
+        log.Printf("Request failed (%v), retrying in %v (attempt %d of %d)", apiErr.Kind, delay, attempt+1, policy.MaxAttempts)
+
+        timer := time.NewTimer(delay)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return ctx.Err()
+        case <-timer.C:
+        }
+    }
+}
+
+// backoffDelay returns the delay before retry number attempt: the base
+// delay doubled for every earlier retry, capped at the maximum, with up to
+// 25% jitter so that parallel jobs do not retry in lockstep.
+func backoffDelay(policy RetryPolicy, attempt int) time.Duration {
+    delay := policy.BaseDelay
+    for i := 1; i < attempt && delay < policy.MaxDelay; i++ {
+        delay *= 2
+    }
+    if delay > policy.MaxDelay {
+        delay = policy.MaxDelay
+    }
+    return delay - time.Duration(rand.Int63n(int64(delay)/4+1))
+}
+
+// Do sends req with a plain client; the deadline comes from the request's
+// context. Network failures are returned as retryable APIErrors, unless
+// they were caused by the caller giving up.
+func Do(req *http.Request) (*http.Response, error) {
+    client := &http.Client{}
+    resp, err := client.Do(req)
+    if err != nil {
+        if ctxErr := req.Context().Err(); ctxErr != nil && ctxErr != context.DeadlineExceeded {
+            return nil, ctxErr
+        }
+        return nil, &APIError{Kind: ErrorNetwork, Message: err.Error()}
+    }
+    return resp, nil
+}
@@ -0,0 +1,178 @@
+package chatgpt
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "strings"
+)
+
+// chatGPTStreamChunk is one server-sent event of a streamed chat completion.
+type chatGPTStreamChunk struct {
+    Choices []struct {
+        Delta struct {
+            Content   string          `json:"content"`
+            ToolCalls []toolCallDelta `json:"tool_calls"`
+        } `json:"delta"`
+        FinishReason string `json:"finish_reason"`
+    } `json:"choices"`
+    Usage *Usage `json:"usage"` // Only set in the final chunk
+}
+
+// StreamRequest is the streaming counterpart of SendRequest.
+func StreamRequest(ctx context.Context, request ChatGPTRequest, onDelta func(delta string)) (Reply, error) {
+    endpoint, apiKey, err := openAIConfig()
+    if err != nil {
+        return Reply{}, err
+    }
+    return StreamRequestTo(ctx, endpoint, apiKey, request, onDelta)
+}
+
+// StreamRequestTo sends the request with streaming enabled and calls onDelta
+// with each piece of the reply as it arrives. It returns the complete reply
+// once the stream has finished. Failures are retried like in SendRequestTo,
+// but only until the first piece of the reply has been passed to onDelta.
+func StreamRequestTo(ctx context.Context, endpoint string, apiKey string, request ChatGPTRequest, onDelta func(delta string)) (Reply, error) {
+    var reply Reply
+    err := Retry(ctx, DefaultRetryPolicy, func(ctx context.Context) error {
+        var err error
+        reply, err = streamRequestOnce(ctx, endpoint, apiKey, request, onDelta)
+        return err
+    })
+    return reply, err
+}
+
+// streamRequestOnce makes a single attempt of StreamRequestTo.
+func streamRequestOnce(ctx context.Context, endpoint string, apiKey string, request ChatGPTRequest, onDelta func(delta string)) (Reply, error) {
+    request.Stream = true
+    request.StreamOptions = &StreamOptions{IncludeUsage: true}
+    req, err := newHTTPRequest(ctx, endpoint, apiKey, request)
+    if err != nil {
+        return Reply{}, err
+    }
+    req.Header.Set("Accept", "text/event-stream")
+
+    resp, err := Do(req)
+    if err != nil {
+        return Reply{}, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := ioutil.ReadAll(resp.Body)
+        return Reply{}, ClassifyHTTPError(resp.StatusCode, resp.Header, body)
+    }
+
+    var content strings.Builder
+    var finishReason string
+    var usage Usage
+    var toolCalls toolCallAccumulator
+    err = ReadServerSentEvents(resp.Body, func(event string, data string) error {
+        if data == "[DONE]" {
+            return io.EOF
+        }
+        var chunk chatGPTStreamChunk
+        if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+            return fmt.Errorf("failed to decode stream chunk: %v", err)
+        }
+        for _, choice := range chunk.Choices {
+            if choice.Delta.Content != "" {
+                content.WriteString(choice.Delta.Content)
+                onDelta(choice.Delta.Content)
+            }
+            for _, delta := range choice.Delta.ToolCalls {
+                if err := toolCalls.add(delta); err != nil {
+                    return err
+                }
+            }
+            if choice.FinishReason != "" {
+                finishReason = choice.FinishReason
+            }
+        }
+        if chunk.Usage != nil {
+            usage = *chunk.Usage
+        }
+        return nil
+    })
+    if err != nil {
+        log.Printf("Failed to read response stream: %v", err)
+        return Reply{}, StreamError(ctx, err, content.Len() > 0)
+    }
+    log.Printf("ChatGPT stream finished, reason: %s, %d bytes", finishReason, content.Len())
+
+    if content.Len() == 0 && len(toolCalls.calls) == 0 {
+        return Reply{}, fmt.Errorf("no response from ChatGPT")
+    }
+    return Reply{Content: content.String(), ToolCalls: toolCalls.calls, FinishReason: finishReason, Usage: usage}, nil
+}
+
+// StreamError classifies an error that interrupted a stream. Before any
+// output has been delivered, the request can be retried like a network
+// error; afterwards a retry would deliver the output twice, so the error is
+// returned as final.
+func StreamError(ctx context.Context, err error, outputStarted bool) error {
+    if ctx.Err() == context.Canceled {
+        return ctx.Err()
+    }
+    if _, ok := err.(*APIError); ok && !outputStarted {
+        return err
+    }
+    if outputStarted {
+        return fmt.Errorf("stream interrupted after output started: %v", err)
+    }
+    return &APIError{Kind: ErrorNetwork, Message: err.Error()}
+}
+
+// ReadServerSentEvents parses a text/event-stream body and calls handle for
+// every event with its event name (empty if the server sent none) and its
+// data. Multiple data lines of one event are joined with newlines. If handle
+// returns io.EOF, reading stops without an error.
+func ReadServerSentEvents(body io.Reader, handle func(event string, data string) error) error {
+    scanner := bufio.NewScanner(body)
+    // Chunks are small, but some servers send a final event with the whole reply.
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+    var event string
+    var data []string
+    for scanner.Scan() {
+        line := scanner.Text()
+        switch {
+        case line == "":
+            // A blank line terminates the event.
+            if len(data) > 0 {
+                err := handle(event, strings.Join(data, "\n"))
+                if err == io.EOF {
+                    return nil
+                }
+                if err != nil {
+                    return err
+                }
+            }
+            event = ""
+            data = nil
+        case strings.HasPrefix(line, ":"):
+            // Comment, used by servers as keep-alive.
+        case strings.HasPrefix(line, "event:"):
+            event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+        case strings.HasPrefix(line, "data:"):
+            data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return err
+    }
+
+    // Deliver a last event that was not followed by a blank line.
+    if len(data) > 0 {
+        err := handle(event, strings.Join(data, "\n"))
+        if err != io.EOF {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,115 @@
+package chatgpt
+
+import (
+    "encoding/json"
+)
+
+// ResponseFormat asks the model to reply with JSON matching a schema
+// ("structured output").
+type ResponseFormat struct {
+    Type       string      `json:"type"`
+    JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+type JSONSchema struct {
+    Name        string          `json:"name"`
+    Description string          `json:"description,omitempty"`
+    Strict      bool            `json:"strict"`
+    Schema      json.RawMessage `json:"schema"`
+}
+
+// fileEditsSchema describes the reply of the structured edit protocol: the
+// complete new content of every changed or created file, the deleted and
+// renamed files, plus the metadata that the
+// marker protocol asks for in "Summary:", "Commit-Message:" and "PR-Title:"
+// lines and the commit body and PR description blocks.
+const fileEditsSchema = `{
+  "type": "object",
+  "additionalProperties": false,
+  "required": ["summary", "commit_message", "commit_body", "pr_title", "pr_description", "files", "deletes", "renames"],
+  "properties": {
+    "summary": {
+      "type": "string",
+      "description": "At most three words separated by dashes, no other punctuation, e.g. fix-parser-crash"
+    },
+    "commit_message": {
+      "type": "string",
+      "description": "Subject line of the commit message, at most 72 characters"
+    },
+    "commit_body": {
+      "type": "string",
+      "description": "Body of the commit message explaining what changed and why, may be empty"
+    },
+    "pr_title": {
+      "type": "string",
+      "description": "One-line title of the pull request"
+    },
+    "pr_description": {
+      "type": "string",
+      "description": "Description of the pull request for reviewers: the rationale of the change and how it works"
+    },
+    "files": {
+      "type": "array",
+      "description": "Every file that is changed or created, each exactly once; a renamed file that is also changed goes by its new path",
+      "items": {
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["path", "content"],
+        "properties": {
+          "path": {
+            "type": "string",
+            "description": "Path of the file as given in the prompt"
+          },
+          "content": {
+            "type": "string",
+            "description": "The entire new content of the file"
+          }
+        }
+      }
+    },
+    "deletes": {
+      "type": "array",
+      "description": "Paths of the files to delete, may be empty",
+      "items": {"type": "string"}
+    },
+    "renames": {
+      "type": "array",
+      "description": "Files to rename or move, may be empty",
+      "items": {
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["from", "to"],
+        "properties": {
+          "from": {
+            "type": "string",
+            "description": "Current path of the file as given in the prompt"
+          },
+          "to": {
+            "type": "string",
+            "description": "New path of the file"
+          }
+        }
+      }
+    }
+  }
+}`
+
+// CreateStructuredRequest prepares a request that asks for the file edits
+// as JSON matching the file edits schema instead of delimited text. Like in
+// CreateRequest, messages is the conversation without the system prompt,
+// which should describe the JSON format instead of the file markers.
+func CreateStructuredRequest(model string, systemPrompt string, messages []Message) ChatGPTRequest {
+    return ChatGPTRequest{
+        Model:    model,
+        Messages: append([]Message{{Role: "system", Content: systemPrompt}}, messages...),
+        ResponseFormat: &ResponseFormat{
+            Type: "json_schema",
+            JSONSchema: &JSONSchema{
+                Name:        "file_edits",
+                Description: "Submit the changed files and the commit metadata",
+                Strict:      true,
+                Schema:      json.RawMessage(fileEditsSchema),
+            },
+        },
+    }
+}
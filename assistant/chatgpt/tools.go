@@ -0,0 +1,68 @@
+package chatgpt
+
+import (
+    "encoding/json"
+    "fmt"
+)
+
+// Tool is a function the model may call. The result of the call is sent
+// back in a message with role "tool", after which the model continues.
+type Tool struct {
+    Type     string             `json:"type"` // Always "function"
+    Function FunctionDefinition `json:"function"`
+}
+
+type FunctionDefinition struct {
+    Name        string          `json:"name"`
+    Description string          `json:"description"`
+    Parameters  json.RawMessage `json:"parameters"` // JSON schema of the arguments
+}
+
+// ToolCall is a call of a Tool requested by the model.
+type ToolCall struct {
+    ID       string       `json:"id"`
+    Type     string       `json:"type"` // Always "function"
+    Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+    Name      string `json:"name"`
+    Arguments string `json:"arguments"` // JSON object
+}
+
+// toolCallDelta is the piece of a tool call sent in one stream chunk. The
+// ID and name come with the first piece, the arguments are spread over all
+// of them.
+type toolCallDelta struct {
+    Index    int    `json:"index"`
+    ID       string `json:"id"`
+    Function struct {
+        Name      string `json:"name"`
+        Arguments string `json:"arguments"`
+    } `json:"function"`
+}
+
+// A reply has at most this many tool calls; larger indexes come from a
+// broken stream.
+const maxToolCalls = 128
+
+// toolCallAccumulator assembles the tool calls of a streamed reply.
+type toolCallAccumulator struct {
+    calls []ToolCall
+}
+
+func (a *toolCallAccumulator) add(delta toolCallDelta) error {
+    if delta.Index < 0 || delta.Index >= maxToolCalls {
+        return fmt.Errorf("invalid tool call index %d in stream", delta.Index)
+    }
+    for len(a.calls) <= delta.Index {
+        a.calls = append(a.calls, ToolCall{Type: "function"})
+    }
+    call := &a.calls[delta.Index]
+    if delta.ID != "" {
+        call.ID = delta.ID
+    }
+    call.Function.Name += delta.Function.Name
+    call.Function.Arguments += delta.Function.Arguments
+    return nil
+}
@@ -0,0 +1,26 @@
+package chatgpt
+
+import "testing"
+
+func TestToolCallAccumulator(t *testing.T) {
+    var a toolCallAccumulator
+    deltas := []toolCallDelta{{Index: 0, ID: "call_1"}, {Index: 1, ID: "call_2"}, {Index: 0}}
+    deltas[0].Function.Name = "read_file"
+    deltas[0].Function.Arguments = `{"path":`
+    deltas[2].Function.Arguments = `"main.go"}`
+    deltas[1].Function.Name = "list_files"
+    for _, delta := range deltas {
+        if err := a.add(delta); err != nil {
+            t.Fatalf("add: %v", err)
+        }
+    }
+    if len(a.calls) != 2 || a.calls[0].ID != "call_1" || a.calls[0].Function.Arguments != `{"path":"main.go"}` || a.calls[1].Function.Name != "list_files" {
+        t.Errorf("got %+v", a.calls)
+    }
+
+    for _, index := range []int{-1, maxToolCalls} {
+        if err := a.add(toolCallDelta{Index: index}); err == nil {
+            t.Errorf("index %d was accepted", index)
+        }
+    }
+}
@@ -0,0 +1,268 @@
+// Command fakellm is a fake OpenAI-compatible chat completions server for
+// developing the assistant offline. It answers every request with a
+// scripted reply from a directory of fixtures, chosen by matching the
+// prompt, so the web interface and the git plumbing can be exercised
+// without network access, API keys or cost.
+//
+// Run it and point the assistant at it:
+//
+//    go run ./cmd/fakellm
+//    OPENAI_ENDPOINT=http://localhost:8081/v1/chat/completions go run .
+//
+// Each fixture is a JSON file:
+//
+//    {
+//      "match": "(?i)say goodbye",
+//      "reply": "Summary: say-goodbye\n...",
+//      "reply_file": "goodbye.txt",
+//      "structured": {"summary": "say-goodbye", ...},
+//      "tool_calls": [{"name": "read_file", "arguments": {"path": "main.go"}}]
+//    }
+//
+// match is a regular expression searched for in the user messages of the
+// request; an empty match accepts every request. The fixtures are tried in
+// the order of their file names and the first match wins. The reply is
+// reply, or the content of reply_file relative to the fixture directory.
+// For requests with a response format, structured is returned instead.
+// If the request offers tools and the model has not called any yet,
+// tool_calls are returned first. Fixtures are read again for every
+// request, so they can be edited while the server runs.
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+    "github.com/thomasdullien/coding-assistant/assistant/tokens"
+)
+
+// fixture is one scripted reply, see the package documentation.
+type fixture struct {
+    Match      string          `json:"match"`
+    Reply      string          `json:"reply"`
+    ReplyFile  string          `json:"reply_file"`
+    Structured json.RawMessage `json:"structured"`
+    ToolCalls  []struct {
+        Name      string          `json:"name"`
+        Arguments json.RawMessage `json:"arguments"`
+    } `json:"tool_calls"`
+
+    name string // File name, for logs
+}
+
+var fixtureDir = flag.String("fixtures", "cmd/fakellm/fixtures", "directory of fixture files")
+var addr = flag.String("addr", "localhost:8081", "address to listen on")
+var chunkDelay = flag.Duration("delay", 10*time.Millisecond, "delay between the chunks of a streamed reply")
+
+func main() {
+    flag.Parse()
+    http.HandleFunc("/v1/chat/completions", completionsHandler)
+    log.Printf("Serving fixtures from %s on http://%s/v1/chat/completions", *fixtureDir, *addr)
+    log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func completionsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use POST")
+        return
+    }
+    var request chatgpt.ChatGPTRequest
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        writeError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("invalid request: %v", err))
+        return
+    }
+
+    fixtures, err := loadFixtures(*fixtureDir)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+        return
+    }
+    prompt := userMessages(request)
+    var chosen *fixture
+    for i := range fixtures {
+        matched, err := regexp.MatchString(fixtures[i].Match, prompt)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, "server_error", fmt.Sprintf("fixture %s: %v", fixtures[i].name, err))
+            return
+        }
+        if matched {
+            chosen = &fixtures[i]
+            break
+        }
+    }
+    if chosen == nil {
+        log.Printf("No fixture matches request for %s with %d messages", request.Model, len(request.Messages))
+        writeError(w, http.StatusBadRequest, "invalid_request_error", "no fixture matches the prompt")
+        return
+    }
+
+    reply, err := chosen.reply(request)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+        return
+    }
+    log.Printf("Answering request for %s with fixture %s (%d tool calls)", request.Model, chosen.name, len(reply.ToolCalls))
+
+    // Usage is counted locally, the numbers only need to be plausible
+    reply.Usage.CompletionTokens = tokens.Count(reply.Content)
+    for _, msg := range request.Messages {
+        reply.Usage.PromptTokens += tokens.Count(msg.Content)
+    }
+    reply.Usage.TotalTokens = reply.Usage.PromptTokens + reply.Usage.CompletionTokens
+
+    if request.Stream {
+        streamReply(w, request, reply)
+        return
+    }
+    var response chatgpt.ChatGPTResponse
+    response.Choices = make([]struct {
+        Message      chatgpt.Message `json:"message"`
+        FinishReason string          `json:"finish_reason"`
+    }, 1)
+    response.Choices[0].Message = chatgpt.Message{Role: "assistant", Content: reply.Content, ToolCalls: reply.ToolCalls}
+    response.Choices[0].FinishReason = reply.FinishReason
+    response.Usage = reply.Usage
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// reply builds the reply of the fixture to request.
+func (f *fixture) reply(request chatgpt.ChatGPTRequest) (chatgpt.Reply, error) {
+    if len(request.Tools) > 0 && request.ToolChoice != "none" && len(f.ToolCalls) > 0 && !hasToolResults(request) {
+        reply := chatgpt.Reply{FinishReason: "tool_calls"}
+        for i, call := range f.ToolCalls {
+            reply.ToolCalls = append(reply.ToolCalls, chatgpt.ToolCall{
+                ID:       fmt.Sprintf("call_%d", i),
+                Type:     "function",
+                Function: chatgpt.FunctionCall{Name: call.Name, Arguments: string(call.Arguments)},
+            })
+        }
+        return reply, nil
+    }
+
+    if request.ResponseFormat != nil && len(f.Structured) > 0 {
+        return chatgpt.Reply{Content: string(f.Structured), FinishReason: "stop"}, nil
+    }
+    if f.ReplyFile != "" {
+        content, err := ioutil.ReadFile(filepath.Join(*fixtureDir, f.ReplyFile))
+        if err != nil {
+            return chatgpt.Reply{}, fmt.Errorf("fixture %s: %v", f.name, err)
+        }
+        return chatgpt.Reply{Content: string(content), FinishReason: "stop"}, nil
+    }
+    return chatgpt.Reply{Content: f.Reply, FinishReason: "stop"}, nil
+}
+
+// streamReply sends the reply as server-sent events in small chunks, the
+// way OpenAI does, ending with the usage chunk and [DONE].
+func streamReply(w http.ResponseWriter, request chatgpt.ChatGPTRequest, reply chatgpt.Reply) {
+    w.Header().Set("Content-Type", "text/event-stream")
+    flusher, _ := w.(http.Flusher)
+    send := func(chunk interface{}) {
+        data, _ := json.Marshal(chunk)
+        fmt.Fprintf(w, "data: %s\n\n", data)
+        if flusher != nil {
+            flusher.Flush()
+        }
+    }
+    type delta map[string]interface{}
+    choice := func(d delta, finishReason string) map[string]interface{} {
+        c := map[string]interface{}{"index": 0, "delta": d}
+        if finishReason != "" {
+            c["finish_reason"] = finishReason
+        }
+        return map[string]interface{}{"choices": []interface{}{c}}
+    }
+
+    content := reply.Content
+    for len(content) > 0 {
+        n := 16
+        if n > len(content) {
+            n = len(content)
+        }
+        for n < len(content) && !utf8.RuneStart(content[n]) {
+            n++
+        }
+        send(choice(delta{"content": content[:n]}, ""))
+        content = content[n:]
+        time.Sleep(*chunkDelay)
+    }
+    for i, call := range reply.ToolCalls {
+        send(choice(delta{"tool_calls": []interface{}{map[string]interface{}{
+            "index": i, "id": call.ID, "type": "function",
+            "function": map[string]string{"name": call.Function.Name, "arguments": call.Function.Arguments},
+        }}}, ""))
+    }
+    send(choice(delta{}, reply.FinishReason))
+    if request.StreamOptions != nil && request.StreamOptions.IncludeUsage {
+        send(map[string]interface{}{"choices": []interface{}{}, "usage": reply.Usage})
+    }
+    fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// loadFixtures reads all fixture files in dir, sorted by name.
+func loadFixtures(dir string) ([]fixture, error) {
+    paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(paths)
+    var fixtures []fixture
+    for _, path := range paths {
+        content, err := ioutil.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read fixture: %v", err)
+        }
+        var f fixture
+        if err := json.Unmarshal(content, &f); err != nil {
+            return nil, fmt.Errorf("failed to parse fixture %s: %v", path, err)
+        }
+        f.name = filepath.Base(path)
+        fixtures = append(fixtures, f)
+    }
+    if len(fixtures) == 0 {
+        return nil, fmt.Errorf("no fixtures in %s", dir)
+    }
+    return fixtures, nil
+}
+
+// userMessages returns the content of the user messages of request, which
+// the fixtures are matched against.
+func userMessages(request chatgpt.ChatGPTRequest) string {
+    var messages []string
+    for _, msg := range request.Messages {
+        if msg.Role == "user" {
+            messages = append(messages, msg.Content)
+        }
+    }
+    return strings.Join(messages, "\n")
+}
+
+func hasToolResults(request chatgpt.ChatGPTRequest) bool {
+    for _, msg := range request.Messages {
+        if msg.Role == "tool" {
+            return true
+        }
+    }
+    return false
+}
+
+// writeError sends an error in the format of the OpenAI API.
+func writeError(w http.ResponseWriter, status int, errorType string, message string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "error": map[string]string{"type": errorType, "message": message},
+    })
+}
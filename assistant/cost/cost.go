@@ -0,0 +1,204 @@
+package cost
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "strings"
+    "sync"
+)
+
+// Price is the price of a model in USD per million tokens.
+type Price struct {
+    InputPerMillion  float64 `json:"input_per_million"`
+    OutputPerMillion float64 `json:"output_per_million"`
+}
+
+// defaultPrices holds list prices of common models. Prices change; a file
+// given to LoadPrices overrides or extends them.
+var defaultPrices = map[string]Price{
+    "gpt-4o-mini":       {0.15, 0.60},
+    "gpt-4o":            {2.50, 10.00},
+    "gpt-4.1-nano":      {0.10, 0.40},
+    "gpt-4.1-mini":      {0.40, 1.60},
+    "gpt-4.1":           {2.00, 8.00},
+    "gpt-5-nano":        {0.05, 0.40},
+    "gpt-5-mini":        {0.25, 2.00},
+    "gpt-5":             {1.25, 10.00},
+    "o3":                {2.00, 8.00},
+    "o4-mini":           {1.10, 4.40},
+    "claude-haiku-4-5":  {1.00, 5.00},
+    "claude-sonnet-4-5": {3.00, 15.00},
+    "claude-opus-4-1":   {15.00, 75.00},
+}
+
+var pricesMu sync.Mutex
+var prices = defaultPrices
+
+// LoadPrices reads a JSON file mapping model names to prices, for example
+// {"gpt-4o": {"input_per_million": 2.5, "output_per_million": 10}}, and
+// adds its entries to the price table.
+func LoadPrices(path string) error {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("failed to read price table: %v", err)
+    }
+    var loaded map[string]Price
+    if err := json.Unmarshal(content, &loaded); err != nil {
+        return fmt.Errorf("failed to parse price table %s: %v", path, err)
+    }
+
+    pricesMu.Lock()
+    defer pricesMu.Unlock()
+    merged := make(map[string]Price)
+    for model, price := range prices {
+        merged[model] = price
+    }
+    for model, price := range loaded {
+        merged[model] = price
+    }
+    prices = merged
+    return nil
+}
+
+// PriceFor returns the price of model. Models with a dated suffix, like
+// "gpt-4o-2024-08-06", use the price of the longest matching name.
+func PriceFor(model string) (Price, bool) {
+    pricesMu.Lock()
+    defer pricesMu.Unlock()
+    if price, ok := prices[model]; ok {
+        return price, true
+    }
+    best := ""
+    for name := range prices {
+        if strings.HasPrefix(model, name+"-") && len(name) > len(best) {
+            best = name
+        }
+    }
+    if best == "" {
+        return Price{}, false
+    }
+    return prices[best], true
+}
+
+// Entry is the token usage of one model request.
+type Entry struct {
+    Label            string // What the request was for, e.g. "attempt 1"
+    Model            string
+    PromptTokens     int
+    CompletionTokens int
+    Estimated        bool    // The server did not report usage, tokens were counted locally
+    Cached           bool    // The reply came from the response cache and cost nothing
+    Cost             float64 // USD
+    Priced           bool    // False if no price is known for the model
+}
+
+// String formats the entry for logs.
+func (e Entry) String() string {
+    if e.Cached {
+        return fmt.Sprintf("%s: %s, served from cache, $0", e.Label, e.Model)
+    }
+    estimated := ""
+    if e.Estimated {
+        estimated = " (estimated)"
+    }
+    cost := "no price configured"
+    if e.Priced {
+        cost = formatCost(e.Cost, true)
+    }
+    return fmt.Sprintf("%s: %s, %d prompt + %d completion tokens%s, %s",
+        e.Label, e.Model, e.PromptTokens, e.CompletionTokens, estimated, cost)
+}
+
+// Ledger collects the usage of all requests made for a job.
+type Ledger struct {
+    mu      sync.Mutex
+    Entries []Entry
+}
+
+// Record prices the usage of a request and adds it to the ledger.
+func (l *Ledger) Record(label string, model string, promptTokens int, completionTokens int, estimated bool) Entry {
+    entry := Entry{
+        Label:            label,
+        Model:            model,
+        PromptTokens:     promptTokens,
+        CompletionTokens: completionTokens,
+        Estimated:        estimated,
+    }
+    if price, ok := PriceFor(model); ok {
+        entry.Priced = true
+        entry.Cost = (float64(promptTokens)*price.InputPerMillion + float64(completionTokens)*price.OutputPerMillion) / 1e6
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.Entries = append(l.Entries, entry)
+    return entry
+}
+
+// RecordCached adds a request that was answered from the response cache.
+func (l *Ledger) RecordCached(label string, model string) Entry {
+    entry := Entry{Label: label, Model: model, Cached: true, Priced: true}
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.Entries = append(l.Entries, entry)
+    return entry
+}
+
+// Merge adds the entries of other to the ledger.
+func (l *Ledger) Merge(other *Ledger) {
+    other.mu.Lock()
+    entries := append([]Entry(nil), other.Entries...)
+    other.mu.Unlock()
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.Entries = append(l.Entries, entries...)
+}
+
+// Tokens returns the number of prompt and completion tokens of all entries.
+func (l *Ledger) Tokens() int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    total := 0
+    for _, entry := range l.Entries {
+        total += entry.PromptTokens + entry.CompletionTokens
+    }
+    return total
+}
+
+// Summary returns the totals of the ledger in one line.
+func (l *Ledger) Summary() string {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if len(l.Entries) == 0 {
+        return "No model requests were made."
+    }
+
+    var promptTokens, completionTokens, cached int
+    var total float64
+    priced := true
+    for _, entry := range l.Entries {
+        if entry.Cached {
+            cached++
+        }
+        promptTokens += entry.PromptTokens
+        completionTokens += entry.CompletionTokens
+        total += entry.Cost
+        priced = priced && entry.Priced
+    }
+    requests := fmt.Sprintf("%d requests", len(l.Entries))
+    if cached > 0 {
+        requests += fmt.Sprintf(" (%d from cache)", cached)
+    }
+    return fmt.Sprintf("%s, %d prompt + %d completion tokens, %s",
+        requests, promptTokens, completionTokens, formatCost(total, priced))
+}
+
+func formatCost(cost float64, priced bool) string {
+    if !priced {
+        return fmt.Sprintf("at least $%.4f (no price configured for some models)", cost)
+    }
+    return fmt.Sprintf("$%.4f", cost)
+}
@@ -1,3 +1,5 @@
 module github.com/thomasdullien/coding-assistant/assistant
 
-go 1.23.3
+go 1.24.0
+
+require github.com/odvcencio/gotreesitter v0.13.0
@@ -0,0 +1,429 @@
+package llm
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+)
+
+const anthropicEndpoint = "https://api.anthropic.com/v1/messages"
+const anthropicVersion = "2023-06-01"
+const defaultAnthropicModel = "claude-sonnet-4-5"
+
+// The Messages API requires an explicit output limit. Whole-file replies
+// get long, so be generous unless the job sets a limit.
+const anthropicMaxTokens = 16384
+
+// AnthropicProvider talks to the Anthropic Messages API.
+type AnthropicProvider struct {
+    Model string
+}
+
+type anthropicRequest struct {
+    Model       string             `json:"model"`
+    MaxTokens   int                `json:"max_tokens"`
+    Temperature *float64           `json:"temperature,omitempty"`
+    System      string             `json:"system,omitempty"`
+    Messages    []anthropicMessage `json:"messages"`
+    Stream      bool               `json:"stream,omitempty"`
+
+    Tools      []anthropicTool      `json:"tools,omitempty"`
+    ToolChoice *anthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+// anthropicMessage is a message of the Messages API. Unlike in the chat
+// completions API, tool calls and their results are content blocks.
+type anthropicMessage struct {
+    Role    string             `json:"role"`
+    Content []anthropicContent `json:"content"`
+}
+
+// anthropicContent is a content block of type text, tool_use or tool_result.
+type anthropicContent struct {
+    Type      string          `json:"type"`
+    Text      string          `json:"text,omitempty"`
+    ID        string          `json:"id,omitempty"`          // tool_use
+    Name      string          `json:"name,omitempty"`        // tool_use
+    Input     json.RawMessage `json:"input,omitempty"`       // tool_use
+    ToolUseID string          `json:"tool_use_id,omitempty"` // tool_result
+    Content   string          `json:"content,omitempty"`     // tool_result
+}
+
+type anthropicTool struct {
+    Name        string          `json:"name"`
+    Description string          `json:"description,omitempty"`
+    InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+    Type string `json:"type"`
+    Name string `json:"name,omitempty"`
+}
+
+type anthropicResponse struct {
+    Content    []anthropicContent `json:"content"`
+    StopReason string         `json:"stop_reason"`
+    Usage      anthropicUsage `json:"usage"`
+}
+
+type anthropicUsage struct {
+    InputTokens  int `json:"input_tokens"`
+    OutputTokens int `json:"output_tokens"`
+}
+
+// anthropicStreamEvent covers the fields of the streaming events we use:
+// message_start, content_block_start, content_block_delta, message_delta and
+// error.
+type anthropicStreamEvent struct {
+    Type    string `json:"type"`
+    Message struct {
+        Usage anthropicUsage `json:"usage"`
+    } `json:"message"`
+    Index        int              `json:"index"`
+    ContentBlock anthropicContent `json:"content_block"`
+    Delta struct {
+        Type        string `json:"type"`
+        Text        string `json:"text"`
+        PartialJSON string `json:"partial_json"`
+        StopReason  string `json:"stop_reason"`
+    } `json:"delta"`
+    Usage anthropicUsage `json:"usage"`
+    Error struct {
+        Type    string `json:"type"`
+        Message string `json:"message"`
+    } `json:"error"`
+}
+
+func (p *AnthropicProvider) Name() string {
+    return "anthropic"
+}
+
+func (p *AnthropicProvider) DefaultModel() string {
+    return p.Model
+}
+
+// SupportsStructuredOutput is implemented with function calling: the
+// response format becomes the only tool, and the model is forced to call it.
+// The arguments of the call are returned as the reply.
+func (p *AnthropicProvider) SupportsStructuredOutput() bool {
+    return true
+}
+
+func (p *AnthropicProvider) SupportsTools() bool {
+    return true
+}
+
+// SendRequest sends the request to the Messages API and returns the text of
+// the reply. Transient failures are retried like for the other providers.
+func (p *AnthropicProvider) SendRequest(ctx context.Context, request chatgpt.ChatGPTRequest) (chatgpt.Reply, error) {
+    var reply chatgpt.Reply
+    err := chatgpt.Retry(ctx, chatgpt.DefaultRetryPolicy, func(ctx context.Context) error {
+        var err error
+        reply, err = p.sendRequestOnce(ctx, request)
+        return err
+    })
+    return reply, err
+}
+
+// sendRequestOnce makes a single attempt of SendRequest.
+func (p *AnthropicProvider) sendRequestOnce(ctx context.Context, request chatgpt.ChatGPTRequest) (chatgpt.Reply, error) {
+    resp, err := p.post(ctx, request, false)
+    if err != nil {
+        return chatgpt.Reply{}, err
+    }
+    defer resp.Body.Close()
+
+    var messagesResponse anthropicResponse
+    err = json.NewDecoder(resp.Body).Decode(&messagesResponse)
+    if err != nil {
+        log.Printf("Failed to decode response: %v", err)
+        return chatgpt.Reply{}, err
+    }
+    log.Printf("Anthropic response stop reason: %s", messagesResponse.StopReason)
+
+    // Concatenate all text blocks of the reply. For structured output,
+    // the reply is the input of the call of the response format tool
+    // instead. Calls of other tools are returned as tool calls.
+    var text strings.Builder
+    var toolCalls []chatgpt.ToolCall
+    for _, block := range messagesResponse.Content {
+        switch {
+        case block.Type == "text" && request.ResponseFormat == nil:
+            text.WriteString(block.Text)
+        case block.Type == "tool_use" && isResponseFormatTool(request, block.Name):
+            text.Write(block.Input)
+        case block.Type == "tool_use":
+            toolCalls = append(toolCalls, toToolCall(block, string(block.Input)))
+        }
+    }
+    if text.Len() == 0 && len(toolCalls) == 0 {
+        return chatgpt.Reply{}, fmt.Errorf("no response from Anthropic")
+    }
+    return chatgpt.Reply{
+        Content:      text.String(),
+        ToolCalls:    toolCalls,
+        FinishReason: messagesResponse.StopReason,
+        Usage:        messagesResponse.Usage.toUsage(),
+    }, nil
+}
+
+// StreamRequest is the streaming counterpart of SendRequest. As with the
+// other providers, failures are only retried before output has started.
+func (p *AnthropicProvider) StreamRequest(ctx context.Context, request chatgpt.ChatGPTRequest, onDelta func(delta string)) (chatgpt.Reply, error) {
+    var reply chatgpt.Reply
+    err := chatgpt.Retry(ctx, chatgpt.DefaultRetryPolicy, func(ctx context.Context) error {
+        var err error
+        reply, err = p.streamRequestOnce(ctx, request, onDelta)
+        return err
+    })
+    return reply, err
+}
+
+// streamRequestOnce makes a single attempt of StreamRequest.
+func (p *AnthropicProvider) streamRequestOnce(ctx context.Context, request chatgpt.ChatGPTRequest, onDelta func(delta string)) (chatgpt.Reply, error) {
+    resp, err := p.post(ctx, request, true)
+    if err != nil {
+        return chatgpt.Reply{}, err
+    }
+    defer resp.Body.Close()
+
+    var text strings.Builder
+    var stopReason string
+    var usage anthropicUsage
+    // Tool calls are assembled from the blocks they were started in.
+    var toolCalls []chatgpt.ToolCall
+    toolCallIndex := make(map[int]int)
+    formatBlock := -1
+    err = chatgpt.ReadServerSentEvents(resp.Body, func(event string, data string) error {
+        var streamEvent anthropicStreamEvent
+        if err := json.Unmarshal([]byte(data), &streamEvent); err != nil {
+            return fmt.Errorf("failed to decode stream event: %v", err)
+        }
+        switch streamEvent.Type {
+        case "message_start":
+            usage.InputTokens = streamEvent.Message.Usage.InputTokens
+        case "content_block_start":
+            block := streamEvent.ContentBlock
+            if block.Type == "tool_use" && isResponseFormatTool(request, block.Name) {
+                formatBlock = streamEvent.Index
+            } else if block.Type == "tool_use" {
+                toolCallIndex[streamEvent.Index] = len(toolCalls)
+                toolCalls = append(toolCalls, toToolCall(block, ""))
+            }
+        case "content_block_delta":
+            if streamEvent.Delta.Type == "text_delta" && request.ResponseFormat == nil {
+                text.WriteString(streamEvent.Delta.Text)
+                onDelta(streamEvent.Delta.Text)
+            } else if streamEvent.Delta.Type == "input_json_delta" && streamEvent.Index == formatBlock {
+                text.WriteString(streamEvent.Delta.PartialJSON)
+                onDelta(streamEvent.Delta.PartialJSON)
+            } else if i, ok := toolCallIndex[streamEvent.Index]; ok && streamEvent.Delta.Type == "input_json_delta" {
+                toolCalls[i].Function.Arguments += streamEvent.Delta.PartialJSON
+            }
+        case "message_delta":
+            stopReason = streamEvent.Delta.StopReason
+            usage.OutputTokens = streamEvent.Usage.OutputTokens
+        case "message_stop":
+            return io.EOF
+        case "error":
+            return anthropicStreamError(streamEvent.Error.Type, streamEvent.Error.Message)
+        }
+        return nil
+    })
+    if err != nil {
+        log.Printf("Failed to read response stream: %v", err)
+        return chatgpt.Reply{}, chatgpt.StreamError(ctx, err, text.Len() > 0)
+    }
+    log.Printf("Anthropic stream finished, stop reason: %s, %d bytes, %d tool calls", stopReason, text.Len(), len(toolCalls))
+
+    if text.Len() == 0 && len(toolCalls) == 0 {
+        return chatgpt.Reply{}, fmt.Errorf("no response from Anthropic")
+    }
+    for i := range toolCalls {
+        // A tool without parameters streams no input at all.
+        if toolCalls[i].Function.Arguments == "" {
+            toolCalls[i].Function.Arguments = "{}"
+        }
+    }
+    return chatgpt.Reply{Content: text.String(), ToolCalls: toolCalls, FinishReason: stopReason, Usage: usage.toUsage()}, nil
+}
+
+// post translates the chat completions request into a Messages API request
+// and sends it. System messages are moved into the top-level "system" field,
+// since the Messages API does not accept them in the message list, and tool
+// calls and results become content blocks. The caller must close the body
+// of the returned response.
+func (p *AnthropicProvider) post(ctx context.Context, request chatgpt.ChatGPTRequest, stream bool) (*http.Response, error) {
+    apiKey := os.Getenv("ANTHROPIC_API_KEY")
+    if apiKey == "" {
+        log.Printf("ANTHROPIC_API_KEY environment variable is not set")
+        return nil, fmt.Errorf("ANTHROPIC_API_KEY environment variable is not set")
+    }
+
+    system, messages := toMessages(request.Messages)
+    anthropicReq := anthropicRequest{
+        Model:       request.Model,
+        MaxTokens:   anthropicMaxTokens,
+        Temperature: request.Temperature,
+        System:      system,
+        Messages:    messages,
+        Stream:      stream,
+    }
+    if request.MaxTokens != 0 {
+        anthropicReq.MaxTokens = request.MaxTokens
+    }
+    for _, tool := range request.Tools {
+        anthropicReq.Tools = append(anthropicReq.Tools, anthropicTool{
+            Name:        tool.Function.Name,
+            Description: tool.Function.Description,
+            InputSchema: tool.Function.Parameters,
+        })
+    }
+    if format := request.ResponseFormat; format != nil && format.JSONSchema != nil {
+        anthropicReq.Tools = append(anthropicReq.Tools, anthropicTool{
+            Name:        format.JSONSchema.Name,
+            Description: format.JSONSchema.Description,
+            InputSchema: format.JSONSchema.Schema,
+        })
+        // With other tools available, the model has to call one of them or
+        // reply through the response format tool.
+        if len(request.Tools) > 0 && request.ToolChoice != "none" {
+            anthropicReq.ToolChoice = &anthropicToolChoice{Type: "any"}
+        } else {
+            anthropicReq.ToolChoice = &anthropicToolChoice{Type: "tool", Name: format.JSONSchema.Name}
+        }
+    }
+
+    if request.ToolChoice == "none" && anthropicReq.ToolChoice == nil && len(anthropicReq.Tools) > 0 {
+        anthropicReq.ToolChoice = &anthropicToolChoice{Type: "none"}
+    }
+
+    requestBody, err := json.Marshal(anthropicReq)
+    if err != nil {
+        return nil, err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, "POST", anthropicEndpoint, bytes.NewBuffer(requestBody))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("x-api-key", apiKey)
+    req.Header.Set("anthropic-version", anthropicVersion)
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := chatgpt.Do(req)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
+        return nil, chatgpt.ClassifyHTTPError(resp.StatusCode, resp.Header, body)
+    }
+    return resp, nil
+}
+
+// toMessages converts chat completions messages into the system prompt and
+// the message list of a Messages API request.
+func toMessages(msgs []chatgpt.Message) (string, []anthropicMessage) {
+    var system []string
+    var messages []anthropicMessage
+    for _, msg := range msgs {
+        if msg.Role == "system" {
+            system = append(system, msg.Content)
+            continue
+        }
+        role, blocks := toContentBlocks(msg)
+        // The API rejects messages without content, so empty ones are left
+        // out
+        if len(blocks) == 0 {
+            continue
+        }
+        // Tool results are sent by the user, and all results for one
+        // assistant turn must be in the same message.
+        if n := len(messages); n > 0 && messages[n-1].Role == role {
+            messages[n-1].Content = append(messages[n-1].Content, blocks...)
+            continue
+        }
+        messages = append(messages, anthropicMessage{Role: role, Content: blocks})
+    }
+    return strings.Join(system, "\n\n"), messages
+}
+
+// toContentBlocks converts a chat completions message into the role and
+// content blocks of a Messages API message.
+func toContentBlocks(msg chatgpt.Message) (string, []anthropicContent) {
+    if msg.Role == "tool" {
+        return "user", []anthropicContent{{Type: "tool_result", ToolUseID: msg.ToolCallID, Content: msg.Content}}
+    }
+    // The API rejects empty text blocks
+    var blocks []anthropicContent
+    if msg.Content != "" {
+        blocks = append(blocks, anthropicContent{Type: "text", Text: msg.Content})
+    }
+    for _, call := range msg.ToolCalls {
+        input := json.RawMessage(call.Function.Arguments)
+        if !json.Valid(input) {
+            input = json.RawMessage("{}")
+        }
+        blocks = append(blocks, anthropicContent{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+    }
+    return msg.Role, blocks
+}
+
+// toToolCall converts a tool_use block into a tool call with the given
+// arguments.
+func toToolCall(block anthropicContent, arguments string) chatgpt.ToolCall {
+    return chatgpt.ToolCall{
+        ID:       block.ID,
+        Type:     "function",
+        Function: chatgpt.FunctionCall{Name: block.Name, Arguments: arguments},
+    }
+}
+
+// isResponseFormatTool reports whether the tool named name is the one that
+// stands in for the response format of the request.
+func isResponseFormatTool(request chatgpt.ChatGPTRequest, name string) bool {
+    format := request.ResponseFormat
+    return format != nil && format.JSONSchema != nil && format.JSONSchema.Name == name
+}
+
+// anthropicStreamError classifies an error event sent in the middle of a
+// stream, which arrives after the HTTP status has already been sent.
+func anthropicStreamError(errorType string, message string) *chatgpt.APIError {
+    apiErr := &chatgpt.APIError{Message: errorType + ": " + message}
+    switch errorType {
+    case "overloaded_error":
+        apiErr.Kind = chatgpt.ErrorOverloaded
+    case "rate_limit_error":
+        apiErr.Kind = chatgpt.ErrorRateLimit
+    case "api_error":
+        apiErr.Kind = chatgpt.ErrorServer
+    case "authentication_error", "permission_error":
+        apiErr.Kind = chatgpt.ErrorAuth
+    case "invalid_request_error", "not_found_error", "request_too_large":
+        apiErr.Kind = chatgpt.ErrorBadRequest
+    default:
+        apiErr.Kind = chatgpt.ErrorOther
+    }
+    return apiErr
+}
+
+// toUsage converts the usage block to the chat completions format.
+func (u anthropicUsage) toUsage() chatgpt.Usage {
+    return chatgpt.Usage{
+        PromptTokens:     u.InputTokens,
+        CompletionTokens: u.OutputTokens,
+        TotalTokens:      u.InputTokens + u.OutputTokens,
+    }
+}
@@ -0,0 +1,40 @@
+package llm
+
+import (
+    "testing"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+)
+
+func TestToMessagesSkipsEmptyText(t *testing.T) {
+    call := chatgpt.ToolCall{ID: "call-1", Type: "function", Function: chatgpt.FunctionCall{Name: "read_file", Arguments: `{"path": "main.go"}`}}
+    system, messages := toMessages([]chatgpt.Message{
+        {Role: "system", Content: "Be brief."},
+        {Role: "user", Content: "Fix main.go"},
+        {Role: "assistant", ToolCalls: []chatgpt.ToolCall{call}},
+        {Role: "tool", ToolCallID: "call-1", Content: "package main"},
+        {Role: "assistant"},
+        {Role: "user", Content: "Go on"},
+    })
+    if system != "Be brief." {
+        t.Errorf("system: got %q", system)
+    }
+    // The empty assistant message is left out, so the tool result and the
+    // next user message form one message
+    if len(messages) != 3 {
+        t.Fatalf("got %d messages, want 3: %+v", len(messages), messages)
+    }
+    for _, msg := range messages {
+        for _, block := range msg.Content {
+            if block.Type == "text" && block.Text == "" {
+                t.Errorf("empty text block in %+v", msg)
+            }
+        }
+    }
+    if blocks := messages[1].Content; len(blocks) != 1 || blocks[0].Type != "tool_use" || blocks[0].ID != "call-1" {
+        t.Errorf("tool call: got %+v", blocks)
+    }
+    if blocks := messages[2].Content; messages[2].Role != "user" || len(blocks) != 2 || blocks[0].Type != "tool_result" || blocks[1].Text != "Go on" {
+        t.Errorf("tool result: got %+v", messages[2])
+    }
+}
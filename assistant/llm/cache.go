@@ -0,0 +1,237 @@
+package llm
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+)
+
+// Cache statuses of a reply, see chatgpt.Reply.Cache.
+const (
+    CacheHit  = "hit"
+    CacheMiss = "miss"
+)
+
+const defaultCacheTTL = 24 * time.Hour
+const defaultCacheMaxMB = 500
+
+// cacheEntry is the on-disk format of a cached reply.
+type cacheEntry struct {
+    Provider string        `json:"provider"`
+    Model    string        `json:"model"`
+    Created  time.Time     `json:"created"`
+    Reply    chatgpt.Reply `json:"reply"`
+}
+
+// Several jobs may write to the cache directory at once.
+var cacheMu sync.Mutex
+
+type cacheVariantKey struct{}
+
+// WithCacheVariant returns a context whose requests are cached apart from
+// the same requests made with another variant. Independent candidates of a
+// job send identical requests, and each must get its own reply.
+func WithCacheVariant(ctx context.Context, variant string) context.Context {
+    return context.WithValue(ctx, cacheVariantKey{}, variant)
+}
+
+// ResponseCache wraps a provider and keeps its replies in a directory, one
+// file per request, named by the hash of the provider name and the request.
+// An identical request within the TTL is answered from the file without
+// calling the provider. When the directory grows beyond maxBytes, the least
+// recently used entries are removed.
+type ResponseCache struct {
+    inner    Provider
+    dir      string
+    ttl      time.Duration
+    maxBytes int64
+}
+
+// NewCachedProvider wraps inner in the response cache configured with
+// ASSISTANT_CACHE_DIR, ASSISTANT_CACHE_TTL (a duration like "24h") and
+// ASSISTANT_CACHE_MAX_MB. Without ASSISTANT_CACHE_DIR, inner is returned
+// as is.
+func NewCachedProvider(inner Provider) (Provider, error) {
+    dir := os.Getenv("ASSISTANT_CACHE_DIR")
+    if dir == "" {
+        return inner, nil
+    }
+    ttl, err := time.ParseDuration(getenvDefault("ASSISTANT_CACHE_TTL", defaultCacheTTL.String()))
+    if err != nil {
+        return nil, fmt.Errorf("invalid ASSISTANT_CACHE_TTL: %v", err)
+    }
+    maxMB, err := strconv.Atoi(getenvDefault("ASSISTANT_CACHE_MAX_MB", strconv.Itoa(defaultCacheMaxMB)))
+    if err != nil {
+        return nil, fmt.Errorf("invalid ASSISTANT_CACHE_MAX_MB: %v", err)
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create cache directory: %v", err)
+    }
+    return &ResponseCache{inner: inner, dir: dir, ttl: ttl, maxBytes: int64(maxMB) << 20}, nil
+}
+
+func (c *ResponseCache) Name() string {
+    return c.inner.Name()
+}
+
+func (c *ResponseCache) DefaultModel() string {
+    return c.inner.DefaultModel()
+}
+
+func (c *ResponseCache) SupportsStructuredOutput() bool {
+    return c.inner.SupportsStructuredOutput()
+}
+
+func (c *ResponseCache) SupportsTools() bool {
+    return c.inner.SupportsTools()
+}
+
+func (c *ResponseCache) SendRequest(ctx context.Context, request chatgpt.ChatGPTRequest) (chatgpt.Reply, error) {
+    key := c.key(ctx, request)
+    if reply, ok := c.lookup(key); ok {
+        return reply, nil
+    }
+    reply, err := c.inner.SendRequest(ctx, request)
+    if err != nil {
+        return reply, err
+    }
+    c.store(key, request, reply)
+    reply.Cache = CacheMiss
+    return reply, nil
+}
+
+// StreamRequest delivers a cached reply line by line, like a replayed
+// cassette.
+func (c *ResponseCache) StreamRequest(ctx context.Context, request chatgpt.ChatGPTRequest, onDelta func(delta string)) (chatgpt.Reply, error) {
+    key := c.key(ctx, request)
+    if reply, ok := c.lookup(key); ok {
+        streamReply(reply, onDelta)
+        return reply, nil
+    }
+    reply, err := c.inner.StreamRequest(ctx, request, onDelta)
+    if err != nil {
+        return reply, err
+    }
+    c.store(key, request, reply)
+    reply.Cache = CacheMiss
+    return reply, nil
+}
+
+// key identifies a request to this provider, in the cache variant of ctx.
+// Streamed and non-streamed requests share entries, see RequestKey.
+func (c *ResponseCache) key(ctx context.Context, request chatgpt.ChatGPTRequest) string {
+    identity := c.inner.Name() + "\n" + RequestKey(request)
+    if variant, _ := ctx.Value(cacheVariantKey{}).(string); variant != "" {
+        identity += "\n" + variant
+    }
+    hash := sha256.Sum256([]byte(identity))
+    return hex.EncodeToString(hash[:])
+}
+
+// lookup returns the cached reply for key if there is one within the TTL.
+func (c *ResponseCache) lookup(key string) (chatgpt.Reply, bool) {
+    cacheMu.Lock()
+    defer cacheMu.Unlock()
+
+    path := filepath.Join(c.dir, key+".json")
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        log.Printf("Cache miss for request %s", key[:12])
+        return chatgpt.Reply{}, false
+    }
+    var entry cacheEntry
+    if err := json.Unmarshal(content, &entry); err != nil {
+        log.Printf("Removing unreadable cache entry %s: %v", path, err)
+        os.Remove(path)
+        return chatgpt.Reply{}, false
+    }
+    if age := time.Since(entry.Created); age > c.ttl {
+        log.Printf("Cache entry for request %s expired %s ago", key[:12], (age - c.ttl).Round(time.Second))
+        os.Remove(path)
+        return chatgpt.Reply{}, false
+    }
+
+    // Mark the entry as recently used, so it is evicted last
+    now := time.Now()
+    os.Chtimes(path, now, now)
+    log.Printf("Cache hit for request %s, cached %s ago", key[:12], time.Since(entry.Created).Round(time.Second))
+    entry.Reply.Cache = CacheHit
+    return entry.Reply, true
+}
+
+// store saves a reply and evicts old entries if the cache is too large.
+// Failures only cost a future cache hit, so they are logged and ignored.
+func (c *ResponseCache) store(key string, request chatgpt.ChatGPTRequest, reply chatgpt.Reply) {
+    content, err := json.Marshal(cacheEntry{
+        Provider: c.inner.Name(),
+        Model:    request.Model,
+        Created:  time.Now(),
+        Reply:    reply,
+    })
+    if err != nil {
+        log.Printf("Failed to encode cache entry: %v", err)
+        return
+    }
+
+    cacheMu.Lock()
+    defer cacheMu.Unlock()
+
+    // Write to a temporary file first, so that readers never see a
+    // partially written entry
+    path := filepath.Join(c.dir, key+".json")
+    if err := ioutil.WriteFile(path+".tmp", content, 0644); err != nil {
+        log.Printf("Failed to write cache entry: %v", err)
+        return
+    }
+    if err := os.Rename(path+".tmp", path); err != nil {
+        log.Printf("Failed to write cache entry: %v", err)
+        return
+    }
+    log.Printf("Cached reply for request %s", key[:12])
+    c.evict()
+}
+
+// evict removes the least recently used entries until the cache fits into
+// maxBytes. The caller must hold cacheMu.
+func (c *ResponseCache) evict() {
+    files, err := ioutil.ReadDir(c.dir)
+    if err != nil {
+        log.Printf("Failed to list cache directory: %v", err)
+        return
+    }
+    var entries []os.FileInfo
+    var total int64
+    for _, file := range files {
+        if strings.HasSuffix(file.Name(), ".json") && file.Mode().IsRegular() {
+            entries = append(entries, file)
+            total += file.Size()
+        }
+    }
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].ModTime().Before(entries[j].ModTime())
+    })
+    for _, file := range entries {
+        if total <= c.maxBytes {
+            break
+        }
+        if err := os.Remove(filepath.Join(c.dir, file.Name())); err != nil {
+            log.Printf("Failed to evict cache entry %s: %v", file.Name(), err)
+            continue
+        }
+        total -= file.Size()
+        log.Printf("Evicted cache entry %s", file.Name())
+    }
+}
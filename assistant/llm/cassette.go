@@ -0,0 +1,225 @@
+package llm
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "strings"
+    "sync"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+)
+
+// Cassette modes.
+const (
+    CassetteRecord = "record" // Send requests to the real provider and save them
+    CassetteReplay = "replay" // Serve saved replies without any network access
+)
+
+// Interaction is one recorded request and the reply it got.
+type Interaction struct {
+    Key      string                 `json:"key"`
+    Provider string                 `json:"provider"`
+    Request  chatgpt.ChatGPTRequest `json:"request"`
+    Reply    chatgpt.Reply          `json:"reply"`
+}
+
+// cassetteFile is the on-disk format of a cassette.
+type cassetteFile struct {
+    Interactions []Interaction `json:"interactions"`
+}
+
+// Several jobs may record into the same cassette at once. A cassette is
+// emptied when the first of them starts recording, so that it holds the
+// interactions of this run only; recordedCassettes are the paths emptied.
+var cassetteWriteMu sync.Mutex
+var recordedCassettes = make(map[string]bool)
+
+// Cassette wraps a provider and records its interactions to a file, or
+// replays them from the file without calling the provider at all. This
+// allows running ProcessAssistant end-to-end in tests, without network
+// access or API keys, against real captured model output.
+//
+// Replayed requests are matched on their whole content, see RequestKey:
+// the model and messages, but also the tools, the response format and the
+// sampling parameters. If the same request was recorded several times (e.g.
+// by the retry loop), the replies are served in the order they were
+// recorded.
+type Cassette struct {
+    inner Provider
+    path  string
+    mode  string
+
+    mu   sync.Mutex
+    tape []Interaction
+    used map[int]bool // Indexes of replayed interactions
+}
+
+// NewCassette returns a cassette around inner that records to or replays
+// from the file at path.
+func NewCassette(inner Provider, path string, mode string) (*Cassette, error) {
+    c := &Cassette{inner: inner, path: path, mode: mode, used: make(map[int]bool)}
+    switch mode {
+    case CassetteRecord:
+        cassetteWriteMu.Lock()
+        defer cassetteWriteMu.Unlock()
+        if !recordedCassettes[path] {
+            if err := writeCassette(path, cassetteFile{}); err != nil {
+                return nil, err
+            }
+            recordedCassettes[path] = true
+        }
+        log.Printf("Recording model interactions to %s", path)
+    case CassetteReplay:
+        file, err := readCassette(path)
+        if err != nil {
+            return nil, err
+        }
+        c.tape = file.Interactions
+        log.Printf("Replaying %d model interactions from %s", len(c.tape), path)
+    default:
+        return nil, fmt.Errorf("unknown cassette mode %q", mode)
+    }
+    return c, nil
+}
+
+func (c *Cassette) Name() string {
+    return c.inner.Name()
+}
+
+func (c *Cassette) DefaultModel() string {
+    return c.inner.DefaultModel()
+}
+
+func (c *Cassette) SupportsStructuredOutput() bool {
+    return c.inner.SupportsStructuredOutput()
+}
+
+func (c *Cassette) SupportsTools() bool {
+    return c.inner.SupportsTools()
+}
+
+func (c *Cassette) SendRequest(ctx context.Context, request chatgpt.ChatGPTRequest) (chatgpt.Reply, error) {
+    if c.mode == CassetteReplay {
+        return c.replay(request)
+    }
+    reply, err := c.inner.SendRequest(ctx, request)
+    if err != nil {
+        return reply, err
+    }
+    return reply, c.record(request, reply)
+}
+
+// StreamRequest replays a recorded reply line by line, so that the
+// streaming code paths are exercised as well.
+func (c *Cassette) StreamRequest(ctx context.Context, request chatgpt.ChatGPTRequest, onDelta func(delta string)) (chatgpt.Reply, error) {
+    if c.mode == CassetteReplay {
+        reply, err := c.replay(request)
+        if err != nil {
+            return reply, err
+        }
+        streamReply(reply, onDelta)
+        return reply, nil
+    }
+    reply, err := c.inner.StreamRequest(ctx, request, onDelta)
+    if err != nil {
+        return reply, err
+    }
+    return reply, c.record(request, reply)
+}
+
+// streamReply delivers a reply that is already complete to onDelta line by
+// line, like a streamed one.
+func streamReply(reply chatgpt.Reply, onDelta func(delta string)) {
+    for _, line := range strings.SplitAfter(reply.Content, "\n") {
+        if line != "" {
+            onDelta(line)
+        }
+    }
+}
+
+// replay returns the first unused recorded reply for request.
+func (c *Cassette) replay(request chatgpt.ChatGPTRequest) (chatgpt.Reply, error) {
+    key := RequestKey(request)
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for i, interaction := range c.tape {
+        if interaction.Key == key && !c.used[i] {
+            c.used[i] = true
+            log.Printf("Replaying interaction %d from %s", i, c.path)
+            return interaction.Reply, nil
+        }
+    }
+    return chatgpt.Reply{}, fmt.Errorf("cassette %s has no unused interaction for request %s (model %s, %d messages)",
+        c.path, key[:12], request.Model, len(request.Messages))
+}
+
+// record appends an interaction to the cassette file, which NewCassette
+// emptied. The file is rewritten after every interaction, so a crashed job
+// still leaves a usable cassette.
+func (c *Cassette) record(request chatgpt.ChatGPTRequest, reply chatgpt.Reply) error {
+    cassetteWriteMu.Lock()
+    defer cassetteWriteMu.Unlock()
+
+    file, err := readCassette(c.path)
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    request.Stream = false
+    request.StreamOptions = nil
+    file.Interactions = append(file.Interactions, Interaction{
+        Key:      RequestKey(request),
+        Provider: c.inner.Name(),
+        Request:  request,
+        Reply:    reply,
+    })
+
+    if err := writeCassette(c.path, file); err != nil {
+        return err
+    }
+    log.Printf("Recorded interaction %d to %s", len(file.Interactions)-1, c.path)
+    return nil
+}
+
+// RequestKey identifies a request by a hash of all of its fields, except
+// those that ask for streaming. Whether the request was streamed does not
+// matter, so that recordings made with
+// streaming can be replayed by SendRequest and vice versa.
+func RequestKey(request chatgpt.ChatGPTRequest) string {
+    request.Stream = false
+    request.StreamOptions = nil
+    content, _ := json.Marshal(request)
+    hash := sha256.Sum256(content)
+    return hex.EncodeToString(hash[:])
+}
+
+// readCassette loads a cassette file. A missing file is returned as an
+// empty cassette together with the os.IsNotExist error.
+func readCassette(path string) (cassetteFile, error) {
+    var file cassetteFile
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return file, err
+    }
+    if err := json.Unmarshal(content, &file); err != nil {
+        return file, fmt.Errorf("failed to parse cassette %s: %v", path, err)
+    }
+    return file, nil
+}
+
+// writeCassette saves a cassette file.
+func writeCassette(path string, file cassetteFile) error {
+    content, err := json.MarshalIndent(file, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := ioutil.WriteFile(path, content, 0644); err != nil {
+        return fmt.Errorf("failed to write cassette: %v", err)
+    }
+    return nil
+}
@@ -0,0 +1,99 @@
+package llm
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+)
+
+// scriptedProvider answers requests with its replies in turn.
+type scriptedProvider struct {
+    replies []string
+}
+
+func (p *scriptedProvider) Name() string                   { return "scripted" }
+func (p *scriptedProvider) DefaultModel() string           { return "model" }
+func (p *scriptedProvider) SupportsStructuredOutput() bool { return false }
+func (p *scriptedProvider) SupportsTools() bool            { return false }
+
+func (p *scriptedProvider) SendRequest(ctx context.Context, request chatgpt.ChatGPTRequest) (chatgpt.Reply, error) {
+    reply := chatgpt.Reply{Content: p.replies[0], FinishReason: "stop"}
+    p.replies = p.replies[1:]
+    return reply, nil
+}
+
+func (p *scriptedProvider) StreamRequest(ctx context.Context, request chatgpt.ChatGPTRequest, onDelta func(delta string)) (chatgpt.Reply, error) {
+    reply, err := p.SendRequest(ctx, request)
+    onDelta(reply.Content)
+    return reply, err
+}
+
+func TestCassetteRecordAndReplay(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "cassette.json")
+    // A cassette from an earlier run is replaced, not appended to
+    stale := cassetteFile{Interactions: []Interaction{{Key: "stale", Reply: chatgpt.Reply{Content: "old"}}}}
+    if err := writeCassette(path, stale); err != nil {
+        t.Fatal(err)
+    }
+
+    ctx := context.Background()
+    question := chatgpt.ChatGPTRequest{Model: "model", Messages: []chatgpt.Message{{Role: "user", Content: "hi"}}}
+    warmer := question
+    temperature := 0.5
+    warmer.Temperature = &temperature
+
+    recorder, err := NewCassette(&scriptedProvider{replies: []string{"first\nreply\n", "second", "warm"}}, path, CassetteRecord)
+    if err != nil {
+        t.Fatalf("NewCassette: %v", err)
+    }
+    for _, request := range []chatgpt.ChatGPTRequest{question, question, warmer} {
+        if _, err := recorder.SendRequest(ctx, request); err != nil {
+            t.Fatalf("SendRequest: %v", err)
+        }
+    }
+    // Other jobs of the same run add to the cassette
+    if _, err := NewCassette(&scriptedProvider{}, path, CassetteRecord); err != nil {
+        t.Fatalf("NewCassette: %v", err)
+    }
+    file, err := readCassette(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(file.Interactions) != 3 || file.Interactions[0].Reply.Content != "first\nreply\n" {
+        t.Fatalf("recorded %+v", file.Interactions)
+    }
+
+    player, err := NewCassette(&scriptedProvider{}, path, CassetteReplay)
+    if err != nil {
+        t.Fatalf("NewCassette: %v", err)
+    }
+    // Repeated requests get their replies in order, streamed or not
+    streamed := question
+    streamed.Stream = true
+    streamed.StreamOptions = &chatgpt.StreamOptions{IncludeUsage: true}
+    var deltas []string
+    reply, err := player.StreamRequest(ctx, streamed, func(delta string) {
+        deltas = append(deltas, delta)
+    })
+    if err != nil || reply.Content != "first\nreply\n" || strings.Join(deltas, "|") != "first\n|reply\n" {
+        t.Errorf("first replay: got %q, %v, deltas %q", reply.Content, err, deltas)
+    }
+    if reply, err := player.SendRequest(ctx, question); err != nil || reply.Content != "second" {
+        t.Errorf("second replay: got %q, %v", reply.Content, err)
+    }
+    // The sampling parameters are part of the key
+    if reply, err := player.SendRequest(ctx, warmer); err != nil || reply.Content != "warm" {
+        t.Errorf("replay with a temperature: got %q, %v", reply.Content, err)
+    }
+    if _, err := player.SendRequest(ctx, question); err == nil {
+        t.Error("a used interaction was replayed again")
+    }
+
+    if _, err := NewCassette(&scriptedProvider{}, filepath.Join(t.TempDir(), "missing.json"), CassetteReplay); !os.IsNotExist(err) {
+        t.Errorf("replaying a missing cassette: got %v", err)
+    }
+}
@@ -0,0 +1,85 @@
+package llm
+
+import (
+    "context"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+)
+
+// Ollama serves its OpenAI-compatible API on port 11434; llama.cpp's server
+// can be used by pointing LOCAL_LLM_ENDPOINT at it.
+const defaultLocalEndpoint = "http://localhost:11434/v1/chat/completions"
+const defaultLocalModel = "llama3.1"
+
+// OpenAIProvider talks to the OpenAI chat completions API.
+type OpenAIProvider struct{}
+
+func (p *OpenAIProvider) Name() string {
+    return "openai"
+}
+
+func (p *OpenAIProvider) DefaultModel() string {
+    return chatgpt.DefaultModel
+}
+
+func (p *OpenAIProvider) SupportsStructuredOutput() bool {
+    return true
+}
+
+func (p *OpenAIProvider) SupportsTools() bool {
+    return true
+}
+
+func (p *OpenAIProvider) SendRequest(ctx context.Context, request chatgpt.ChatGPTRequest) (chatgpt.Reply, error) {
+    return chatgpt.SendRequest(ctx, openAIRequest(request))
+}
+
+func (p *OpenAIProvider) StreamRequest(ctx context.Context, request chatgpt.ChatGPTRequest, onDelta func(delta string)) (chatgpt.Reply, error) {
+    return chatgpt.StreamRequest(ctx, openAIRequest(request), onDelta)
+}
+
+// openAIRequest moves the reply limit to max_completion_tokens. OpenAI has
+// deprecated max_tokens and reasoning models reject it, while local servers
+// only know max_tokens.
+func openAIRequest(request chatgpt.ChatGPTRequest) chatgpt.ChatGPTRequest {
+    if request.MaxTokens != 0 {
+        request.MaxCompletionTokens = request.MaxTokens
+        request.MaxTokens = 0
+    }
+    return request
+}
+
+// LocalProvider talks to any server implementing the OpenAI chat completions
+// API, such as llama.cpp server or Ollama. Code sent to it does not leave
+// the machine (or the network the server runs in).
+type LocalProvider struct {
+    Endpoint         string
+    Model            string
+    APIKey           string
+    StructuredOutput bool
+    Tools            bool
+}
+
+func (p *LocalProvider) Name() string {
+    return "local"
+}
+
+func (p *LocalProvider) DefaultModel() string {
+    return p.Model
+}
+
+func (p *LocalProvider) SupportsStructuredOutput() bool {
+    return p.StructuredOutput
+}
+
+func (p *LocalProvider) SupportsTools() bool {
+    return p.Tools
+}
+
+func (p *LocalProvider) SendRequest(ctx context.Context, request chatgpt.ChatGPTRequest) (chatgpt.Reply, error) {
+    return chatgpt.SendRequestTo(ctx, p.Endpoint, p.APIKey, request)
+}
+
+func (p *LocalProvider) StreamRequest(ctx context.Context, request chatgpt.ChatGPTRequest, onDelta func(delta string)) (chatgpt.Reply, error) {
+    return chatgpt.StreamRequestTo(ctx, p.Endpoint, p.APIKey, request, onDelta)
+}
@@ -0,0 +1,172 @@
+package llm
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "strings"
+    "sync"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+    "github.com/thomasdullien/coding-assistant/assistant/tokens"
+    "github.com/thomasdullien/coding-assistant/assistant/types"
+)
+
+// modelCapabilities describes which sampling parameters a model accepts.
+type modelCapabilities struct {
+    MaxTemperature   float64  // 0 if the temperature cannot be set
+    Seed             bool     // Whether a seed can be set
+    ReasoningEfforts []string // Accepted reasoning efforts, empty for non-reasoning models
+}
+
+var standardEfforts = []string{"low", "medium", "high"}
+
+// modelCapabilityTable maps model name prefixes to their capabilities. The
+// first matching prefix wins, so more specific prefixes come first.
+var modelCapabilityTable = []struct {
+    prefix string
+    caps   modelCapabilities
+}{
+    {"gpt-5-chat", modelCapabilities{2, true, nil}},
+    {"gpt-5", modelCapabilities{0, true, append([]string{"minimal"}, standardEfforts...)}},
+    {"o1", modelCapabilities{0, true, standardEfforts}},
+    {"o3", modelCapabilities{0, true, standardEfforts}},
+    {"o4-mini", modelCapabilities{0, true, standardEfforts}},
+    {"gpt-", modelCapabilities{2, true, nil}},
+    {"claude", modelCapabilities{1, false, nil}},
+}
+
+// defaultCapabilities is used for models we know nothing about, mostly
+// local ones. llama.cpp and Ollama accept a temperature and a seed.
+var defaultCapabilities = modelCapabilities{2, true, nil}
+
+func capabilitiesFor(model string) modelCapabilities {
+    for _, entry := range modelCapabilityTable {
+        if strings.HasPrefix(model, entry.prefix) {
+            return entry.caps
+        }
+    }
+    return defaultCapabilities
+}
+
+var serverParamsMu sync.Mutex
+var serverParams = map[string]types.ModelParams{}
+
+// LoadServerParams reads a JSON file with the default model parameters of
+// each provider, for example
+// {"openai": {"model": "gpt-4.1-mini", "escalation": ["gpt-4.1", "o3"]}, "anthropic": {"max_tokens": 8192}}.
+// Parameters set by a job take precedence.
+func LoadServerParams(path string) error {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("failed to read model configuration: %v", err)
+    }
+    var loaded map[string]types.ModelParams
+    decoder := json.NewDecoder(bytes.NewReader(content))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&loaded); err != nil {
+        return fmt.Errorf("failed to parse model configuration %s: %v", path, err)
+    }
+    for name := range loaded {
+        if _, err := newBaseProvider(name); err != nil {
+            return fmt.Errorf("model configuration %s: %v", path, err)
+        }
+    }
+
+    serverParamsMu.Lock()
+    defer serverParamsMu.Unlock()
+    serverParams = loaded
+    return nil
+}
+
+// ResolveParams fills in the parameters the job did not set from the server
+// configuration and the provider's default model, and checks that every
+// model of the escalation ladder accepts them. All problems are reported
+// together.
+func ResolveParams(provider Provider, job types.ModelParams) (types.ModelParams, error) {
+    serverParamsMu.Lock()
+    params := serverParams[provider.Name()]
+    serverParamsMu.Unlock()
+
+    if job.Model != "" {
+        params.Model = job.Model
+    }
+    if job.Temperature != nil {
+        params.Temperature = job.Temperature
+    }
+    if job.MaxTokens != 0 {
+        params.MaxTokens = job.MaxTokens
+    }
+    if job.Seed != nil {
+        params.Seed = job.Seed
+    }
+    if job.ReasoningEffort != "" {
+        params.ReasoningEffort = job.ReasoningEffort
+    }
+    if len(job.Escalation) > 0 {
+        params.Escalation = job.Escalation
+    }
+    if params.Model == "" {
+        params.Model = provider.DefaultModel()
+    }
+
+    var problems []string
+    for i, model := range params.Ladder() {
+        if model == "" {
+            problems = append(problems, fmt.Sprintf("escalation model %d is empty", i))
+            continue
+        }
+        problems = append(problems, checkParams(model, params)...)
+    }
+
+    if len(problems) > 0 {
+        return params, fmt.Errorf("invalid model parameters: %s", strings.Join(problems, "; "))
+    }
+    return params, nil
+}
+
+// checkParams returns the problems model has with the sampling parameters.
+func checkParams(model string, params types.ModelParams) []string {
+    var problems []string
+    caps := capabilitiesFor(model)
+    if t := params.Temperature; t != nil {
+        if caps.MaxTemperature == 0 {
+            problems = append(problems, fmt.Sprintf("%s does not accept a temperature", model))
+        } else if *t < 0 || *t > caps.MaxTemperature {
+            problems = append(problems, fmt.Sprintf("temperature %g is outside 0 to %g for %s", *t, caps.MaxTemperature, model))
+        }
+    }
+    if maxOutput := tokens.LimitsFor(model).MaxOutput; params.MaxTokens < 0 || params.MaxTokens > maxOutput {
+        problems = append(problems, fmt.Sprintf("max tokens %d is outside 1 to %d for %s", params.MaxTokens, maxOutput, model))
+    }
+    if params.Seed != nil && !caps.Seed {
+        problems = append(problems, fmt.Sprintf("%s does not accept a seed", model))
+    }
+    if effort := params.ReasoningEffort; effort != "" {
+        if len(caps.ReasoningEfforts) == 0 {
+            problems = append(problems, fmt.Sprintf("%s is not a reasoning model and does not accept a reasoning effort", model))
+        } else if !contains(caps.ReasoningEfforts, effort) {
+            problems = append(problems, fmt.Sprintf("reasoning effort %q is not one of %s for %s", effort, strings.Join(caps.ReasoningEfforts, ", "), model))
+        }
+    }
+    return problems
+}
+
+// ApplyParams sets the model and sampling parameters of a request.
+func ApplyParams(request *chatgpt.ChatGPTRequest, params types.ModelParams) {
+    request.Model = params.Model
+    request.Temperature = params.Temperature
+    request.MaxTokens = params.MaxTokens
+    request.Seed = params.Seed
+    request.ReasoningEffort = params.ReasoningEffort
+}
+
+func contains(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,79 @@
+package llm
+
+import (
+    "context"
+    "fmt"
+    "os"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+)
+
+// Provider is implemented by every LLM backend the assistant can talk to.
+// Requests and messages use the chat completions types from the chatgpt
+// package; providers with a different wire format translate them.
+type Provider interface {
+    // Name returns the identifier used to select the provider, e.g. "openai".
+    Name() string
+    // DefaultModel returns the model used if the job does not specify one.
+    DefaultModel() string
+    // SupportsStructuredOutput reports whether requests with a
+    // ResponseFormat are honored, so that the reply is JSON matching it.
+    SupportsStructuredOutput() bool
+    // SupportsTools reports whether requests with Tools are honored, so that
+    // the reply may contain tool calls.
+    SupportsTools() bool
+    // SendRequest sends the request and returns the reply and its token
+    // usage. Transient errors are retried until ctx is done.
+    SendRequest(ctx context.Context, request chatgpt.ChatGPTRequest) (chatgpt.Reply, error)
+    // StreamRequest sends the request, calls onDelta with each piece of the
+    // reply as it is generated, and returns the complete reply.
+    StreamRequest(ctx context.Context, request chatgpt.ChatGPTRequest, onDelta func(delta string)) (chatgpt.Reply, error)
+}
+
+// NewProvider returns the provider with the given name. An empty name selects
+// OpenAI, which was the only backend before providers became pluggable.
+// If ASSISTANT_CASSETTE names a cassette file, the provider records to or
+// replays from it, depending on ASSISTANT_CASSETTE_MODE.
+func NewProvider(name string) (Provider, error) {
+    provider, err := newBaseProvider(name)
+    if err != nil {
+        return nil, err
+    }
+    if path := os.Getenv("ASSISTANT_CASSETTE"); path != "" {
+        return NewCassette(provider, path, getenvDefault("ASSISTANT_CASSETTE_MODE", CassetteReplay))
+    }
+    return provider, nil
+}
+
+// newBaseProvider returns the provider that talks to the named API.
+func newBaseProvider(name string) (Provider, error) {
+    switch name {
+    case "", "openai":
+        return &OpenAIProvider{}, nil
+    case "anthropic":
+        return &AnthropicProvider{
+            Model: getenvDefault("ANTHROPIC_MODEL", defaultAnthropicModel),
+        }, nil
+    case "local":
+        return &LocalProvider{
+            Endpoint:         getenvDefault("LOCAL_LLM_ENDPOINT", defaultLocalEndpoint),
+            Model:            getenvDefault("LOCAL_LLM_MODEL", defaultLocalModel),
+            APIKey:           os.Getenv("LOCAL_LLM_API_KEY"),
+            // Recent llama.cpp and Ollama versions honor response_format
+            // json_schema, older ones ignore it.
+            StructuredOutput: os.Getenv("LOCAL_LLM_STRUCTURED_OUTPUT") == "true",
+            // Tool calling depends on the model as much as on the server.
+            Tools:            os.Getenv("LOCAL_LLM_TOOLS") == "true",
+        }, nil
+    }
+    return nil, fmt.Errorf("unknown LLM provider %q", name)
+}
+
+// getenvDefault returns the value of the environment variable key, or def if
+// it is unset or empty.
+func getenvDefault(key string, def string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return def
+}
@@ -0,0 +1,66 @@
+package llm
+
+import (
+    "context"
+
+    "github.com/thomasdullien/coding-assistant/assistant/chatgpt"
+    "github.com/thomasdullien/coding-assistant/assistant/redact"
+)
+
+// RedactingProvider wraps a provider and masks the secrets in every
+// message before the request leaves the machine, so nothing slips through
+// that was not redacted where it was read. The reply keeps the
+// placeholders; they are restored when files are written.
+type RedactingProvider struct {
+    inner    Provider
+    redactor *redact.Redactor
+}
+
+// NewRedactingProvider wraps inner, masking secrets with redactor.
+func NewRedactingProvider(inner Provider, redactor *redact.Redactor) *RedactingProvider {
+    return &RedactingProvider{inner: inner, redactor: redactor}
+}
+
+func (p *RedactingProvider) Name() string {
+    return p.inner.Name()
+}
+
+func (p *RedactingProvider) DefaultModel() string {
+    return p.inner.DefaultModel()
+}
+
+func (p *RedactingProvider) SupportsStructuredOutput() bool {
+    return p.inner.SupportsStructuredOutput()
+}
+
+func (p *RedactingProvider) SupportsTools() bool {
+    return p.inner.SupportsTools()
+}
+
+func (p *RedactingProvider) SendRequest(ctx context.Context, request chatgpt.ChatGPTRequest) (chatgpt.Reply, error) {
+    return p.inner.SendRequest(ctx, p.redactRequest(request))
+}
+
+func (p *RedactingProvider) StreamRequest(ctx context.Context, request chatgpt.ChatGPTRequest, onDelta func(delta string)) (chatgpt.Reply, error) {
+    return p.inner.StreamRequest(ctx, p.redactRequest(request), onDelta)
+}
+
+// redactRequest returns a copy of request with the secrets of all messages
+// and tool calls masked.
+func (p *RedactingProvider) redactRequest(request chatgpt.ChatGPTRequest) chatgpt.ChatGPTRequest {
+    messages := make([]chatgpt.Message, len(request.Messages))
+    for i, msg := range request.Messages {
+        msg.Content = p.redactor.Redact(msg.Content)
+        if len(msg.ToolCalls) > 0 {
+            calls := make([]chatgpt.ToolCall, len(msg.ToolCalls))
+            for j, call := range msg.ToolCalls {
+                call.Function.Arguments = p.redactor.Redact(call.Function.Arguments)
+                calls[j] = call
+            }
+            msg.ToolCalls = calls
+        }
+        messages[i] = msg
+    }
+    request.Messages = messages
+    return request
+}
@@ -2,10 +2,37 @@ package main
 
 import (
     "fmt"
+    "log"
+    "os"
+
+    "github.com/thomasdullien/coding-assistant/assistant/cost"
+    "github.com/thomasdullien/coding-assistant/assistant/llm"
+    "github.com/thomasdullien/coding-assistant/assistant/redact"
     "github.com/thomasdullien/coding-assistant/assistant/web"
 )
 
 func main() {
+    // Prices of models not in the built-in table, or changed prices
+    if path := os.Getenv("ASSISTANT_PRICES"); path != "" {
+        if err := cost.LoadPrices(path); err != nil {
+            log.Fatalf("Failed to load prices: %v", err)
+        }
+    }
+
+    // Default model and sampling parameters of each provider
+    if path := os.Getenv("ASSISTANT_MODEL_CONFIG"); path != "" {
+        if err := llm.LoadServerParams(path); err != nil {
+            log.Fatalf("Failed to load model configuration: %v", err)
+        }
+    }
+
+    // Additional patterns of secrets to mask before sending, and known non-secrets
+    if path := os.Getenv("ASSISTANT_REDACT_CONFIG"); path != "" {
+        if err := redact.LoadConfig(path); err != nil {
+            log.Fatalf("Failed to load redaction configuration: %v", err)
+        }
+    }
+
     fmt.Println("Starting ASSISTANT on localhost:8080")
     web.ServeWebInterface()
 }
\ No newline at end of file
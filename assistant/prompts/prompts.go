@@ -0,0 +1,155 @@
+// Package prompts renders the system prompt of a job from the templates in
+// prompts/templates. The prompt is put together from named templates:
+//
+//   - "system", the whole prompt, from system.tmpl
+//   - "format", how to format the reply, from markers.tmpl, diff.tmpl,
+//     blocks.tmpl, declarations.tmpl or json.tmpl
+//   - "description", how to describe the change in the marker, diff, block
+//     and declaration formats, from system.tmpl
+//   - "operations", how to delete and rename files in the marker, block and
+//     declaration formats, from system.tmpl
+//   - "rules", the rules for every job, from system.tmpl
+//   - "language", the rules for the repository type, e.g. from go.tmpl
+//   - "extra", empty by default
+//
+// A repository can check in .assistant/prompt.tmpl to change the prompt of
+// its jobs. The file is parsed after the built-in templates, so it can
+// extend the prompt by defining "extra", or override any of the other
+// templates by defining it again.
+package prompts
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "text/template"
+
+    "github.com/thomasdullien/coding-assistant/assistant/tokens"
+)
+
+// TemplateDir holds the built-in templates, relative to the working
+// directory like the web templates.
+const TemplateDir = "prompts/templates"
+
+// RepoTemplate is the path of the prompt template a repository can check in.
+const RepoTemplate = ".assistant/prompt.tmpl"
+
+// conventionFiles are the files, relative to the repository root, that may
+// describe the coding conventions of a repository. The first one found is
+// used.
+var conventionFiles = []string{".assistant/conventions.md", "CONVENTIONS.md"}
+
+// Conventions are cut to this many tokens, so that they cannot crowd out
+// the files in the prompt.
+const maxConventionsTokens = 2000
+
+// languages maps the repository types of the web form to the language
+// name used in the prompt and its template.
+var languages = map[string]struct {
+    name      string
+    fileKinds string
+    template  string
+}{
+    "C++":    {"C++", ".cpp or .hpp", "cpp.tmpl"},
+    "Golang": {"Go", ".go", "go.tmpl"},
+}
+
+// formatTemplates maps the reply formats to their templates.
+var formatTemplates = map[string]string{
+    "markers":      "markers.tmpl",
+    "diff":         "diff.tmpl",
+    "blocks":       "blocks.tmpl",
+    "declarations": "declarations.tmpl",
+    "json":         "json.tmpl",
+}
+
+// Data holds the template variables.
+type Data struct {
+    Language    string   // e.g. "Go"
+    RepoType    string   // As selected on the form, e.g. "Golang"
+    FileKinds   string   // The kind of files to reply with, e.g. ".go"
+    Format      string   // "markers", "diff", "blocks", "declarations" or "json"
+    Files       []string // The files the user asked to change
+    Conventions string   // The coding conventions of the repository, may be empty
+}
+
+// System renders the system prompt for a job on the repository cloned to
+// repoDir, with the instructions for the reply format: "markers" for whole
+// files between file markers, "diff" for unified diffs, "blocks" for
+// search/replace blocks, "declarations" for the changed declarations of Go
+// and C++ files, or "json" for structured output.
+func System(repoDir string, repoType string, files []string, format string) (string, error) {
+    data := Data{
+        Language:  "C++ and Golang",
+        RepoType:  repoType,
+        FileKinds: "source",
+        Format:    format,
+    }
+    languageTemplate := "generic.tmpl"
+    if language, ok := languages[repoType]; ok {
+        data.Language = language.name
+        data.FileKinds = language.fileKinds
+        languageTemplate = language.template
+    }
+    formatTemplate, ok := formatTemplates[format]
+    if !ok {
+        return "", fmt.Errorf("unknown reply format %q", format)
+    }
+    for _, file := range files {
+        data.Files = append(data.Files, "repo/"+strings.TrimPrefix(file, "repo/"))
+    }
+    conventions, err := readConventions(repoDir)
+    if err != nil {
+        return "", err
+    }
+    data.Conventions = conventions
+
+    // Parse the built-in templates, then the repository's own
+    tmpl := template.New("prompt")
+    for _, name := range []string{"system.tmpl", formatTemplate, languageTemplate} {
+        content, err := ioutil.ReadFile(filepath.Join(TemplateDir, name))
+        if err != nil {
+            return "", fmt.Errorf("failed to read prompt template: %v", err)
+        }
+        if _, err := tmpl.Parse(string(content)); err != nil {
+            return "", fmt.Errorf("failed to parse prompt template %s: %v", name, err)
+        }
+    }
+    content, err := ioutil.ReadFile(filepath.Join(repoDir, RepoTemplate))
+    if err == nil {
+        if _, err := tmpl.Parse(string(content)); err != nil {
+            return "", fmt.Errorf("failed to parse %s of the repository: %v", RepoTemplate, err)
+        }
+    } else if !os.IsNotExist(err) {
+        return "", fmt.Errorf("failed to read %s of the repository: %v", RepoTemplate, err)
+    }
+
+    var prompt strings.Builder
+    if err := tmpl.ExecuteTemplate(&prompt, "system", data); err != nil {
+        return "", fmt.Errorf("failed to render system prompt: %v", err)
+    }
+    return prompt.String(), nil
+}
+
+// readConventions returns the coding conventions checked into the
+// repository, or an empty string if there are none.
+func readConventions(repoDir string) (string, error) {
+    for _, name := range conventionFiles {
+        content, err := ioutil.ReadFile(filepath.Join(repoDir, name))
+        if os.IsNotExist(err) {
+            continue
+        }
+        if err != nil {
+            return "", fmt.Errorf("failed to read %s: %v", name, err)
+        }
+        // Keep the beginning, where the most important conventions usually are
+        conventions, cut := tokens.Truncate(strings.TrimSpace(string(content)), maxConventionsTokens)
+        if cut > 0 {
+            conventions += fmt.Sprintf("\n[... %d more lines of %s omitted ...]", cut, name)
+        }
+        return conventions, nil
+    }
+    return "", nil
+}
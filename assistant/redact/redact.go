@@ -0,0 +1,345 @@
+// Package redact masks credentials in repository content before it is sent
+// to a model or written to the log. Secrets are found with patterns for
+// well-known key formats, with an entropy check for random-looking strings
+// and quoted values assigned to names like "password", and by file name for
+// .env files, whose values are all masked.
+//
+// Each secret is replaced by a placeholder like
+// [REDACTED:aws-access-key:1f2e3d4c], derived from the secret itself, so
+// the same secret always gets the same placeholder. When the model copies a
+// placeholder into a file it returns, Restore puts the secret back.
+package redact
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "math"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "unicode"
+)
+
+// Rule finds one kind of secret. If the pattern has a group, only the text
+// of the first group is the secret, otherwise the whole match is.
+type Rule struct {
+    Name       string
+    Pattern    *regexp.Regexp
+    MinEntropy float64 // Bits per character the secret needs, 0 to accept any match
+    Mixed      bool    // The secret needs upper and lower case letters and digits
+}
+
+// defaultMinEntropy is the entropy random-looking strings need to count as
+// secrets. Base64 keys have about 5 bits per character, hex hashes at
+// most 4 and identifiers well below that.
+const defaultMinEntropy = 4.5
+
+// builtinRules are tried in order; a secret found by one rule is not
+// looked at by the ones after it.
+var builtinRules = []Rule{
+    {Name: "private-key", Pattern: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+    {Name: "aws-access-key", Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+    {Name: "github-token", Pattern: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`)},
+    {Name: "anthropic-key", Pattern: regexp.MustCompile(`\bsk-ant-[A-Za-z0-9_\-]{20,}`)},
+    {Name: "openai-key", Pattern: regexp.MustCompile(`\bsk-[A-Za-z0-9_\-]{20,}`)},
+    {Name: "slack-token", Pattern: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9\-]{10,}`)},
+    {Name: "google-api-key", Pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}`)},
+    {Name: "jwt", Pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]{10,}\.eyJ[A-Za-z0-9_\-]{10,}\.[A-Za-z0-9_\-]{10,}`)},
+    {Name: "url-password", Pattern: regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.\-]*://[^/\s:@]+:([^/\s@]+)@`)},
+    {Name: "secret-assignment", Pattern: regexp.MustCompile(`(?i)(?:api[_\-]?key|secret|token|passw(?:or)?d|credentials?)[a-z0-9_\-]*["']?\s*(?::=|=>|[:=])\s*["']([^"'\s]{8,})["']`), MinEntropy: 3},
+    {Name: "high-entropy", Pattern: regexp.MustCompile(`[A-Za-z0-9+/_\-]{32,}={0,2}`), MinEntropy: defaultMinEntropy, Mixed: true},
+}
+
+// builtinAllow matches secrets that are known to be examples.
+var builtinAllow = []*regexp.Regexp{
+    regexp.MustCompile(`(?i)example|placeholder|changeme|dummy|x{8,}`),
+    regexp.MustCompile(`^\[REDACTED:`),
+}
+
+// Config is the format of the file given to LoadConfig, for example
+// {"patterns": [{"name": "internal-token", "pattern": "itk_[a-z0-9]{32}"}],
+// "allow": ["^test-"], "min_entropy": 4.2}.
+type Config struct {
+    Patterns []struct {
+        Name       string  `json:"name"`
+        Pattern    string  `json:"pattern"`
+        MinEntropy float64 `json:"min_entropy"`
+    } `json:"patterns"`
+    Allow      []string `json:"allow"`       // Patterns of secrets to leave alone
+    MinEntropy float64  `json:"min_entropy"` // Replaces the entropy needed by random-looking strings
+}
+
+var configMu sync.Mutex
+var configuredRules = builtinRules
+var configuredAllow = builtinAllow
+
+// LoadConfig reads a JSON file with additional patterns and allowed
+// secrets, see Config. The patterns are tried before the built-in ones.
+func LoadConfig(path string) error {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("failed to read redaction configuration: %v", err)
+    }
+    var config Config
+    if err := json.Unmarshal(content, &config); err != nil {
+        return fmt.Errorf("failed to parse redaction configuration %s: %v", path, err)
+    }
+
+    var rules []Rule
+    for _, p := range config.Patterns {
+        pattern, err := regexp.Compile(p.Pattern)
+        if err != nil {
+            return fmt.Errorf("redaction pattern %s: %v", p.Name, err)
+        }
+        if p.Name == "" {
+            return fmt.Errorf("redaction pattern %q has no name", p.Pattern)
+        }
+        rules = append(rules, Rule{Name: p.Name, Pattern: pattern, MinEntropy: p.MinEntropy})
+    }
+    for _, rule := range builtinRules {
+        if rule.Name == "high-entropy" && config.MinEntropy > 0 {
+            rule.MinEntropy = config.MinEntropy
+        }
+        rules = append(rules, rule)
+    }
+    allow := append([]*regexp.Regexp(nil), builtinAllow...)
+    for _, a := range config.Allow {
+        pattern, err := regexp.Compile(a)
+        if err != nil {
+            return fmt.Errorf("allowed secret pattern %q: %v", a, err)
+        }
+        allow = append(allow, pattern)
+    }
+
+    configMu.Lock()
+    defer configMu.Unlock()
+    configuredRules = rules
+    configuredAllow = allow
+    return nil
+}
+
+// finding is a secret that was masked.
+type finding struct {
+    rule   string
+    source string // The file it was found in, or "" if unknown
+}
+
+// Redactor masks the secrets of one job and remembers them, so that they
+// can be restored and reported. A nil *Redactor masks nothing.
+type Redactor struct {
+    rules []Rule
+    allow []*regexp.Regexp
+
+    mu       sync.Mutex
+    secrets  map[string]string   // Placeholder to secret
+    findings map[string][]finding // Placeholder to where it was found
+}
+
+// New returns a Redactor with the configured rules.
+func New() *Redactor {
+    configMu.Lock()
+    defer configMu.Unlock()
+    return &Redactor{
+        rules:    configuredRules,
+        allow:    configuredAllow,
+        secrets:  map[string]string{},
+        findings: map[string][]finding{},
+    }
+}
+
+// Redact masks the secrets in text.
+func (r *Redactor) Redact(text string) string {
+    return r.redact(text, "")
+}
+
+// RedactFile masks the secrets in the content of the file at path. All
+// values of .env files are masked, whatever they look like.
+func (r *Redactor) RedactFile(path string, content string) string {
+    if isEnvFile(path) {
+        content = envValue.ReplaceAllStringFunc(content, func(line string) string {
+            match := envValue.FindStringSubmatchIndex(line)
+            value := line[match[2]:match[3]]
+            return line[:match[2]] + r.mask("env-file", value, path) + line[match[3]:]
+        })
+    }
+    return r.redact(content, path)
+}
+
+// envValue matches the value of a line like "export KEY=value" in a .env
+// file, without quotes.
+var envValue = regexp.MustCompile(`(?m)^(?:export\s+)?[A-Za-z_][A-Za-z0-9_.]*\s*=\s*["']?([^"'\r\n]+?)["']?\s*$`)
+
+// isEnvFile reports whether path names a .env file, not counting the
+// examples that are checked in to document the variables.
+func isEnvFile(path string) bool {
+    name := filepath.Base(path)
+    if name != ".env" && !strings.HasPrefix(name, ".env.") {
+        return false
+    }
+    for _, suffix := range []string{".example", ".sample", ".template", ".dist"} {
+        if strings.HasSuffix(name, suffix) {
+            return false
+        }
+    }
+    return true
+}
+
+func (r *Redactor) redact(text string, source string) string {
+    if r == nil {
+        return text
+    }
+    for _, rule := range r.rules {
+        rule := rule
+        text = rule.Pattern.ReplaceAllStringFunc(text, func(match string) string {
+            // Mask only the group if the rule has one
+            start, end := 0, len(match)
+            if indexes := rule.Pattern.FindStringSubmatchIndex(match); len(indexes) >= 4 && indexes[2] >= 0 {
+                start, end = indexes[2], indexes[3]
+            }
+            secret := match[start:end]
+            if !r.isSecret(rule, secret) {
+                return match
+            }
+            return match[:start] + r.mask(rule.Name, secret, source) + match[end:]
+        })
+    }
+    return text
+}
+
+// isSecret checks a match of rule against the entropy requirements and the
+// allowed secrets.
+func (r *Redactor) isSecret(rule Rule, secret string) bool {
+    for _, allow := range r.allow {
+        if allow.MatchString(secret) {
+            return false
+        }
+    }
+    if rule.Mixed && !hasMixedClasses(secret) {
+        return false
+    }
+    return rule.MinEntropy == 0 || entropy(secret) >= rule.MinEntropy
+}
+
+// mask records a secret and returns its placeholder.
+func (r *Redactor) mask(rule string, secret string, source string) string {
+    if r == nil {
+        return secret
+    }
+    hash := sha256.Sum256([]byte(secret))
+    placeholder := fmt.Sprintf("[REDACTED:%s:%s]", rule, hex.EncodeToString(hash[:4]))
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.secrets[placeholder] = secret
+
+    // Remember every file the secret is in; where it is known, a finding
+    // of unknown origin adds nothing
+    findings := r.findings[placeholder]
+    for _, existing := range findings {
+        if existing.source == source || source == "" {
+            return placeholder
+        }
+    }
+    if len(findings) == 1 && findings[0].source == "" {
+        findings = nil
+    }
+    r.findings[placeholder] = append(findings, finding{rule: rule, source: source})
+    return placeholder
+}
+
+// Restore replaces the placeholders in text with the secrets they stand
+// for.
+func (r *Redactor) Restore(text string) string {
+    if r == nil || !strings.Contains(text, "[REDACTED:") {
+        return text
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for placeholder, secret := range r.secrets {
+        text = strings.Replace(text, placeholder, secret, -1)
+    }
+    return text
+}
+
+// Report summarizes what was masked, or returns an empty string if
+// nothing was.
+func (r *Redactor) Report() string {
+    if r == nil {
+        return ""
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if len(r.findings) == 0 {
+        return ""
+    }
+
+    // Count the secrets of each rule in each file
+    counts := map[finding]int{}
+    for _, findings := range r.findings {
+        for _, f := range findings {
+            counts[f]++
+        }
+    }
+    var parts []string
+    for f, count := range counts {
+        part := fmt.Sprintf("%d %s", count, f.rule)
+        if f.source != "" {
+            part += " in " + f.source
+        }
+        parts = append(parts, part)
+    }
+    sort.Strings(parts)
+    noun := "secrets"
+    if len(r.secrets) == 1 {
+        noun = "secret"
+    }
+    return fmt.Sprintf("Redacted %d %s before sending: %s", len(r.secrets), noun, strings.Join(parts, ", "))
+}
+
+// entropy returns the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+    counts := map[rune]int{}
+    total := 0
+    for _, c := range s {
+        counts[c]++
+        total++
+    }
+    var bits float64
+    for _, count := range counts {
+        p := float64(count) / float64(total)
+        bits -= p * math.Log2(p)
+    }
+    return bits
+}
+
+// hasMixedClasses reports whether s has upper and lower case letters and
+// digits, like generated keys and unlike paths and identifiers.
+func hasMixedClasses(s string) bool {
+    var upper, lower, digit bool
+    for _, c := range s {
+        upper = upper || unicode.IsUpper(c)
+        lower = lower || unicode.IsLower(c)
+        digit = digit || unicode.IsDigit(c)
+    }
+    return upper && lower && digit
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying r, for code that logs or returns
+// content far from where the job's Redactor was made.
+func NewContext(ctx context.Context, r *Redactor) context.Context {
+    return context.WithValue(ctx, contextKey{}, r)
+}
+
+// FromContext returns the Redactor of ctx, or nil, which masks nothing.
+func FromContext(ctx context.Context) *Redactor {
+    r, _ := ctx.Value(contextKey{}).(*Redactor)
+    return r
+}
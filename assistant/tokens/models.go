@@ -0,0 +1,58 @@
+package tokens
+
+import (
+    "strings"
+)
+
+// ModelLimits describes the token limits of a model.
+type ModelLimits struct {
+    ContextWindow int // Prompt and reply together
+    MaxOutput     int // Tokens reserved for the reply
+}
+
+// modelLimits maps model name prefixes to their limits. The first matching
+// prefix wins, so more specific prefixes come first.
+var modelLimits = []struct {
+    prefix string
+    limits ModelLimits
+}{
+    {"gpt-4o-mini", ModelLimits{128000, 16384}},
+    {"gpt-4o", ModelLimits{128000, 16384}},
+    {"gpt-4.1", ModelLimits{1047576, 32768}},
+    {"gpt-4-turbo", ModelLimits{128000, 4096}},
+    {"gpt-4", ModelLimits{8192, 4096}},
+    {"gpt-3.5-turbo", ModelLimits{16385, 4096}},
+    {"gpt-5", ModelLimits{400000, 128000}},
+    {"o1", ModelLimits{200000, 100000}},
+    {"o3", ModelLimits{200000, 100000}},
+    {"o4-mini", ModelLimits{200000, 100000}},
+    {"claude", ModelLimits{200000, 16384}},
+    {"llama3", ModelLimits{128000, 8192}},
+    {"qwen2.5-coder", ModelLimits{32768, 8192}},
+}
+
+// defaultLimits is used for models we know nothing about, mostly local ones.
+// Local servers often run with a small context unless configured otherwise.
+var defaultLimits = ModelLimits{8192, 2048}
+
+// LimitsFor returns the limits of the given model.
+func LimitsFor(model string) ModelLimits {
+    for _, entry := range modelLimits {
+        if strings.HasPrefix(model, entry.prefix) {
+            return entry.limits
+        }
+    }
+    return defaultLimits
+}
+
+// Count is an estimate, which may be below the real count for some text, so
+// this share of the context window, in percent, is kept free as well.
+const safetyMarginPercent = 5
+
+// InputBudget returns how many tokens the prompt for model may use: the
+// context window minus the space reserved for the reply and a safety margin
+// for the errors of Count.
+func InputBudget(model string) int {
+    limits := LimitsFor(model)
+    return limits.ContextWindow - limits.MaxOutput - limits.ContextWindow*safetyMarginPercent/100
+}
@@ -0,0 +1,159 @@
+package tokens
+
+import (
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// Count returns the number of tokens text is expected to use. It splits the
+// text the way the pre-tokenizers of the GPT, Claude and Llama BPE
+// vocabularies do (letter runs, digit groups, punctuation runs, whitespace
+// runs) and then estimates how many vocabulary pieces each part needs.
+// Encoded data like base64 or hex, which the vocabularies barely merge, is
+// counted at blobTokensPer100Bytes instead.
+//
+// It is an estimate, not a tokenizer. Measured against the cl100k and o200k
+// vocabularies it is about a fifth above the real count for source code and
+// English prose, and above it for encoded data and Cyrillic and CJK text.
+// Other vocabularies and unusual text may still come out higher than this,
+// so InputBudget keeps a safety margin.
+func Count(text string) int {
+    count := 0
+    for i := 0; i < len(text); {
+        r, size := utf8.DecodeRuneInString(text[i:])
+        start := i
+        switch {
+        case isBlob(text[i:]):
+            i = scanWhile(text, i, isBlobRune)
+            count += (i - start) * blobTokensPer100Bytes / 100
+        case isWordRune(r):
+            // Words are merged with one leading space, so the space is free.
+            i = scanWhile(text, i, isWordRune)
+            count += wordTokens(text[start:i])
+        case unicode.IsDigit(r):
+            // Numbers are split into groups of up to three digits.
+            i = scanWhile(text, i, unicode.IsDigit)
+            count += (i - start + 2) / 3
+        case unicode.IsSpace(r):
+            // A whitespace run is one token, unless a word follows it, in
+            // which case its last space is merged into the word.
+            i = scanWhile(text, i, unicode.IsSpace)
+            if i-start > 1 || i >= len(text) || !startsWord(text[i:]) || r != ' ' {
+                count++
+            }
+        case r < utf8.RuneSelf:
+            // Punctuation runs like "();" or "->" merge in pairs.
+            i = scanWhile(text, i, isASCIIPunct)
+            count += (i - start + 1) / 2
+        default:
+            // Other symbols and scripts without word merges: roughly one
+            // token per character.
+            i += size
+            count++
+        }
+    }
+    return count
+}
+
+// wordTokens estimates the vocabulary pieces of a run of letters. Common
+// words are a single token; identifiers are split at case changes and
+// underscores, and each part needs about one token per six characters.
+func wordTokens(word string) int {
+    count := 0
+    partLen := 0
+    var prev rune
+    for _, r := range word {
+        if r >= utf8.RuneSelf {
+            // Non-ASCII letters are rarely merged.
+            count++
+            partLen = 0
+        } else if r == '_' || (unicode.IsUpper(r) && unicode.IsLower(prev)) {
+            if partLen > 0 {
+                count += (partLen + 5) / 6
+            }
+            partLen = 0
+            if r != '_' {
+                partLen = 1
+            }
+        } else {
+            partLen++
+        }
+        prev = r
+    }
+    if partLen > 0 {
+        count += (partLen + 5) / 6
+    }
+    if count == 0 {
+        count = 1
+    }
+    return count
+}
+
+// Runs of at least blobMinBytes letters, digits and the other characters of
+// base64 that mix letters and digits are encoded data. They need about
+// blobTokensPer100Bytes tokens per 100 bytes: measured at 72 for base64 and 57
+// for hex, with some room added.
+const blobMinBytes = 64
+const blobTokensPer100Bytes = 80
+
+// isBlob reports whether text starts with encoded data.
+func isBlob(text string) bool {
+    letters, digits := false, false
+    for i := 0; i < len(text); i++ {
+        c := rune(text[i])
+        if !isBlobRune(c) {
+            return false
+        }
+        letters = letters || unicode.IsLetter(c)
+        digits = digits || unicode.IsDigit(c)
+        if i+1 >= blobMinBytes && letters && digits {
+            return true
+        }
+    }
+    return false
+}
+
+func isBlobRune(r rune) bool {
+    return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("+/=_-", r))
+}
+
+func isWordRune(r rune) bool {
+    return unicode.IsLetter(r) || r == '_'
+}
+
+func isASCIIPunct(r rune) bool {
+    return r < utf8.RuneSelf && !isWordRune(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+}
+
+func startsWord(text string) bool {
+    r, _ := utf8.DecodeRuneInString(text)
+    return isWordRune(r)
+}
+
+// scanWhile returns the index of the first rune at or after i that does not
+// satisfy match.
+func scanWhile(text string, i int, match func(rune) bool) int {
+    for i < len(text) {
+        r, size := utf8.DecodeRuneInString(text[i:])
+        if !match(r) {
+            break
+        }
+        i += size
+    }
+    return i
+}
+
+// Truncate returns the longest prefix of content, cut at a line boundary,
+// that fits into maxTokens, and the number of lines cut off.
+func Truncate(content string, maxTokens int) (string, int) {
+    lines := strings.SplitAfter(content, "\n")
+    used := 0
+    for i, line := range lines {
+        used += Count(line)
+        if used > maxTokens {
+            return strings.Join(lines[:i], ""), len(lines) - i
+        }
+    }
+    return content, 0
+}
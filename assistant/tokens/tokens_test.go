@@ -0,0 +1,71 @@
+package tokens
+
+import (
+    "encoding/base64"
+    "fmt"
+    "math/rand"
+    "strings"
+    "testing"
+)
+
+// base64File returns a Go file that embeds 12000 random bytes as base64.
+func base64File() string {
+    data := make([]byte, 12000)
+    rand.New(rand.NewSource(1)).Read(data)
+    encoded := base64.StdEncoding.EncodeToString(data)
+    var b strings.Builder
+    b.WriteString("package assets\n\n// logo is the embedded logo.\nvar logo = \"\" +\n")
+    for i := 0; i < len(encoded); i += 76 {
+        end := min(i+76, len(encoded))
+        fmt.Fprintf(&b, "    %q +\n", encoded[i:end])
+    }
+    b.WriteString("    \"\"\n")
+    return b.String()
+}
+
+func TestCountBase64(t *testing.T) {
+    file := base64File()
+    // The real counts of the file, by the tiktoken encodings of the OpenAI
+    // models
+    real := map[string]int{"cl100k_base": 12358, "o200k_base": 11810}
+    count := Count(file)
+    for encoding, tokens := range real {
+        if count < tokens {
+            t.Errorf("Count = %d, below the %d tokens of %s", count, tokens, encoding)
+        }
+    }
+    // The estimate must not be so high that it wastes the window
+    if count > real["cl100k_base"]*5/4 {
+        t.Errorf("Count = %d, far above the %d tokens of cl100k_base", count, real["cl100k_base"])
+    }
+}
+
+func TestCountBlobs(t *testing.T) {
+    hex := strings.Repeat("0123456789abcdef", 8)
+    tests := []struct {
+        text string
+        want int
+    }{
+        // Encoded data is counted by its length
+        {hex, len(hex) * blobTokensPer100Bytes / 100},
+        {"x = \"" + hex + "\"", Count("x = \"") + len(hex)*blobTokensPer100Bytes/100 + Count("\"")},
+        // Long words without digits, and short mixed ones, are not
+        {strings.Repeat("abcdef", 12), 12},
+        {"a1b2c3", 6},
+    }
+    for _, test := range tests {
+        if got := Count(test.text); got != test.want {
+            t.Errorf("Count(%q) = %d, want %d", test.text, got, test.want)
+        }
+    }
+}
+
+func TestInputBudgetKeepsMargin(t *testing.T) {
+    for _, model := range []string{"gpt-4o", "claude-sonnet-4", "unknown-local-model"} {
+        limits := LimitsFor(model)
+        budget := InputBudget(model)
+        if margin := limits.ContextWindow - limits.MaxOutput - budget; margin < limits.ContextWindow/20 {
+            t.Errorf("InputBudget(%s) = %d keeps only %d tokens of %d spare", model, budget, margin, limits.ContextWindow)
+        }
+    }
+}
@@ -8,4 +8,11 @@ type FormData struct {
     Files        []string
     Prompt       string
     RepoType     string
+    Provider     string // LLM provider: "openai", "anthropic" or "local"
+    EditFormat   string // "markers" (default), "diff" for unified diffs, "blocks" for search/replace blocks, "declarations" for changed Go or C++ declarations or "json" for structured output
+    UseTools     bool   // Let the model read and search the repository with tools
+    Params       ModelParams
+    BypassCache  bool // Always ask the model, even if the response cache has a reply
+    Candidates   int      // Independent candidates to generate, the best passing one is used; 0 means 1
+    TieBreakers  []string // How to choose among passing candidates with equally small diffs, see assistant.TieBreakers
 }
\ No newline at end of file
@@ -0,0 +1,19 @@
+package types
+
+// ModelParams selects the model of a job and how it samples its reply.
+// Empty fields fall back to the server configuration, and then to the
+// defaults of the provider and the model.
+type ModelParams struct {
+    Model           string   `json:"model,omitempty"`
+    Temperature     *float64 `json:"temperature,omitempty"`
+    MaxTokens       int      `json:"max_tokens,omitempty"` // Limit of the reply
+    Seed            *int64   `json:"seed,omitempty"`
+    ReasoningEffort string   `json:"reasoning_effort,omitempty"` // For reasoning models: "low", "medium" or "high"
+    Escalation      []string `json:"escalation,omitempty"`       // Stronger models to move to, in order, after a build or test failure
+}
+
+// Ladder returns the models a job may use, starting with Model and
+// followed by the escalation models.
+func (p ModelParams) Ladder() []string {
+    return append([]string{p.Model}, p.Escalation...)
+}
@@ -0,0 +1,17 @@
+package types
+
+// ProgressUpdate is one event of a running job. The web interface forwards
+// these to the browser while the job runs.
+type ProgressUpdate struct {
+    // Kind is "stage" for a new step of the pipeline, "output" for a piece
+    // of the streamed model reply and "file" when the model starts (or,
+    // with an empty Text, finishes) writing a file. "tool" reports a tool
+    // call of the model, with the tool name and its arguments. "attempt" is
+    // the stage that starts a new model request of a candidate, whose
+    // output replaces that of the one before.
+    Kind string `json:"kind"`
+    Text string `json:"text"`
+}
+
+// ProgressFunc receives the progress updates of a job.
+type ProgressFunc func(update ProgressUpdate)
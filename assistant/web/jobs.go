@@ -0,0 +1,121 @@
+package web
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "sync"
+    "time"
+
+    "github.com/thomasdullien/coding-assistant/assistant/types"
+)
+
+// job is a ProcessAssistant run started from the web interface. It keeps
+// every progress update, so that a browser connecting late (or reconnecting)
+// still sees the whole history.
+type job struct {
+    id     string
+    ctx    context.Context
+    cancel context.CancelFunc // Aborts the job
+
+    mu      sync.Mutex
+    updates []types.ProgressUpdate
+    changed chan struct{} // Closed and replaced whenever the job changes
+    done     bool
+    finished time.Time // When done was set
+    result   jobResult
+}
+
+// jobResult is what the result page shows of a finished job.
+type jobResult struct {
+    Message    string
+    Link       string   // The pull request, if one was created
+    Usage      string   // Token usage and cost summary
+    Candidates []string // How each candidate did, if there were several
+    Redactions string   // The secrets masked before sending, if any
+}
+
+// How long the pages of a finished job stay available. Finished jobs are
+// dropped after that, so that a long-running server does not keep them all.
+const finishedJobTTL = time.Hour
+
+var jobsMu sync.Mutex
+var jobs = map[string]*job{}
+
+// newJob creates and registers a job with a random ID, and drops the jobs
+// that finished more than finishedJobTTL ago.
+func newJob() *job {
+    idBytes := make([]byte, 8)
+    rand.Read(idBytes)
+    j := &job{
+        id:      hex.EncodeToString(idBytes),
+        changed: make(chan struct{}),
+    }
+    j.ctx, j.cancel = context.WithCancel(context.Background())
+
+    jobsMu.Lock()
+    pruneJobsLocked(time.Now())
+    jobs[j.id] = j
+    jobsMu.Unlock()
+    return j
+}
+
+// pruneJobsLocked drops the jobs that finished more than finishedJobTTL
+// before now. Running jobs are kept however old they are.
+func pruneJobsLocked(now time.Time) {
+    for id, j := range jobs {
+        j.mu.Lock()
+        expired := j.done && now.Sub(j.finished) > finishedJobTTL
+        j.mu.Unlock()
+        if expired {
+            delete(jobs, id)
+        }
+    }
+}
+
+// findJob returns the job with the given ID, or nil.
+func findJob(id string) *job {
+    jobsMu.Lock()
+    defer jobsMu.Unlock()
+    return jobs[id]
+}
+
+// report records a progress update and wakes up all listeners.
+func (j *job) report(update types.ProgressUpdate) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    j.updates = append(j.updates, update)
+    j.notifyLocked()
+}
+
+// finish records the result of the job and wakes up all listeners.
+func (j *job) finish(result jobResult) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    j.done = true
+    j.finished = time.Now()
+    j.result = result
+    j.notifyLocked()
+    j.cancel()
+}
+
+func (j *job) notifyLocked() {
+    close(j.changed)
+    j.changed = make(chan struct{})
+}
+
+// snapshot returns the updates starting at index from, a channel that is
+// closed on the next change, and whether the job has finished.
+func (j *job) snapshot(from int) ([]types.ProgressUpdate, <-chan struct{}, bool) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    updates := append([]types.ProgressUpdate(nil), j.updates[from:]...)
+    return updates, j.changed, j.done
+}
+
+// outcome returns the result of the job and whether it has finished.
+func (j *job) outcome() (jobResult, bool) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return j.result, j.done
+}
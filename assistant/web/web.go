@@ -1,9 +1,13 @@
 package web
 
 import (
+    "encoding/json"
+    "fmt"
     "text/template"
     "net/http"
     "log"
+    "strconv"
+    "strings"
 
     "github.com/thomasdullien/coding-assistant/assistant/assistant"
     "github.com/thomasdullien/coding-assistant/assistant/types" 
@@ -11,11 +15,16 @@ import (
 
 var tmpl = template.Must(template.ParseFiles("web/templates/index.html"))
 var resultTmpl = template.Must(template.ParseFiles("web/templates/result.html"))
+var jobTmpl = template.Must(template.ParseFiles("web/templates/job.html"))
 
 // Serve the web interface
 func ServeWebInterface() {
     http.HandleFunc("/", homeHandler)
     http.HandleFunc("/submit", submitHandler)
+    http.HandleFunc("/job", jobHandler)
+    http.HandleFunc("/events", eventsHandler)
+    http.HandleFunc("/abort", abortHandler)
+    http.HandleFunc("/result", resultHandler)
     http.ListenAndServe(":8080", nil)
 }
 
@@ -26,29 +35,184 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 // Handle form submission
 func submitHandler(w http.ResponseWriter, r *http.Request) {
     r.ParseForm()
+    params, err := parseModelParams(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    candidates := 1
+    if value := strings.TrimSpace(r.FormValue("candidates")); value != "" {
+        candidates, err = strconv.Atoi(value)
+        if err != nil {
+            http.Error(w, fmt.Sprintf("invalid number of candidates %q", value), http.StatusBadRequest)
+            return
+        }
+    }
     data := types.FormData{
         GithubUser:   r.FormValue("githubUser"),
         RepoURL:      r.FormValue("repoURL"),
         Branch:       "assistant-branch",
-        Files:        r.Form["files"],
+        Files:        splitFileList(r.FormValue("files")),
         Prompt:       r.FormValue("prompt"),
         RepoType:     r.FormValue("repoType"), // Capture the repository type
+        Provider:     r.FormValue("provider"), // Capture the LLM provider
+        EditFormat:   r.FormValue("editFormat"),
+        UseTools:     r.FormValue("useTools") == "on",
+        Params:       params,
+        BypassCache:  r.FormValue("bypassCache") == "on",
+        Candidates:   candidates,
+        TieBreakers:  splitFileList(r.FormValue("tieBreakers")),
     }
 
-    // Run ProcessAssistant and capture the pull request link or error
-    prLink, err := assistant.ProcessAssistant(data)
+    // Run ProcessAssistant in the background and send the browser to the
+    // job page, which shows its progress live
+    j := newJob()
+    go runJob(j, data)
+    http.Redirect(w, r, "/job?id="+j.id, http.StatusSeeOther)
+}
+
+// splitFileList splits a comma-separated list of the form, like the files.
+func splitFileList(files string) []string {
+    var result []string
+    for _, file := range strings.Split(files, ",") {
+        if file = strings.TrimSpace(file); file != "" {
+            result = append(result, file)
+        }
+    }
+    return result
+}
+
+// parseModelParams reads the optional model and sampling fields of the form.
+// Whether the model accepts them is checked when the job starts, once the
+// provider's defaults are known.
+func parseModelParams(r *http.Request) (types.ModelParams, error) {
+    params := types.ModelParams{
+        Model:           strings.TrimSpace(r.FormValue("model")),
+        ReasoningEffort: r.FormValue("reasoningEffort"),
+        Escalation:      splitFileList(r.FormValue("escalation")),
+    }
+    if value := strings.TrimSpace(r.FormValue("temperature")); value != "" {
+        temperature, err := strconv.ParseFloat(value, 64)
+        if err != nil {
+            return params, fmt.Errorf("invalid temperature %q", value)
+        }
+        params.Temperature = &temperature
+    }
+    if value := strings.TrimSpace(r.FormValue("maxTokens")); value != "" {
+        maxTokens, err := strconv.Atoi(value)
+        if err != nil || maxTokens <= 0 {
+            return params, fmt.Errorf("invalid max tokens %q", value)
+        }
+        params.MaxTokens = maxTokens
+    }
+    if value := strings.TrimSpace(r.FormValue("seed")); value != "" {
+        seed, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            return params, fmt.Errorf("invalid seed %q", value)
+        }
+        params.Seed = &seed
+    }
+    return params, nil
+}
+
+// runJob runs ProcessAssistant and records the pull request link or error,
+// along with what the job cost.
+func runJob(j *job, data types.FormData) {
+    result, err := assistant.ProcessAssistant(j.ctx, data, j.report)
+    outcome := jobResult{
+        Message:    "Pull request created successfully!",
+        Link:       result.PRLink,
+        Usage:      result.Usage.Summary(),
+        Candidates: result.Candidates,
+        Redactions: result.Redactions,
+    }
     if err != nil {
         log.Printf("Error in ProcessAssistant: %v", err)
-        resultTmpl.Execute(w, map[string]string{
-            "Message": "An error occurred: " + err.Error(),
-            "Link":    "",
-        })
+        outcome.Message = "An error occurred: " + err.Error()
+    }
+    j.finish(outcome)
+}
+
+// Show the live progress page of a job
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+    j := findJob(r.FormValue("id"))
+    if j == nil {
+        http.NotFound(w, r)
+        return
+    }
+    jobTmpl.Execute(w, map[string]string{"ID": j.id})
+}
+
+// Stream the progress updates of a job as server-sent events. Each update is
+// sent as a "progress" event; a final "done" event tells the page to load
+// the result.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+    j := findJob(r.FormValue("id"))
+    if j == nil {
+        http.NotFound(w, r)
+        return
+    }
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming not supported", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    sent := 0
+    for {
+        updates, changed, done := j.snapshot(sent)
+        for _, update := range updates {
+            payload, _ := json.Marshal(update)
+            fmt.Fprintf(w, "event: progress\ndata: %s\n\n", payload)
+        }
+        sent += len(updates)
+        if done {
+            fmt.Fprintf(w, "event: done\ndata: {}\n\n")
+            flusher.Flush()
+            return
+        }
+        flusher.Flush()
+
+        select {
+        case <-changed:
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
+
+// Abort a running job. The job page then receives the final "done" event
+// once ProcessAssistant has returned.
+func abortHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    j := findJob(r.FormValue("id"))
+    if j == nil {
+        http.NotFound(w, r)
+        return
+    }
+    log.Printf("Aborting job %s", j.id)
+    j.cancel()
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// Show the result page of a finished job
+func resultHandler(w http.ResponseWriter, r *http.Request) {
+    j := findJob(r.FormValue("id"))
+    if j == nil {
+        http.NotFound(w, r)
+        return
+    }
+    result, done := j.outcome()
+    if !done {
+        http.Redirect(w, r, "/job?id="+j.id, http.StatusSeeOther)
         return
     }
 
     // Show the result page with the pull request link
-    resultTmpl.Execute(w, map[string]string{
-        "Message": "Pull request created successfully!",
-        "Link":    prLink,
-    })
-}
\ No newline at end of file
+    resultTmpl.Execute(w, result)
+}